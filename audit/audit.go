@@ -0,0 +1,232 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/redaction"
+	"code.cloudfoundry.org/stager/stager_metrics"
+)
+
+const AuditEventsDroppedCounter = stager_metrics.Counter("AuditEventsDropped")
+
+func init() {
+	stager_metrics.RegisterCounters(AuditEventsDroppedCounter)
+}
+
+var ErrChainBroken = errors.New("audit log hash chain is broken")
+
+// Audited actions. ActionDesireQueuedTask records the outcome of a staging
+// request that was queued, once its task has been desired or abandoned.
+const (
+	ActionStage            = "stage"
+	ActionStopStaging      = "stop-staging"
+	ActionStagingCompleted = "staging-completed"
+	ActionDesireQueuedTask = "desire-queued-task"
+)
+
+// Outcomes of an audited action. OutcomeAccepted is recorded for a staging
+// request that was queued rather than desired.
+const (
+	OutcomeSuccess  = "success"
+	OutcomeFailure  = "failure"
+	OutcomeAccepted = "accepted"
+)
+
+// Event is a single entry of the audit log. Error is the sanitized error
+// reported to CC, never the raw failure reason.
+type Event struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Action      string    `json:"action"`
+	Actor       string    `json:"actor"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	StagingGuid string    `json:"staging_guid"`
+	AppId       string    `json:"app_id,omitempty"`
+	Lifecycle   string    `json:"lifecycle,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	StatusCode  int       `json:"status_code"`
+	Outcome     string    `json:"outcome"`
+	ErrorId     string    `json:"error_id,omitempty"`
+	Error       string    `json:"error,omitempty"`
+
+	// PreviousHash and Hash chain the entries of the log together with an
+	// HMAC keyed by the configured audit key, so that removing or altering an
+	// entry invalidates every entry after it unless the key is known.
+	PreviousHash string `json:"previous_hash"`
+	Hash         string `json:"hash"`
+}
+
+//go:generate counterfeiter -o fakes/fake_recorder.go . Recorder
+type Recorder interface {
+	Record(event Event)
+}
+
+type discardRecorder struct{}
+
+func (discardRecorder) Record(Event) {}
+
+// Discard is a Recorder that drops every event.
+var Discard Recorder = discardRecorder{}
+
+// Actor identifies the caller of a request by the common name of its TLS
+// client certificate, if it presented one, and otherwise by the basic auth
+// user it claims. Certificates the TLS handshake did not verify, and basic
+// auth users, which the stager does not authenticate, are marked unverified;
+// the remote address is recorded alongside the actor.
+func Actor(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		commonName := req.TLS.PeerCertificates[0].Subject.CommonName
+		if len(req.TLS.VerifiedChains) > 0 {
+			return "tls-client:" + commonName
+		}
+		return "unverified-tls-client:" + commonName
+	}
+
+	if user, _, ok := req.BasicAuth(); ok {
+		return "unverified-user:" + user
+	}
+
+	return "anonymous"
+}
+
+// JSONRecorder writes events to a writer as HMAC-chained JSON lines. Event
+// errors are redacted, as failure reasons may quote URLs and payloads. Events
+// that cannot be written are logged and counted as AuditEventsDropped.
+type JSONRecorder struct {
+	logger   lager.Logger
+	key      []byte
+	redactor *redaction.Redactor
+
+	lock     sync.Mutex
+	writer   io.Writer
+	lastHash string
+	now      func() time.Time
+}
+
+func NewJSONRecorder(logger lager.Logger, writer io.Writer, key []byte, lastHash string, redactor *redaction.Redactor) *JSONRecorder {
+	return &JSONRecorder{
+		logger:   logger.Session("audit-recorder"),
+		key:      key,
+		redactor: redactor,
+		writer:   writer,
+		lastHash: lastHash,
+		now:      time.Now,
+	}
+}
+
+// NewFileRecorder appends events to the file at path, continuing the chain of
+// any entries already in it.
+func NewFileRecorder(logger lager.Logger, path string, key []byte, redactor *redaction.Redactor) (*JSONRecorder, error) {
+	lastHash, err := lastHashInFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJSONRecorder(logger, file, key, lastHash, redactor), nil
+}
+
+func (r *JSONRecorder) Record(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = r.now().UTC()
+	}
+	event.Error = r.redactor.RedactString(event.Error)
+	event.PreviousHash = r.lastHash
+	event.Hash = ""
+
+	event.Hash = hashEvent(r.key, event)
+	line, err := json.Marshal(event)
+	if err != nil {
+		r.drop(event, err)
+		return
+	}
+
+	_, err = r.writer.Write(append(line, '\n'))
+	if err != nil {
+		r.drop(event, err)
+		return
+	}
+	r.lastHash = event.Hash
+}
+
+func (r *JSONRecorder) drop(event Event, err error) {
+	r.logger.Error("failed-to-record-audit-event", err, lager.Data{
+		"action":       event.Action,
+		"staging-guid": event.StagingGuid,
+	})
+	AuditEventsDroppedCounter.Increment()
+}
+
+// Verify checks the chain of an audit log written with key, returning the
+// number of valid entries read and ErrChainBroken if an entry has been
+// altered or removed.
+func Verify(reader io.Reader, key []byte) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	previousHash := ""
+	entries := 0
+
+	for scanner.Scan() {
+		var event Event
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return entries, err
+		}
+
+		hash := event.Hash
+		event.Hash = ""
+		if event.PreviousHash != previousHash || !hmac.Equal([]byte(hashEvent(key, event)), []byte(hash)) {
+			return entries, ErrChainBroken
+		}
+
+		previousHash = hash
+		entries++
+	}
+
+	return entries, scanner.Err()
+}
+
+func hashEvent(key []byte, event Event) string {
+	payload, _ := json.Marshal(event)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func lastHashInFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	lastHash := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			lastHash = event.Hash
+		}
+	}
+
+	return lastHash, scanner.Err()
+}
@@ -0,0 +1,41 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/stager/audit"
+)
+
+type FakeRecorder struct {
+	RecordStub        func(event audit.Event)
+	recordMutex       sync.RWMutex
+	recordArgsForCall []struct {
+		event audit.Event
+	}
+}
+
+func (fake *FakeRecorder) Record(event audit.Event) {
+	fake.recordMutex.Lock()
+	fake.recordArgsForCall = append(fake.recordArgsForCall, struct {
+		event audit.Event
+	}{event})
+	fake.recordMutex.Unlock()
+	if fake.RecordStub != nil {
+		fake.RecordStub(event)
+	}
+}
+
+func (fake *FakeRecorder) RecordCallCount() int {
+	fake.recordMutex.RLock()
+	defer fake.recordMutex.RUnlock()
+	return len(fake.recordArgsForCall)
+}
+
+func (fake *FakeRecorder) RecordArgsForCall(i int) audit.Event {
+	fake.recordMutex.RLock()
+	defer fake.recordMutex.RUnlock()
+	return fake.recordArgsForCall[i].event
+}
+
+var _ audit.Recorder = new(FakeRecorder)
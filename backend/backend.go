@@ -1,15 +1,12 @@
 package backend
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/url"
-	"strconv"
-	"strings"
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
-	"code.cloudfoundry.org/buildpackapplifecycle"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/stager/diego_errors"
 )
@@ -18,20 +15,77 @@ const (
 	TaskLogSource                 = "STG"
 	DefaultStagingTimeout         = 15 * time.Minute
 	TrustedSystemCertificatesPath = "/etc/cf-system-certificates"
+
+	// STAGING_LIMIT_EXCEEDED is reported to CC when a staging request is
+	// rejected by the stager's admission control.
+	STAGING_LIMIT_EXCEEDED = diego_errors.STAGING_LIMIT_EXCEEDED_ID
+
+	// STAGING_IN_PROGRESS is reported to CC when a staging request is rejected
+	// because the app is already staging, and STAGING_SUPERSEDED for an
+	// in-flight staging task that was cancelled in favour of a newer one.
+	STAGING_IN_PROGRESS = diego_errors.STAGING_IN_PROGRESS_ID
+	STAGING_SUPERSEDED  = diego_errors.STAGING_SUPERSEDED_ID
+
+	// INVALID_STAGING_RESULT is reported to CC in place of a staging result
+	// that the lifecycle wrote but that does not match its schema.
+	INVALID_STAGING_RESULT = diego_errors.INVALID_STAGING_RESULT_ID
+
+	// STAGING_OUT_OF_MEMORY, STAGING_DISK_QUOTA_EXCEEDED and STAGING_TIMED_OUT
+	// are reported to CC when a staging task is killed for exceeding its
+	// memory, disk or time limit.
+	STAGING_OUT_OF_MEMORY       = diego_errors.STAGING_OUT_OF_MEMORY_ID
+	STAGING_DISK_QUOTA_EXCEEDED = diego_errors.STAGING_DISK_QUOTA_EXCEEDED_ID
+	STAGING_TIMED_OUT           = diego_errors.STAGING_TIMED_OUT_ID
 )
 
-type FailureReasonSanitizer func(string) *cc_messages.StagingError
+// FailureReasonSanitizer returns the error reported to CC for a staging task
+// of the given lifecycle that failed with reason.
+type FailureReasonSanitizer func(lifecycle, reason string) *cc_messages.StagingError
 
 //go:generate counterfeiter -o fake_backend/fake_backend.go . Backend
 type Backend interface {
 	BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error)
 	BuildStagingResponse(*models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error)
+	Priority(request cc_messages.StagingRequestFromCC) PriorityClass
+}
+
+var ErrNoCompilerDefined = diego_errors.NoCompilerDefined
+var ErrMissingAppId = diego_errors.MissingAppId
+var ErrMissingAppBitsDownloadUri = diego_errors.MissingAppBitsDownloadUri
+var ErrMissingLifecycleData = diego_errors.MissingLifecycleData
+
+// StagingTaskAnnotation is the annotation the stager attaches to staging
+// tasks. It extends the annotation understood by CC with the fields the stager
+// itself needs to reason about in-flight tasks.
+type StagingTaskAnnotation struct {
+	cc_messages.StagingTaskAnnotation
+	AppId            string      `json:"app_id,omitempty"`
+	Stack            string      `json:"stack,omitempty"`
+	IsolationSegment string      `json:"isolation_segment,omitempty"`
+	PriorityClass    string      `json:"priority_class,omitempty"`
+	QueuePriority    int         `json:"queue_priority,omitempty"`
+	Provenance       *Provenance `json:"provenance,omitempty"`
+	Traceparent      string      `json:"traceparent,omitempty"`
 }
 
-var ErrNoCompilerDefined = errors.New(diego_errors.NO_COMPILER_DEFINED_MESSAGE)
-var ErrMissingAppId = errors.New(diego_errors.MISSING_APP_ID_MESSAGE)
-var ErrMissingAppBitsDownloadUri = errors.New(diego_errors.MISSING_APP_BITS_DOWNLOAD_URI_MESSAGE)
-var ErrMissingLifecycleData = errors.New(diego_errors.MISSING_LIFECYCLE_DATA_MESSAGE)
+// SetTraceparent records the trace context of the staging request in the
+// task's annotation so that it can be resumed when the task completes.
+func SetTraceparent(taskDef *models.TaskDefinition, traceparent string) error {
+	var annotation StagingTaskAnnotation
+	err := json.Unmarshal([]byte(taskDef.Annotation), &annotation)
+	if err != nil {
+		return err
+	}
+
+	annotation.Traceparent = traceparent
+	annotationJson, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+
+	taskDef.Annotation = string(annotationJson)
+	return nil
+}
 
 type Config struct {
 	TaskDomain               string
@@ -39,12 +93,14 @@ type Config struct {
 	FileServerURL            string
 	CCUploaderURL            string
 	Lifecycles               map[string]string
+	LifecycleBundles         LifecycleBundles
 	InsecureDockerRegistries []string
 	ConsulCluster            string
 	SkipCertVerify           bool
 	Sanitizer                FailureReasonSanitizer
 	DockerStagingStack       string
 	PrivilegedContainers     bool
+	Priorities               Priorities
 }
 
 func (c Config) CallbackURL(stagingGuid string) string {
@@ -66,35 +122,17 @@ func addTimeoutParamToURL(u url.URL, timeout time.Duration) *url.URL {
 	return &u
 }
 
+// SanitizeErrorMessage classifies a failure with the built-in failure rules.
 func SanitizeErrorMessage(message string) *cc_messages.StagingError {
-	const staging_failed = "staging failed"
-	id := cc_messages.STAGING_ERROR
-	switch {
-	case strings.HasSuffix(message, strconv.Itoa(buildpackapplifecycle.DETECT_FAIL_CODE)):
-		id = cc_messages.BUILDPACK_DETECT_FAILED
-		message = staging_failed
-	case strings.HasSuffix(message, strconv.Itoa(buildpackapplifecycle.COMPILE_FAIL_CODE)):
-		id = cc_messages.BUILDPACK_COMPILE_FAILED
-		message = staging_failed
-	case strings.HasSuffix(message, strconv.Itoa(buildpackapplifecycle.RELEASE_FAIL_CODE)):
-		id = cc_messages.BUILDPACK_RELEASE_FAILED
-		message = staging_failed
-	case strings.HasPrefix(message, diego_errors.INSUFFICIENT_RESOURCES_MESSAGE):
-		id = cc_messages.INSUFFICIENT_RESOURCES
-	case strings.HasPrefix(message, diego_errors.CELL_MISMATCH_MESSAGE):
-		id = cc_messages.NO_COMPATIBLE_CELL
-	case message == diego_errors.CELL_COMMUNICATION_ERROR:
-		id = cc_messages.CELL_COMMUNICATION_ERROR
-	case message == diego_errors.MISSING_DOCKER_IMAGE_URL:
-	case message == diego_errors.MISSING_DOCKER_REGISTRY:
-	case message == diego_errors.MISSING_DOCKER_CREDENTIALS:
-	case message == diego_errors.INVALID_DOCKER_REGISTRY_ADDRESS:
-	default:
-		message = "staging failed"
-	}
+	return defaultFailureClassifier.Classify("", message)
+}
 
-	return &cc_messages.StagingError{
-		Id:      id,
-		Message: message,
+// StagingErrorFor returns the error reported to CC for err. Errors from the
+// diego_errors catalog are reported as catalogued, and any other error is
+// classified by its message with the built-in failure rules.
+func StagingErrorFor(err error) *cc_messages.StagingError {
+	if stagingError := diego_errors.StagingError(err); stagingError != nil {
+		return stagingError
 	}
+	return SanitizeErrorMessage(err.Error())
 }
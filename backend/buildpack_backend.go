@@ -2,7 +2,6 @@ package backend
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/url"
 	"path"
@@ -14,6 +13,7 @@ import (
 	"code.cloudfoundry.org/cc-uploader"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/diego_errors"
 	"code.cloudfoundry.org/urljoiner"
 	"github.com/tedsuo/rata"
 )
@@ -48,7 +48,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	var lifecycleData cc_messages.BuildpackStagingData
 	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
 	if err != nil {
-		return &models.TaskDefinition{}, "", "", err
+		return &models.TaskDefinition{}, "", "", diego_errors.InvalidLifecycleData.WithDetail("%s", err)
 	}
 
 	err = backend.validateRequest(request, lifecycleData)
@@ -56,7 +56,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 		return &models.TaskDefinition{}, "", "", err
 	}
 
-	compilerURL, err := backend.compilerDownloadURL(request, lifecycleData)
+	lifecycleBundle, compilerURL, err := backend.compilerDownloadURL(request, lifecycleData)
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
@@ -85,12 +85,15 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 
 	cachedDependencies := []*models.CachedDependency{}
 	//Download builder
+	checksumAlgorithm, checksumValue := lifecycleBundle.checksum()
 	cachedDependencies = append(
 		cachedDependencies,
 		&models.CachedDependency{
-			From:     compilerURL.String(),
-			To:       path.Dir(builderConfig.ExecutablePath),
-			CacheKey: fmt.Sprintf("buildpack-%s-lifecycle", lifecycleData.Stack),
+			From:              compilerURL.String(),
+			To:                path.Dir(builderConfig.ExecutablePath),
+			CacheKey:          lifecycleBundle.cacheKey(fmt.Sprintf("buildpack-%s-lifecycle", lifecycleData.Stack)),
+			ChecksumAlgorithm: checksumAlgorithm,
+			ChecksumValue:     checksumValue,
 		},
 	)
 
@@ -189,17 +192,31 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	uploadMsg := fmt.Sprintf("Uploading %s...", strings.Join(uploadNames, ", "))
 	actions = append(actions, models.EmitProgressFor(models.Parallel(uploadActions...), uploadMsg, "Uploading complete", "Uploading failed"))
 
-	annotationJson, _ := json.Marshal(cc_messages.StagingTaskAnnotation{
-		Lifecycle:          TraditionalLifecycleName,
-		CompletionCallback: request.CompletionCallback,
+	priority := backend.Priority(request)
+
+	rootFS := lifecycleBundle.rootFS(models.PreloadedRootFS(lifecycleData.Stack))
+	provenance := newProvenance(TraditionalLifecycleName, lifecycleBundle, compilerURL, lifecycleData.Stack, rootFS)
+	provenance.setBuildpacks(lifecycleData.Buildpacks)
+
+	annotationJson, _ := json.Marshal(StagingTaskAnnotation{
+		StagingTaskAnnotation: cc_messages.StagingTaskAnnotation{
+			Lifecycle:          TraditionalLifecycleName,
+			CompletionCallback: request.CompletionCallback,
+		},
+		AppId:            request.AppId,
+		Stack:            lifecycleData.Stack,
+		IsolationSegment: request.IsolationSegment,
+		PriorityClass:    priority.Name,
+		QueuePriority:    priority.QueuePriority,
+		Provenance:       provenance,
 	})
 
 	taskDefinition := &models.TaskDefinition{
-		RootFs:                        models.PreloadedRootFS(lifecycleData.Stack),
+		RootFs:                        rootFS,
 		ResultFile:                    builderConfig.OutputMetadata(),
 		MemoryMb:                      int32(request.MemoryMB),
 		DiskMb:                        int32(request.DiskMB),
-		CpuWeight:                     uint32(StagingTaskCpuWeight),
+		CpuWeight:                     priority.cpuWeight(StagingTaskCpuWeight),
 		CachedDependencies:            cachedDependencies,
 		Action:                        models.WrapAction(models.Timeout(models.Serial(actions...), timeout)),
 		LogGuid:                       request.LogGuid,
@@ -216,53 +233,47 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	if request.IsolationSegment != "" {
 		taskDefinition.PlacementTags = []string{request.IsolationSegment}
 	}
+	taskDefinition.PlacementTags = append(taskDefinition.PlacementTags, priority.PlacementTags...)
 
 	logger.Debug("staging-task-request")
 
 	return taskDefinition, stagingGuid, backend.config.TaskDomain, nil
 }
 
+// Priority returns the priority class the request's staging task is
+// scheduled with.
+func (backend *traditionalBackend) Priority(request cc_messages.StagingRequestFromCC) PriorityClass {
+	return backend.config.Priorities.Classify(request)
+}
+
 func (backend *traditionalBackend) BuildStagingResponse(taskResponse *models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error) {
 	var response cc_messages.StagingResponseForCC
 
 	if taskResponse.Failed {
-		response.Error = backend.config.Sanitizer(taskResponse.FailureReason)
+		response.Error = backend.config.Sanitizer(TraditionalLifecycleName, taskResponse.FailureReason)
+	} else if err := ValidateBuildpackResult([]byte(taskResponse.Result)); err != nil {
+		backend.logger.Error("invalid-staging-result", err, lager.Data{"task-guid": taskResponse.TaskGuid})
+		response.Error = diego_errors.StagingError(err)
 	} else {
-		result := json.RawMessage([]byte(taskResponse.Result))
+		result := resultWithProvenance(taskResponse)
 		response.Result = &result
 	}
 
 	return response, nil
 }
 
-func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
-	compilerPath, ok := backend.config.Lifecycles[request.Lifecycle+"/"+buildpackData.Stack]
+func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (LifecycleBundle, *url.URL, error) {
+	bundle, ok := backend.config.lifecycleBundle(request.Lifecycle + "/" + buildpackData.Stack)
 	if !ok {
-		return nil, ErrNoCompilerDefined
-	}
-
-	parsed, err := url.Parse(compilerPath)
-	if err != nil {
-		return nil, errors.New("couldn't parse compiler URL")
-	}
-
-	switch parsed.Scheme {
-	case "http", "https":
-		return parsed, nil
-	case "":
-		break
-	default:
-		return nil, errors.New("Unknown Scheme")
+		return LifecycleBundle{}, nil, ErrNoCompilerDefined
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, "/v1/static/", compilerPath)
-
-	url, err := url.ParseRequestURI(urlString)
+	compilerURL, err := backend.config.lifecycleBundleURL(bundle)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse compiler download URL: %s", err)
+		return LifecycleBundle{}, nil, err
 	}
 
-	return url, nil
+	return bundle, compilerURL, nil
 }
 
 func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
@@ -2,8 +2,6 @@ package backend
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"net/url"
 	"path"
 	"strings"
@@ -13,7 +11,6 @@ import (
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/stager/diego_errors"
-	"code.cloudfoundry.org/urljoiner"
 )
 
 const (
@@ -23,8 +20,8 @@ const (
 	DockerBuilderOutputPath     = "/tmp/docker-result/result.json"
 )
 
-var ErrMissingDockerImageUrl = errors.New(diego_errors.MISSING_DOCKER_IMAGE_URL)
-var ErrMissingDockerCredentials = errors.New(diego_errors.MISSING_DOCKER_CREDENTIALS)
+var ErrMissingDockerImageUrl = diego_errors.MissingDockerImageUrl
+var ErrMissingDockerCredentials = diego_errors.MissingDockerCredentials
 
 type dockerBackend struct {
 	config Config
@@ -46,10 +43,14 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 	logger := backend.logger.Session("build-recipe", lager.Data{"app-id": request.AppId, "staging-guid": stagingGuid})
 	logger.Info("staging-request")
 
+	if request.LifecycleData == nil {
+		return &models.TaskDefinition{}, "", "", ErrMissingLifecycleData
+	}
+
 	var lifecycleData cc_messages.DockerStagingData
 	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
 	if err != nil {
-		return &models.TaskDefinition{}, "", "", err
+		return &models.TaskDefinition{}, "", "", diego_errors.InvalidLifecycleData.WithDetail("%s", err)
 	}
 
 	err = backend.validateRequest(request, lifecycleData)
@@ -57,16 +58,19 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		return &models.TaskDefinition{}, "", "", err
 	}
 
-	compilerURL, err := backend.compilerDownloadURL()
+	lifecycleBundle, compilerURL, err := backend.compilerDownloadURL()
 	if err != nil {
 		return &models.TaskDefinition{}, "", "", err
 	}
 
+	checksumAlgorithm, checksumValue := lifecycleBundle.checksum()
 	cachedDependencies := []*models.CachedDependency{
 		&models.CachedDependency{
-			From:     compilerURL.String(),
-			To:       path.Dir(DockerBuilderExecutablePath),
-			CacheKey: "docker-lifecycle",
+			From:              compilerURL.String(),
+			To:                path.Dir(DockerBuilderExecutablePath),
+			CacheKey:          lifecycleBundle.cacheKey("docker-lifecycle"),
+			ChecksumAlgorithm: checksumAlgorithm,
+			ChecksumValue:     checksumValue,
 		},
 	}
 
@@ -109,13 +113,24 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		),
 	)
 
-	annotationJson, _ := json.Marshal(cc_messages.StagingTaskAnnotation{
-		Lifecycle:          DockerLifecycleName,
-		CompletionCallback: request.CompletionCallback,
+	priority := backend.Priority(request)
+	rootFS := lifecycleBundle.rootFS(models.PreloadedRootFS(backend.config.DockerStagingStack))
+
+	annotationJson, _ := json.Marshal(StagingTaskAnnotation{
+		StagingTaskAnnotation: cc_messages.StagingTaskAnnotation{
+			Lifecycle:          DockerLifecycleName,
+			CompletionCallback: request.CompletionCallback,
+		},
+		AppId:            request.AppId,
+		Stack:            backend.config.DockerStagingStack,
+		IsolationSegment: request.IsolationSegment,
+		PriorityClass:    priority.Name,
+		QueuePriority:    priority.QueuePriority,
+		Provenance:       newProvenance(DockerLifecycleName, lifecycleBundle, compilerURL, backend.config.DockerStagingStack, rootFS),
 	})
 
 	taskDefinition := &models.TaskDefinition{
-		RootFs:                        models.PreloadedRootFS(backend.config.DockerStagingStack),
+		RootFs:                        rootFS,
 		ResultFile:                    DockerBuilderOutputPath,
 		Privileged:                    backend.config.PrivilegedContainers,
 		MemoryMb:                      int32(request.MemoryMB),
@@ -123,6 +138,7 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		LogGuid:                       request.LogGuid,
 		EgressRules:                   request.EgressRules,
 		DiskMb:                        int32(request.DiskMB),
+		CpuWeight:                     priority.cpuWeight(0),
 		CompletionCallbackUrl:         backend.config.CallbackURL(stagingGuid),
 		Annotation:                    string(annotationJson),
 		Action:                        models.WrapAction(models.Timeout(models.Serial(actions...), dockerTimeout(request, backend.logger))),
@@ -135,51 +151,45 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 	if request.IsolationSegment != "" {
 		taskDefinition.PlacementTags = []string{request.IsolationSegment}
 	}
+	taskDefinition.PlacementTags = append(taskDefinition.PlacementTags, priority.PlacementTags...)
 
 	return taskDefinition, stagingGuid, backend.config.TaskDomain, nil
 }
 
+// Priority returns the priority class the request's staging task is
+// scheduled with.
+func (backend *dockerBackend) Priority(request cc_messages.StagingRequestFromCC) PriorityClass {
+	return backend.config.Priorities.Classify(request)
+}
+
 func (backend *dockerBackend) BuildStagingResponse(taskResponse *models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error) {
 	var response cc_messages.StagingResponseForCC
 
 	if taskResponse.Failed {
-		response.Error = backend.config.Sanitizer(taskResponse.FailureReason)
+		response.Error = backend.config.Sanitizer(DockerLifecycleName, taskResponse.FailureReason)
+	} else if err := ValidateDockerResult([]byte(taskResponse.Result)); err != nil {
+		backend.logger.Error("invalid-staging-result", err, lager.Data{"task-guid": taskResponse.TaskGuid})
+		response.Error = diego_errors.StagingError(err)
 	} else {
-		result := json.RawMessage([]byte(taskResponse.Result))
+		result := resultWithProvenance(taskResponse)
 		response.Result = &result
 	}
 
 	return response, nil
 }
 
-func (backend *dockerBackend) compilerDownloadURL() (*url.URL, error) {
-	lifecycleFilename := backend.config.Lifecycles["docker"]
-	if lifecycleFilename == "" {
-		return nil, ErrNoCompilerDefined
+func (backend *dockerBackend) compilerDownloadURL() (LifecycleBundle, *url.URL, error) {
+	bundle, ok := backend.config.lifecycleBundle("docker")
+	if !ok {
+		return LifecycleBundle{}, nil, ErrNoCompilerDefined
 	}
 
-	parsed, err := url.Parse(lifecycleFilename)
-	if err != nil {
-		return nil, errors.New("couldn't parse compiler URL")
-	}
-
-	switch parsed.Scheme {
-	case "http", "https":
-		return parsed, nil
-	case "":
-		break
-	default:
-		return nil, fmt.Errorf("unknown scheme: '%s'", parsed.Scheme)
-	}
-
-	urlString := urljoiner.Join(backend.config.FileServerURL, "/v1/static", lifecycleFilename)
-
-	url, err := url.ParseRequestURI(urlString)
+	compilerURL, err := backend.config.lifecycleBundleURL(bundle)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse compiler download URL: %s", err)
+		return LifecycleBundle{}, nil, err
 	}
 
-	return url, nil
+	return bundle, compilerURL, nil
 }
 
 func (backend *dockerBackend) validateRequest(stagingRequest cc_messages.StagingRequestFromCC, dockerData cc_messages.DockerStagingData) error {
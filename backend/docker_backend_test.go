@@ -2,6 +2,7 @@ package backend_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"code.cloudfoundry.org/lager/lagertest"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/diego_errors"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -40,7 +42,7 @@ var _ = Describe("DockerBackend", func() {
 				"compiler_with_bad_url":  "ftp://the-bad-compiler-url",
 				"docker":                 "docker_lifecycle/docker_app_lifecycle.tgz",
 			},
-			Sanitizer: func(msg string) *cc_messages.StagingError {
+			Sanitizer: func(lifecycle, msg string) *cc_messages.StagingError {
 				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
 			},
 		}
@@ -157,13 +159,23 @@ var _ = Describe("DockerBackend", func() {
 			taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
 			Expect(err).NotTo(HaveOccurred())
 
-			var annotation cc_messages.StagingTaskAnnotation
+			var annotation backend.StagingTaskAnnotation
 			err = json.Unmarshal([]byte(taskDef.Annotation), &annotation)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(annotation).To(Equal(cc_messages.StagingTaskAnnotation{
-				Lifecycle:          "docker",
-				CompletionCallback: "https://api.cc.com/v1/staging/some-staging-guid/droplet_completed",
+			Expect(annotation).To(Equal(backend.StagingTaskAnnotation{
+				StagingTaskAnnotation: cc_messages.StagingTaskAnnotation{
+					Lifecycle:          "docker",
+					CompletionCallback: "https://api.cc.com/v1/staging/some-staging-guid/droplet_completed",
+				},
+				AppId: "app-id",
+				Stack: "penguin",
+				Provenance: &backend.Provenance{
+					Lifecycle:    "docker",
+					LifecycleURL: "http://file-server.com/v1/static/docker_lifecycle/docker_app_lifecycle.tgz",
+					Stack:        "penguin",
+					RootFS:       models.PreloadedRootFS("penguin"),
+				},
 			}))
 		})
 
@@ -362,6 +374,23 @@ var _ = Describe("DockerBackend", func() {
 			})
 		})
 
+		Context("with no lifecycle data", func() {
+			It("returns an error", func() {
+				stagingRequest.LifecycleData = nil
+				_, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).To(Equal(backend.ErrMissingLifecycleData))
+			})
+		})
+
+		Context("with malformed lifecycle data", func() {
+			It("returns an invalid lifecycle data error", func() {
+				lifecycleData := json.RawMessage(`{"docker_image": 1}`)
+				stagingRequest.LifecycleData = &lifecycleData
+				_, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(errors.Is(err, diego_errors.InvalidLifecycleData)).To(BeTrue())
+			})
+		})
+
 		Context("when the docker lifecycle is missing", func() {
 			BeforeEach(func() {
 				delete(config.Lifecycles, "docker")
@@ -384,6 +413,59 @@ var _ = Describe("DockerBackend", func() {
 			})
 		})
 
+		Context("when a lifecycle bundle is configured for docker", func() {
+			BeforeEach(func() {
+				bundles, err := backend.NewLifecycleBundles([]backend.LifecycleBundle{{
+					Lifecycle: "docker",
+					URL:       "https://lifecycles.example.com/docker_app_lifecycle-1.2.3.tgz",
+					Checksum:  "sha256:abc123",
+					Version:   "1.2.3",
+					RootFS:    "preloaded:penguin-v2",
+					CacheKey:  "docker-lifecycle-1.2.3",
+				}})
+				Expect(err).NotTo(HaveOccurred())
+
+				config.LifecycleBundles = bundles
+				docker = backend.NewDockerBackend(config, logger)
+			})
+
+			It("downloads and verifies the bundle instead of the legacy lifecycle", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(taskDef.CachedDependencies).To(ConsistOf(&models.CachedDependency{
+					From:              "https://lifecycles.example.com/docker_app_lifecycle-1.2.3.tgz",
+					To:                "/tmp/docker_app_lifecycle",
+					CacheKey:          "docker-lifecycle-1.2.3",
+					ChecksumAlgorithm: "sha256",
+					ChecksumValue:     "abc123",
+				}))
+			})
+
+			It("runs on the bundle's rootfs", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(taskDef.RootFs).To(Equal("preloaded:penguin-v2"))
+			})
+
+			It("records the lifecycle bundle in the provenance", func() {
+				taskDef, _, _, err := docker.BuildRecipe("staging-guid", stagingRequest)
+				Expect(err).NotTo(HaveOccurred())
+
+				var annotation backend.StagingTaskAnnotation
+				Expect(json.Unmarshal([]byte(taskDef.Annotation), &annotation)).To(Succeed())
+				Expect(annotation.Provenance).To(Equal(&backend.Provenance{
+					Lifecycle:         "docker",
+					LifecycleURL:      "https://lifecycles.example.com/docker_app_lifecycle-1.2.3.tgz",
+					LifecycleVersion:  "1.2.3",
+					LifecycleChecksum: "sha256:abc123",
+					Stack:             "penguin",
+					RootFS:            "preloaded:penguin-v2",
+				}))
+			})
+		})
+
 		Context("when a positive timeout is specified in the staging request from CC", func() {
 			BeforeEach(func() {
 				timeout = 5
@@ -471,6 +553,67 @@ var _ = Describe("DockerBackend", func() {
 				}))
 			})
 
+			Context("when the lifecycle reports no process types", func() {
+				BeforeEach(func() {
+					stagingResult = dockerapplifecycle.NewStagingResult(
+						nil,
+						dockerapplifecycle.LifecycleMetadata{
+							DockerImage: "cloudfoundry/diego-docker-app",
+						},
+						"metadata",
+					)
+					var err error
+					stagingResultJson, err = json.Marshal(stagingResult)
+					Expect(err).NotTo(HaveOccurred())
+
+					response, buildError = docker.BuildStagingResponse(&models.TaskCallbackResponse{
+						Result: string(stagingResultJson),
+					})
+				})
+
+				It("accepts the result", func() {
+					Expect(buildError).NotTo(HaveOccurred())
+					Expect(response.Error).To(BeNil())
+					Expect(response.Result).NotTo(BeNil())
+				})
+			})
+
+			Context("with a staging result that is missing the docker image", func() {
+				BeforeEach(func() {
+					taskResponse := &models.TaskCallbackResponse{
+						Result: `{"process_types": {"a": "b"}, "lifecycle_metadata": {}, "execution_metadata": "metadata"}`,
+					}
+
+					response, buildError = docker.BuildStagingResponse(taskResponse)
+					Expect(buildError).NotTo(HaveOccurred())
+				})
+
+				It("reports a staging error instead of the result", func() {
+					Expect(response).To(Equal(cc_messages.StagingResponseForCC{
+						Error: &cc_messages.StagingError{
+							Id:      backend.INVALID_STAGING_RESULT,
+							Message: "invalid staging result: lifecycle_metadata.docker_image is missing",
+						},
+					}))
+				})
+			})
+
+			Context("with a truncated staging result", func() {
+				BeforeEach(func() {
+					taskResponse := &models.TaskCallbackResponse{
+						Result: `{"process_types": {"a": "b"}, "lifecycle_metadata": {"docker_im`,
+					}
+
+					response, buildError = docker.BuildStagingResponse(taskResponse)
+					Expect(buildError).NotTo(HaveOccurred())
+				})
+
+				It("reports a staging error instead of the result", func() {
+					Expect(response.Result).To(BeNil())
+					Expect(response.Error.Message).To(HavePrefix("invalid staging result: result is malformed JSON"))
+				})
+			})
+
 			Context("with a failed task response", func() {
 				BeforeEach(func() {
 					taskResponse := &models.TaskCallbackResponse{
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/diego_errors"
+)
+
+const stagingFailedMessage = "staging failed"
+
+// Failure reasons reported by the executor for a staging task whose container
+// was killed for exceeding its memory or disk limit, or whose Timeout action
+// expired. The reason may follow the description of the failed action, but is
+// always at the end, so that e.g. a download that failed with "connection
+// timed out" is not mistaken for the task timing out.
+const (
+	outOfMemoryReasonPattern       = `(^|: )Exited with status \d+ \(out of memory\)$`
+	diskQuotaExceededReasonPattern = `(^|: )(Exited with status \d+ \(disk quota exceeded\)|disk limit exceeded)$`
+	timeoutExceededReasonPattern   = `(^|: )exceeded \S+ timeout$`
+)
+
+// Failure reasons reported by Diego, and the docker staging request errors
+// that have always been passed through to CC. They are matched by these
+// patterns rather than by the messages the catalog displays for the errors,
+// so that rewording a message does not change how failures are classified.
+const (
+	insufficientResourcesReasonPattern        = `^insufficient resources`
+	noCompatibleCellReasonPattern             = `^found no compatible cell`
+	cellCommunicationErrorReasonPattern       = `^unable to communicate to compatible cells$`
+	missingDockerImageUrlReasonPattern        = `^missing docker image download url$`
+	missingDockerRegistryReasonPattern        = `^missing docker registry$`
+	missingDockerCredentialsReasonPattern     = `^missing docker credentials$`
+	invalidDockerRegistryAddressReasonPattern = `^invalid docker registry address$`
+)
+
+// FailureRule maps staging failures to the error reported to CC. A rule
+// matches a failure if its pattern matches the failure reason, the reason ends
+// in its exit code and the task was for its lifecycle; conditions that are not
+// set always match. The failure is reported with the rule's id and message,
+// or with the failure reason itself if the rule has no message.
+type FailureRule struct {
+	Pattern   string `json:"pattern,omitempty"`
+	ExitCode  *int   `json:"exit_code,omitempty"`
+	Lifecycle string `json:"lifecycle,omitempty"`
+	Id        string `json:"id"`
+	Message   string `json:"message,omitempty"`
+}
+
+func (r FailureRule) matches(pattern *regexp.Regexp, lifecycle, reason string) bool {
+	if r.Lifecycle != "" && r.Lifecycle != lifecycle {
+		return false
+	}
+
+	if r.ExitCode != nil {
+		exitCode, ok := FailureExitCode(reason)
+		if !ok || exitCode != *r.ExitCode {
+			return false
+		}
+	}
+
+	return pattern == nil || pattern.MatchString(reason)
+}
+
+var exitCodePattern = regexp.MustCompile(`(\d+)\s*$`)
+
+// FailureExitCode returns the exit code that the executor appends to the
+// failure reason of a task whose action exited unsuccessfully.
+func FailureExitCode(reason string) (int, bool) {
+	match := exitCodePattern.FindStringSubmatch(reason)
+	if match == nil {
+		return 0, false
+	}
+
+	exitCode, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, false
+	}
+	return exitCode, true
+}
+
+// FailureClassifier classifies staging failures by the first matching rule,
+// falling back to a generic staging error.
+type FailureClassifier struct {
+	rules    []FailureRule
+	patterns []*regexp.Regexp
+}
+
+// NewFailureClassifier returns a classifier that applies the given rules in
+// order, followed by the built-in rules.
+func NewFailureClassifier(rules []FailureRule) (*FailureClassifier, error) {
+	classifier := &FailureClassifier{}
+
+	for i, rule := range append(append([]FailureRule{}, rules...), DefaultFailureRules()...) {
+		if rule.Id == "" {
+			return nil, fmt.Errorf("failure rule %d has no id", i)
+		}
+
+		var pattern *regexp.Regexp
+		if rule.Pattern != "" {
+			var err error
+			pattern, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("failure rule %d has an invalid pattern: %s", i, err)
+			}
+		}
+
+		classifier.rules = append(classifier.rules, rule)
+		classifier.patterns = append(classifier.patterns, pattern)
+	}
+
+	return classifier, nil
+}
+
+// Classify returns the staging error reported to CC for a task of the given
+// lifecycle that failed with reason.
+func (c *FailureClassifier) Classify(lifecycle, reason string) *cc_messages.StagingError {
+	for i, rule := range c.rules {
+		if !rule.matches(c.patterns[i], lifecycle, reason) {
+			continue
+		}
+
+		message := rule.Message
+		if message == "" {
+			message = reason
+		}
+		return &cc_messages.StagingError{Id: rule.Id, Message: message}
+	}
+
+	return &cc_messages.StagingError{Id: cc_messages.STAGING_ERROR, Message: stagingFailedMessage}
+}
+
+// DefaultFailureRules returns the built-in rules, which classify failure
+// reasons that arrive as text from Diego into the diego_errors catalog.
+// Staging tasks killed for exceeding their limits are reported with a message
+// saying which limit to raise, failures of the buildpack lifecycle's phases
+// are reported as such, placement failures and docker staging request errors
+// are reported with their reason, and any other failure is reported as a
+// generic staging error without its reason, which may contain details of the
+// cell.
+func DefaultFailureRules() []FailureRule {
+	exitCode := func(code int) *int { return &code }
+
+	// Failures reported with their reason, which names Diego's or the
+	// stager's own error and may carry details of it.
+	withReason := func(pattern string, catalogError *diego_errors.Error) FailureRule {
+		return FailureRule{Pattern: pattern, Id: catalogError.CCErrorId}
+	}
+	// Failures reported with the catalog's message for them.
+	catalogued := func(pattern string, catalogError *diego_errors.Error) FailureRule {
+		return FailureRule{Pattern: pattern, Id: catalogError.CCErrorId, Message: catalogError.UserMessage}
+	}
+
+	return []FailureRule{
+		catalogued(outOfMemoryReasonPattern, diego_errors.StagingOutOfMemory),
+		catalogued(diskQuotaExceededReasonPattern, diego_errors.StagingDiskQuotaExceeded),
+		catalogued(timeoutExceededReasonPattern, diego_errors.StagingTimedOut),
+		{ExitCode: exitCode(buildpackapplifecycle.DETECT_FAIL_CODE), Id: cc_messages.BUILDPACK_DETECT_FAILED, Message: stagingFailedMessage},
+		{ExitCode: exitCode(buildpackapplifecycle.COMPILE_FAIL_CODE), Id: cc_messages.BUILDPACK_COMPILE_FAILED, Message: stagingFailedMessage},
+		{ExitCode: exitCode(buildpackapplifecycle.RELEASE_FAIL_CODE), Id: cc_messages.BUILDPACK_RELEASE_FAILED, Message: stagingFailedMessage},
+		withReason(insufficientResourcesReasonPattern, diego_errors.InsufficientResources),
+		withReason(noCompatibleCellReasonPattern, diego_errors.NoCompatibleCell),
+		withReason(cellCommunicationErrorReasonPattern, diego_errors.CellCommunicationError),
+		withReason(missingDockerImageUrlReasonPattern, diego_errors.MissingDockerImageUrl),
+		withReason(missingDockerRegistryReasonPattern, diego_errors.MissingDockerRegistry),
+		withReason(missingDockerCredentialsReasonPattern, diego_errors.MissingDockerCredentials),
+		withReason(invalidDockerRegistryAddressReasonPattern, diego_errors.InvalidDockerRegistryAddress),
+	}
+}
+
+var defaultFailureClassifier, _ = NewFailureClassifier(nil)
@@ -0,0 +1,125 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/diego_errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FailureClassifier", func() {
+	var (
+		rules      []backend.FailureRule
+		classifier *backend.FailureClassifier
+	)
+
+	exitCode := func(code int) *int { return &code }
+
+	BeforeEach(func() {
+		rules = []backend.FailureRule{
+			{Pattern: "(?i)killed", ExitCode: exitCode(137), Id: "StagingKilled", Message: "staging was killed"},
+			{Pattern: "unauthorized", Lifecycle: "docker", Id: "DockerRegistryAuthFailed"},
+			{ExitCode: exitCode(222), Lifecycle: "docker", Id: "DockerDetectFailed", Message: "docker staging failed"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		classifier, err = backend.NewFailureClassifier(rules)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("NewFailureClassifier", func() {
+		It("rejects rules without an id", func() {
+			_, err := backend.NewFailureClassifier([]backend.FailureRule{{Pattern: "oops"}})
+			Expect(err).To(MatchError("failure rule 0 has no id"))
+		})
+
+		It("rejects rules with an invalid pattern", func() {
+			_, err := backend.NewFailureClassifier([]backend.FailureRule{{Pattern: "(", Id: "SomeError"}})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("failure rule 0 has an invalid pattern"))
+		})
+	})
+
+	Describe("Classify", func() {
+		It("reports the first matching rule's id and message", func() {
+			stagingErr := classifier.Classify("buildpack", "Killed: exit status 137")
+			Expect(stagingErr).To(Equal(&cc_messages.StagingError{Id: "StagingKilled", Message: "staging was killed"}))
+		})
+
+		It("requires every condition of a rule to match", func() {
+			stagingErr := classifier.Classify("buildpack", "Killed: exit status 1")
+			Expect(stagingErr).To(Equal(&cc_messages.StagingError{Id: cc_messages.STAGING_ERROR, Message: "staging failed"}))
+		})
+
+		It("reports the failure reason for rules without a message", func() {
+			stagingErr := classifier.Classify("docker", "registry said unauthorized")
+			Expect(stagingErr).To(Equal(&cc_messages.StagingError{Id: "DockerRegistryAuthFailed", Message: "registry said unauthorized"}))
+		})
+
+		It("only applies lifecycle rules to that lifecycle", func() {
+			stagingErr := classifier.Classify("buildpack", "registry said unauthorized")
+			Expect(stagingErr.Id).To(Equal(cc_messages.STAGING_ERROR))
+		})
+
+		It("applies configured rules before the built-in rules", func() {
+			stagingErr := classifier.Classify("docker", "Exited with status 222")
+			Expect(stagingErr.Id).To(Equal("DockerDetectFailed"))
+
+			stagingErr = classifier.Classify("buildpack", "Exited with status 222")
+			Expect(stagingErr.Id).To(Equal(cc_messages.BUILDPACK_DETECT_FAILED))
+		})
+
+		It("falls back to the built-in rules", func() {
+			stagingErr := classifier.Classify("buildpack", diego_errors.CELL_COMMUNICATION_ERROR)
+			Expect(stagingErr).To(Equal(&cc_messages.StagingError{Id: cc_messages.CELL_COMMUNICATION_ERROR, Message: diego_errors.CELL_COMMUNICATION_ERROR}))
+		})
+
+		Describe("the built-in rules", func() {
+			BeforeEach(func() {
+				rules = nil
+			})
+
+			It("reports a staging task killed for running out of memory", func() {
+				for _, reason := range []string{"Exited with status 137 (out of memory)", "staging: Exited with status 137 (out of memory)"} {
+					stagingErr := classifier.Classify("buildpack", reason)
+					Expect(stagingErr.Id).To(Equal(backend.STAGING_OUT_OF_MEMORY))
+					Expect(stagingErr.Message).To(ContainSubstring("increase the memory available to staging"))
+				}
+			})
+
+			It("reports a staging task that exceeded its disk quota", func() {
+				for _, reason := range []string{"Exited with status 1 (disk quota exceeded)", "Copying into the container failed: disk limit exceeded"} {
+					stagingErr := classifier.Classify("docker", reason)
+					Expect(stagingErr.Id).To(Equal(backend.STAGING_DISK_QUOTA_EXCEEDED))
+					Expect(stagingErr.Message).To(ContainSubstring("increase the disk available to staging"))
+				}
+			})
+
+			It("reports a staging task whose timeout expired", func() {
+				for _, reason := range []string{"exceeded 15m0s timeout", "staging: exceeded 15m0s timeout"} {
+					stagingErr := classifier.Classify("buildpack", reason)
+					Expect(stagingErr.Id).To(Equal(backend.STAGING_TIMED_OUT))
+					Expect(stagingErr.Message).To(ContainSubstring("increase the staging timeout"))
+				}
+			})
+
+			It("does not mistake download and network errors for exceeded limits", func() {
+				for _, reason := range []string{
+					"Downloading failed: Get https://buildpacks.example.com/ruby.zip: dial tcp 10.0.0.1:443: i/o timeout",
+					"Downloading failed: read tcp 10.0.0.2:51234->10.0.0.1:443: read: connection timed out",
+					"Downloading failed: Get https://blobs.example.com/droplet: net/http: request canceled (Client.Timeout exceeded while awaiting headers)",
+					"Downloading failed: registry responded: out of memory, retry later",
+					"Uploading failed: disk quota exceeded on blobstore (status 507)",
+					"Exited with status 1 (out of memory killer disabled)",
+				} {
+					stagingErr := classifier.Classify("buildpack", reason)
+					Expect(stagingErr).To(Equal(&cc_messages.StagingError{Id: cc_messages.STAGING_ERROR, Message: "staging failed"}), reason)
+				}
+			})
+		})
+	})
+})
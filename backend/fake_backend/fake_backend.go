@@ -31,6 +31,14 @@ type FakeBackend struct {
 		result1 cc_messages.StagingResponseForCC
 		result2 error
 	}
+	PriorityStub        func(request cc_messages.StagingRequestFromCC) backend.PriorityClass
+	priorityMutex       sync.RWMutex
+	priorityArgsForCall []struct {
+		request cc_messages.StagingRequestFromCC
+	}
+	priorityReturns struct {
+		result1 backend.PriorityClass
+	}
 }
 
 func (fake *FakeBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error) {
@@ -102,4 +110,36 @@ func (fake *FakeBackend) BuildStagingResponseReturns(result1 cc_messages.Staging
 	}{result1, result2}
 }
 
+func (fake *FakeBackend) Priority(request cc_messages.StagingRequestFromCC) backend.PriorityClass {
+	fake.priorityMutex.Lock()
+	fake.priorityArgsForCall = append(fake.priorityArgsForCall, struct {
+		request cc_messages.StagingRequestFromCC
+	}{request})
+	fake.priorityMutex.Unlock()
+	if fake.PriorityStub != nil {
+		return fake.PriorityStub(request)
+	} else {
+		return fake.priorityReturns.result1
+	}
+}
+
+func (fake *FakeBackend) PriorityCallCount() int {
+	fake.priorityMutex.RLock()
+	defer fake.priorityMutex.RUnlock()
+	return len(fake.priorityArgsForCall)
+}
+
+func (fake *FakeBackend) PriorityArgsForCall(i int) cc_messages.StagingRequestFromCC {
+	fake.priorityMutex.RLock()
+	defer fake.priorityMutex.RUnlock()
+	return fake.priorityArgsForCall[i].request
+}
+
+func (fake *FakeBackend) PriorityReturns(result1 backend.PriorityClass) {
+	fake.PriorityStub = nil
+	fake.priorityReturns = struct {
+		result1 backend.PriorityClass
+	}{result1}
+}
+
 var _ backend.Backend = new(FakeBackend)
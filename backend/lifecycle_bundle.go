@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"code.cloudfoundry.org/urljoiner"
+)
+
+// LifecycleBundle describes the lifecycle used to stage apps of a lifecycle,
+// and for buildpack staging a stack. URL is either absolute or a path on the
+// file server. Checksum has the form "<algorithm>:<hex value>" and is verified
+// by the cell when it downloads the bundle. Version is recorded on the staging
+// task, RootFS overrides the rootfs the task runs on and CacheKey the key the
+// bundle is cached under on the cell.
+type LifecycleBundle struct {
+	Lifecycle string `json:"lifecycle"`
+	Stack     string `json:"stack,omitempty"`
+	URL       string `json:"url"`
+	Checksum  string `json:"checksum,omitempty"`
+	Version   string `json:"version,omitempty"`
+	RootFS    string `json:"rootfs,omitempty"`
+	CacheKey  string `json:"cache_key,omitempty"`
+}
+
+var lifecycleChecksumAlgorithms = map[string]bool{"md5": true, "sha1": true, "sha256": true}
+
+// Key returns the key the bundle is looked up by, "<lifecycle>/<stack>" or
+// just the lifecycle if it has no stack.
+func (b LifecycleBundle) Key() string {
+	if b.Stack == "" {
+		return b.Lifecycle
+	}
+	return b.Lifecycle + "/" + b.Stack
+}
+
+func (b LifecycleBundle) checksum() (string, string) {
+	if b.Checksum == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(b.Checksum, ":", 2)
+	return parts[0], parts[1]
+}
+
+func (b LifecycleBundle) cacheKey(defaultKey string) string {
+	if b.CacheKey != "" {
+		return b.CacheKey
+	}
+	return defaultKey
+}
+
+func (b LifecycleBundle) rootFS(defaultRootFS string) string {
+	if b.RootFS != "" {
+		return b.RootFS
+	}
+	return defaultRootFS
+}
+
+// LifecycleBundles holds the configured lifecycle bundles by key.
+type LifecycleBundles map[string]LifecycleBundle
+
+func NewLifecycleBundles(bundles []LifecycleBundle) (LifecycleBundles, error) {
+	lifecycleBundles := LifecycleBundles{}
+
+	for _, bundle := range bundles {
+		if bundle.Lifecycle == "" {
+			return nil, errors.New("lifecycle bundle has no lifecycle")
+		}
+		if bundle.URL == "" {
+			return nil, fmt.Errorf("lifecycle bundle '%s' has no url", bundle.Key())
+		}
+		if _, err := url.Parse(bundle.URL); err != nil {
+			return nil, fmt.Errorf("lifecycle bundle '%s' has an invalid url: %s", bundle.Key(), err)
+		}
+		if bundle.Checksum != "" {
+			parts := strings.SplitN(bundle.Checksum, ":", 2)
+			if len(parts) != 2 || parts[1] == "" || !lifecycleChecksumAlgorithms[parts[0]] {
+				return nil, fmt.Errorf("lifecycle bundle '%s' has an invalid checksum, expected md5, sha1 or sha256:<value>", bundle.Key())
+			}
+		}
+		if _, ok := lifecycleBundles[bundle.Key()]; ok {
+			return nil, fmt.Errorf("lifecycle bundle '%s' is configured more than once", bundle.Key())
+		}
+
+		lifecycleBundles[bundle.Key()] = bundle
+	}
+
+	return lifecycleBundles, nil
+}
+
+// lifecycleBundle returns the bundle configured for key, preferring a
+// structured bundle to an entry in the legacy Lifecycles map.
+func (c Config) lifecycleBundle(key string) (LifecycleBundle, bool) {
+	if bundle, ok := c.LifecycleBundles[key]; ok {
+		return bundle, true
+	}
+
+	path := c.Lifecycles[key]
+	if path == "" {
+		return LifecycleBundle{}, false
+	}
+	return LifecycleBundle{URL: path}, true
+}
+
+// LifecycleURLs returns the URL of every configured lifecycle bundle by key,
+// as it appears in the configuration.
+func (c Config) LifecycleURLs() map[string]string {
+	urls := map[string]string{}
+	for key, path := range c.Lifecycles {
+		urls[key] = path
+	}
+	for key, bundle := range c.LifecycleBundles {
+		urls[key] = bundle.URL
+	}
+	return urls
+}
+
+// lifecycleBundleURL resolves the URL of bundle against the file server.
+func (c Config) lifecycleBundleURL(bundle LifecycleBundle) (*url.URL, error) {
+	return LifecycleBundleURL(c.FileServerURL, bundle.URL)
+}
+
+// LifecycleBundleURL resolves the URL of a lifecycle bundle, which is relative
+// to the file server's static assets unless it is absolute.
+func LifecycleBundleURL(fileServerURL, bundleURL string) (*url.URL, error) {
+	parsed, err := url.Parse(bundleURL)
+	if err != nil {
+		return nil, errors.New("couldn't parse compiler URL")
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		return parsed, nil
+	case "":
+		break
+	default:
+		return nil, fmt.Errorf("unknown scheme: '%s'", parsed.Scheme)
+	}
+
+	urlString := urljoiner.Join(fileServerURL, "/v1/static", bundleURL)
+
+	u, err := url.ParseRequestURI(urlString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse compiler download URL: %s", err)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,67 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LifecycleBundles", func() {
+	Describe("NewLifecycleBundles", func() {
+		It("indexes bundles by lifecycle and stack", func() {
+			bundles, err := backend.NewLifecycleBundles([]backend.LifecycleBundle{
+				{Lifecycle: "buildpack", Stack: "cflinuxfs3", URL: "buildpack_app_lifecycle.tgz"},
+				{Lifecycle: "docker", URL: "docker_app_lifecycle.tgz"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bundles).To(HaveKey("buildpack/cflinuxfs3"))
+			Expect(bundles).To(HaveKey("docker"))
+		})
+
+		It("rejects bundles without a lifecycle or url", func() {
+			_, err := backend.NewLifecycleBundles([]backend.LifecycleBundle{{URL: "lifecycle.tgz"}})
+			Expect(err).To(HaveOccurred())
+
+			_, err = backend.NewLifecycleBundles([]backend.LifecycleBundle{{Lifecycle: "docker"}})
+			Expect(err).To(MatchError("lifecycle bundle 'docker' has no url"))
+		})
+
+		It("rejects unsupported checksums", func() {
+			_, err := backend.NewLifecycleBundles([]backend.LifecycleBundle{
+				{Lifecycle: "docker", URL: "docker_app_lifecycle.tgz", Checksum: "abc123"},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects duplicate bundles", func() {
+			_, err := backend.NewLifecycleBundles([]backend.LifecycleBundle{
+				{Lifecycle: "docker", URL: "docker_app_lifecycle.tgz"},
+				{Lifecycle: "docker", URL: "docker_app_lifecycle-2.tgz"},
+			})
+			Expect(err).To(MatchError("lifecycle bundle 'docker' is configured more than once"))
+		})
+	})
+
+	Describe("LifecycleURLs", func() {
+		It("merges the legacy lifecycles with the bundles", func() {
+			bundles, err := backend.NewLifecycleBundles([]backend.LifecycleBundle{
+				{Lifecycle: "docker", URL: "docker_app_lifecycle-2.tgz"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			config := backend.Config{
+				Lifecycles: map[string]string{
+					"buildpack/cflinuxfs3": "buildpack_app_lifecycle.tgz",
+					"docker":               "docker_app_lifecycle.tgz",
+				},
+				LifecycleBundles: bundles,
+			}
+
+			Expect(config.LifecycleURLs()).To(Equal(map[string]string{
+				"buildpack/cflinuxfs3": "buildpack_app_lifecycle.tgz",
+				"docker":               "docker_app_lifecycle-2.tgz",
+			}))
+		})
+	})
+})
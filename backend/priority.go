@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+)
+
+// PriorityClass describes how staging tasks of a given priority are scheduled.
+// Zero values leave the backend defaults in place.
+type PriorityClass struct {
+	Name          string   `json:"name"`
+	CpuWeight     uint32   `json:"cpu_weight,omitempty"`
+	PlacementTags []string `json:"placement_tags,omitempty"`
+	QueuePriority int      `json:"queue_priority,omitempty"`
+}
+
+func (class PriorityClass) cpuWeight(defaultWeight uint32) uint32 {
+	if class.CpuWeight > 0 {
+		return class.CpuWeight
+	}
+	return defaultWeight
+}
+
+// PriorityRule assigns Class to staging requests matching every non-empty
+// field of the rule. EnvironmentVariable matches requests that set the named
+// environment variable, to EnvironmentValue if that is not empty.
+type PriorityRule struct {
+	IsolationSegment    string `json:"isolation_segment,omitempty"`
+	Lifecycle           string `json:"lifecycle,omitempty"`
+	EnvironmentVariable string `json:"environment_variable,omitempty"`
+	EnvironmentValue    string `json:"environment_value,omitempty"`
+	Class               string `json:"class"`
+}
+
+func (r PriorityRule) Matches(request cc_messages.StagingRequestFromCC) bool {
+	if r.IsolationSegment != "" && r.IsolationSegment != request.IsolationSegment {
+		return false
+	}
+
+	if r.Lifecycle != "" && r.Lifecycle != request.Lifecycle {
+		return false
+	}
+
+	if r.EnvironmentVariable != "" {
+		for _, envVar := range request.Environment {
+			if envVar.Name == r.EnvironmentVariable && (r.EnvironmentValue == "" || envVar.Value == r.EnvironmentValue) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Priorities classifies staging requests by the first matching rule, falling
+// back to the default class.
+type Priorities struct {
+	classes      map[string]PriorityClass
+	rules        []PriorityRule
+	defaultClass PriorityClass
+}
+
+func NewPriorities(classes []PriorityClass, rules []PriorityRule, defaultClass string) (Priorities, error) {
+	priorities := Priorities{
+		classes: map[string]PriorityClass{},
+		rules:   rules,
+	}
+
+	for _, class := range classes {
+		if class.Name == "" {
+			return Priorities{}, fmt.Errorf("priority class has no name")
+		}
+		priorities.classes[class.Name] = class
+	}
+
+	for _, rule := range rules {
+		if _, ok := priorities.classes[rule.Class]; !ok {
+			return Priorities{}, fmt.Errorf("priority rule refers to unknown class '%s'", rule.Class)
+		}
+	}
+
+	if defaultClass != "" {
+		class, ok := priorities.classes[defaultClass]
+		if !ok {
+			return Priorities{}, fmt.Errorf("unknown default priority class '%s'", defaultClass)
+		}
+		priorities.defaultClass = class
+	}
+
+	return priorities, nil
+}
+
+func (p Priorities) Classify(request cc_messages.StagingRequestFromCC) PriorityClass {
+	for _, rule := range p.rules {
+		if rule.Matches(request) {
+			return p.classes[rule.Class]
+		}
+	}
+
+	return p.defaultClass
+}
@@ -0,0 +1,100 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Priorities", func() {
+	var (
+		classes []backend.PriorityClass
+		rules   []backend.PriorityRule
+		request cc_messages.StagingRequestFromCC
+	)
+
+	BeforeEach(func() {
+		classes = []backend.PriorityClass{
+			{Name: "high", QueuePriority: 10},
+			{Name: "normal"},
+			{Name: "low", QueuePriority: -10},
+		}
+		rules = []backend.PriorityRule{
+			{IsolationSegment: "production", Lifecycle: "buildpack", Class: "high"},
+			{EnvironmentVariable: "BULK_RESTAGE", Class: "low"},
+			{Lifecycle: "docker", Class: "high"},
+		}
+		request = cc_messages.StagingRequestFromCC{Lifecycle: "buildpack"}
+	})
+
+	Describe("NewPriorities", func() {
+		It("rejects rules referring to unknown classes", func() {
+			rules = append(rules, backend.PriorityRule{Class: "bogus"})
+			_, err := backend.NewPriorities(classes, rules, "normal")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects an unknown default class", func() {
+			_, err := backend.NewPriorities(classes, rules, "bogus")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects unnamed classes", func() {
+			classes = append(classes, backend.PriorityClass{CpuWeight: 10})
+			_, err := backend.NewPriorities(classes, rules, "normal")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Classify", func() {
+		var priorities backend.Priorities
+
+		JustBeforeEach(func() {
+			var err error
+			priorities, err = backend.NewPriorities(classes, rules, "normal")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("applies the first matching rule", func() {
+			request.IsolationSegment = "production"
+			request.Environment = []*models.EnvironmentVariable{{Name: "BULK_RESTAGE", Value: "true"}}
+			Expect(priorities.Classify(request).Name).To(Equal("high"))
+		})
+
+		It("requires every field of a rule to match", func() {
+			request.IsolationSegment = "production"
+			request.Lifecycle = "other"
+			Expect(priorities.Classify(request).Name).To(Equal("normal"))
+		})
+
+		It("matches on the presence of an environment variable", func() {
+			request.Environment = []*models.EnvironmentVariable{{Name: "BULK_RESTAGE", Value: "anything"}}
+			Expect(priorities.Classify(request).Name).To(Equal("low"))
+		})
+
+		It("matches on the value of an environment variable when one is given", func() {
+			rules = []backend.PriorityRule{{EnvironmentVariable: "BULK_RESTAGE", EnvironmentValue: "true", Class: "low"}}
+			priorities, err := backend.NewPriorities(classes, rules, "normal")
+			Expect(err).NotTo(HaveOccurred())
+
+			request.Environment = []*models.EnvironmentVariable{{Name: "BULK_RESTAGE", Value: "false"}}
+			Expect(priorities.Classify(request).Name).To(Equal("normal"))
+
+			request.Environment = []*models.EnvironmentVariable{{Name: "BULK_RESTAGE", Value: "true"}}
+			Expect(priorities.Classify(request).Name).To(Equal("low"))
+		})
+
+		It("falls back to the default class", func() {
+			Expect(priorities.Classify(request).Name).To(Equal("normal"))
+		})
+
+		Context("without any configuration", func() {
+			It("returns an empty class", func() {
+				Expect(backend.Priorities{}.Classify(request)).To(Equal(backend.PriorityClass{}))
+			})
+		})
+	})
+})
@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/redaction"
+)
+
+// maxProvenanceBuildpacks bounds the buildpacks recorded in the provenance,
+// which is stored in the staging task's annotation and so counts towards the
+// BBS limit on its size.
+const maxProvenanceBuildpacks = 10
+
+// Provenance records what a droplet was built with, so that the droplets
+// built with a given lifecycle or buildpack can be found later. It is recorded
+// in the staging task's annotation when the recipe is built, and added to the
+// staging result sent to CC under the "provenance" key when the task succeeds.
+// URLs are recorded without credentials or signatures.
+type Provenance struct {
+	Lifecycle         string                `json:"lifecycle"`
+	LifecycleURL      string                `json:"lifecycle_url,omitempty"`
+	LifecycleVersion  string                `json:"lifecycle_version,omitempty"`
+	LifecycleChecksum string                `json:"lifecycle_checksum,omitempty"`
+	Stack             string                `json:"stack,omitempty"`
+	RootFS            string                `json:"rootfs,omitempty"`
+	Buildpacks        []ProvenanceBuildpack `json:"buildpacks,omitempty"`
+	BuildpacksOmitted int                   `json:"buildpacks_omitted,omitempty"`
+	TaskCreatedAt     int64                 `json:"task_created_at,omitempty"`
+}
+
+type ProvenanceBuildpack struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	URL  string `json:"url"`
+}
+
+func newProvenance(lifecycle string, bundle LifecycleBundle, bundleURL *url.URL, stack, rootFS string) *Provenance {
+	return &Provenance{
+		Lifecycle:         lifecycle,
+		LifecycleURL:      redaction.StripURLSecrets(bundleURL.String()),
+		LifecycleVersion:  bundle.Version,
+		LifecycleChecksum: bundle.Checksum,
+		Stack:             stack,
+		RootFS:            rootFS,
+	}
+}
+
+// setBuildpacks records the first maxProvenanceBuildpacks buildpacks and
+// the number of buildpacks left out.
+func (p *Provenance) setBuildpacks(buildpacks []cc_messages.Buildpack) {
+	p.Buildpacks = []ProvenanceBuildpack{}
+	for i, buildpack := range buildpacks {
+		if i == maxProvenanceBuildpacks {
+			p.BuildpacksOmitted = len(buildpacks) - i
+			break
+		}
+		p.Buildpacks = append(p.Buildpacks, ProvenanceBuildpack{
+			Name: buildpack.Name,
+			Key:  buildpack.Key,
+			URL:  redaction.StripURLSecrets(buildpack.Url),
+		})
+	}
+}
+
+// resultWithProvenance returns the result of a successful staging task with
+// the provenance recorded in its annotation added. The result is returned
+// unchanged if no provenance was recorded or it is not a JSON object.
+func resultWithProvenance(taskResponse *models.TaskCallbackResponse) json.RawMessage {
+	result := json.RawMessage(taskResponse.Result)
+
+	var annotation StagingTaskAnnotation
+	err := json.Unmarshal([]byte(taskResponse.Annotation), &annotation)
+	if err != nil || annotation.Provenance == nil {
+		return result
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(result, &fields)
+	if err != nil || fields == nil {
+		return result
+	}
+
+	provenance := *annotation.Provenance
+	provenance.TaskCreatedAt = taskResponse.CreatedAt
+
+	fields["provenance"], err = json.Marshal(provenance)
+	if err != nil {
+		return result
+	}
+
+	enriched, err := json.Marshal(fields)
+	if err != nil {
+		return result
+	}
+	return enriched
+}
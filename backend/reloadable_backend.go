@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"sync/atomic"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+)
+
+// ReloadableBackends holds the backend of every lifecycle, which can be
+// replaced while the stager is running, e.g. to pick up new lifecycle bundles.
+// The backends are replaced together, so a staging request never sees the
+// backend of one lifecycle from before a reload and another from after it.
+type ReloadableBackends struct {
+	current atomic.Value
+}
+
+func NewReloadableBackends(backends map[string]Backend) *ReloadableBackends {
+	reloadable := &ReloadableBackends{}
+	reloadable.Reload(backends)
+	return reloadable
+}
+
+// Reload replaces the backends used by subsequent calls. backends is expected
+// to configure the same lifecycles as the backends it replaces.
+func (r *ReloadableBackends) Reload(backends map[string]Backend) {
+	current := make(map[string]Backend, len(backends))
+	for lifecycle, backend := range backends {
+		current[lifecycle] = backend
+	}
+	r.current.Store(current)
+}
+
+// Backends returns a Backend for every current lifecycle that delegates each
+// call to the backend of the lifecycle that is current when the call starts.
+func (r *ReloadableBackends) Backends() map[string]Backend {
+	backends := map[string]Backend{}
+	for lifecycle := range r.load() {
+		backends[lifecycle] = &reloadableBackend{backends: r, lifecycle: lifecycle}
+	}
+	return backends
+}
+
+func (r *ReloadableBackends) load() map[string]Backend {
+	return r.current.Load().(map[string]Backend)
+}
+
+type reloadableBackend struct {
+	backends  *ReloadableBackends
+	lifecycle string
+}
+
+func (r *reloadableBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (*models.TaskDefinition, string, string, error) {
+	return r.backend().BuildRecipe(stagingGuid, request)
+}
+
+func (r *reloadableBackend) BuildStagingResponse(response *models.TaskCallbackResponse) (cc_messages.StagingResponseForCC, error) {
+	return r.backend().BuildStagingResponse(response)
+}
+
+func (r *reloadableBackend) Priority(request cc_messages.StagingRequestFromCC) PriorityClass {
+	return r.backend().Priority(request)
+}
+
+func (r *reloadableBackend) backend() Backend {
+	return r.backends.load()[r.lifecycle]
+}
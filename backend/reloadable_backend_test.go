@@ -0,0 +1,79 @@
+package backend_test
+
+import (
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/backend/fake_backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReloadableBackends", func() {
+	var (
+		original   *fake_backend.FakeBackend
+		reloaded   *fake_backend.FakeBackend
+		other      *fake_backend.FakeBackend
+		reloadable *backend.ReloadableBackends
+		backends   map[string]backend.Backend
+	)
+
+	BeforeEach(func() {
+		original = &fake_backend.FakeBackend{}
+		original.BuildRecipeReturns(&models.TaskDefinition{}, "original-guid", "domain", nil)
+		reloaded = &fake_backend.FakeBackend{}
+		reloaded.BuildRecipeReturns(&models.TaskDefinition{}, "reloaded-guid", "domain", nil)
+		other = &fake_backend.FakeBackend{}
+
+		reloadable = backend.NewReloadableBackends(map[string]backend.Backend{
+			"buildpack": original,
+			"docker":    other,
+		})
+		backends = reloadable.Backends()
+	})
+
+	It("returns a backend for every lifecycle", func() {
+		Expect(backends).To(HaveLen(2))
+		Expect(backends).To(HaveKey("buildpack"))
+		Expect(backends).To(HaveKey("docker"))
+	})
+
+	It("delegates to the backends it was created with", func() {
+		_, guid, _, err := backends["buildpack"].BuildRecipe("staging-guid", cc_messages.StagingRequestFromCC{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(guid).To(Equal("original-guid"))
+
+		_, err = backends["buildpack"].BuildStagingResponse(&models.TaskCallbackResponse{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(original.BuildStagingResponseCallCount()).To(Equal(1))
+		Expect(other.BuildStagingResponseCallCount()).To(Equal(0))
+	})
+
+	It("delegates to the new backends once reloaded", func() {
+		otherReloaded := &fake_backend.FakeBackend{}
+		reloadable.Reload(map[string]backend.Backend{
+			"buildpack": reloaded,
+			"docker":    otherReloaded,
+		})
+
+		_, guid, _, err := backends["buildpack"].BuildRecipe("staging-guid", cc_messages.StagingRequestFromCC{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(guid).To(Equal("reloaded-guid"))
+		Expect(original.BuildRecipeCallCount()).To(Equal(0))
+
+		backends["docker"].Priority(cc_messages.StagingRequestFromCC{})
+		Expect(otherReloaded.PriorityCallCount()).To(Equal(1))
+		Expect(other.PriorityCallCount()).To(Equal(0))
+	})
+
+	It("is not affected by changes to the map it was given", func() {
+		given := map[string]backend.Backend{"buildpack": reloaded, "docker": other}
+		reloadable.Reload(given)
+		given["buildpack"] = original
+
+		_, guid, _, err := backends["buildpack"].BuildRecipe("staging-guid", cc_messages.StagingRequestFromCC{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(guid).To(Equal("reloaded-guid"))
+	})
+})
@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"code.cloudfoundry.org/stager/diego_errors"
+)
+
+// stagingResultSchema is the part of a lifecycle's staging result that CC
+// relies on. A null field is treated as empty, as the lifecycles write a null
+// process_types when an app has none.
+type stagingResultSchema struct {
+	ProcessTypes      map[string]string `json:"process_types"`
+	LifecycleMetadata json.RawMessage   `json:"lifecycle_metadata"`
+	ExecutionMetadata string            `json:"execution_metadata"`
+}
+
+// requiredResultFields must be present in a staging result, even if null.
+var requiredResultFields = []string{"process_types", "execution_metadata", "lifecycle_metadata"}
+
+type buildpackLifecycleMetadataSchema struct {
+	BuildpackKey      string `json:"buildpack_key"`
+	DetectedBuildpack string `json:"detected_buildpack"`
+}
+
+type dockerLifecycleMetadataSchema struct {
+	DockerImage string `json:"docker_image"`
+}
+
+func invalidResult(reason string) error {
+	return diego_errors.InvalidStagingResult.WithDetail("%s", reason)
+}
+
+// ValidateBuildpackResult checks that a buildpack staging result has process
+// types, execution metadata and names the buildpack that was detected.
+func ValidateBuildpackResult(result []byte) error {
+	var metadata buildpackLifecycleMetadataSchema
+	err := validateResult(result, &metadata)
+	if err != nil {
+		return err
+	}
+
+	if metadata.DetectedBuildpack == "" && metadata.BuildpackKey == "" {
+		return invalidResult("lifecycle_metadata.detected_buildpack is missing")
+	}
+	return nil
+}
+
+// ValidateDockerResult checks that a docker staging result has process types,
+// execution metadata and the image that was staged.
+func ValidateDockerResult(result []byte) error {
+	var metadata dockerLifecycleMetadataSchema
+	err := validateResult(result, &metadata)
+	if err != nil {
+		return err
+	}
+
+	if metadata.DockerImage == "" {
+		return invalidResult("lifecycle_metadata.docker_image is missing")
+	}
+	return nil
+}
+
+func validateResult(result []byte, metadata interface{}) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(result, &fields)
+	if err != nil {
+		return invalidResult(describeJSONError("result", err))
+	}
+	if fields == nil {
+		return invalidResult("result is not a JSON object")
+	}
+
+	for _, field := range requiredResultFields {
+		if _, ok := fields[field]; !ok {
+			return invalidResult(field + " is missing")
+		}
+	}
+
+	var schema stagingResultSchema
+	err = json.Unmarshal(result, &schema)
+	if err != nil {
+		return invalidResult(describeJSONError("result", err))
+	}
+
+	if len(schema.LifecycleMetadata) == 0 || string(schema.LifecycleMetadata) == "null" {
+		return nil
+	}
+
+	err = json.Unmarshal(schema.LifecycleMetadata, metadata)
+	if err != nil {
+		return invalidResult(describeJSONError("lifecycle_metadata", err))
+	}
+	return nil
+}
+
+// describeJSONError describes why subject could not be decoded without
+// quoting any of its contents, which may be sensitive.
+func describeJSONError(subject string, err error) string {
+	switch err := err.(type) {
+	case *json.UnmarshalTypeError:
+		if err.Field == "" {
+			return subject + " is not a JSON object"
+		}
+		if subject != "result" {
+			return subject + "." + err.Field + " has the wrong type"
+		}
+		return err.Field + " has the wrong type"
+	case *json.SyntaxError:
+		return fmt.Sprintf("%s is malformed JSON at offset %d", subject, err.Offset)
+	default:
+		return subject + " is malformed JSON"
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/tracing"
 )
 
 const (
@@ -17,7 +18,7 @@ const (
 
 //go:generate counterfeiter -o fakes/fake_cc_client.go . CcClient
 type CcClient interface {
-	StagingComplete(stagingGuid string, completionCallback string, payload []byte, logger lager.Logger) error
+	StagingComplete(stagingGuid string, completionCallback string, payload []byte, trace tracing.SpanContext, logger lager.Logger) error
 }
 
 type ccClient struct {
@@ -60,7 +61,7 @@ func NewCcClient(baseURI string, username string, password string, skipCertVerif
 	}
 }
 
-func (cc *ccClient) StagingComplete(stagingGuid string, completionCallback string, payload []byte, logger lager.Logger) error {
+func (cc *ccClient) StagingComplete(stagingGuid string, completionCallback string, payload []byte, trace tracing.SpanContext, logger lager.Logger) error {
 	logger = logger.Session("cc-client")
 	logger.Info("delivering-staging-response", lager.Data{"payload": string(payload)})
 
@@ -71,6 +72,7 @@ func (cc *ccClient) StagingComplete(stagingGuid string, completionCallback strin
 
 	request.SetBasicAuth(cc.username, cc.password)
 	request.Header.Set("content-type", "application/json")
+	tracing.Inject(request.Header, trace)
 
 	response, err := cc.httpClient.Do(request)
 	if err != nil {
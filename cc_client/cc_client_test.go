@@ -9,6 +9,7 @@ import (
 
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/tracing"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -53,7 +54,21 @@ var _ = Describe("CC Client", func() {
 				),
 			)
 
-			err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), logger)
+			err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), tracing.SpanContext{}, logger)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("propagates the trace context", func() {
+			trace := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+			fakeCC.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid)),
+					ghttp.VerifyHeaderKV("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"),
+				),
+			)
+
+			err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), trace, logger)
 			Expect(err).NotTo(HaveOccurred())
 		})
 
@@ -78,7 +93,7 @@ var _ = Describe("CC Client", func() {
 			})
 
 			It("sends the request payload to the CC without modification", func() {
-				err := ccClient.StagingComplete(stagingGuid, completionCallback, expectedBody, logger)
+				err := ccClient.StagingComplete(stagingGuid, completionCallback, expectedBody, tracing.SpanContext{}, logger)
 				Expect(err).NotTo(HaveOccurred())
 			})
 		})
@@ -105,7 +120,7 @@ var _ = Describe("CC Client", func() {
 			})
 
 			It("fails with a self-signed certificate", func() {
-				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), logger)
+				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), tracing.SpanContext{}, logger)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -116,7 +131,7 @@ var _ = Describe("CC Client", func() {
 			})
 
 			It("Attempts to validate SSL certificates", func() {
-				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), logger)
+				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), tracing.SpanContext{}, logger)
 				Expect(err).NotTo(HaveOccurred())
 			})
 		})
@@ -130,7 +145,7 @@ var _ = Describe("CC Client", func() {
 			})
 
 			It("percolates the error", func() {
-				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), logger)
+				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), tracing.SpanContext{}, logger)
 				Expect(err).To(HaveOccurred())
 				Expect(err).To(BeAssignableToTypeOf(&url.Error{}))
 			})
@@ -147,7 +162,7 @@ var _ = Describe("CC Client", func() {
 			})
 
 			It("returns an error with the actual status code", func() {
-				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), logger)
+				err := ccClient.StagingComplete(stagingGuid, completionCallback, []byte(`{}`), tracing.SpanContext{}, logger)
 				Expect(err).To(HaveOccurred())
 				Expect(err).To(BeAssignableToTypeOf(&cc_client.BadResponseError{}))
 				Expect(err.(*cc_client.BadResponseError).StatusCode).To(Equal(500))
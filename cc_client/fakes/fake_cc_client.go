@@ -6,15 +6,17 @@ import (
 
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/tracing"
 )
 
 type FakeCcClient struct {
-	StagingCompleteStub        func(stagingGuid string, completionCallback string, payload []byte, logger lager.Logger) error
+	StagingCompleteStub        func(stagingGuid string, completionCallback string, payload []byte, trace tracing.SpanContext, logger lager.Logger) error
 	stagingCompleteMutex       sync.RWMutex
 	stagingCompleteArgsForCall []struct {
 		stagingGuid        string
 		completionCallback string
 		payload            []byte
+		trace              tracing.SpanContext
 		logger             lager.Logger
 	}
 	stagingCompleteReturns struct {
@@ -22,17 +24,18 @@ type FakeCcClient struct {
 	}
 }
 
-func (fake *FakeCcClient) StagingComplete(stagingGuid string, completionCallback string, payload []byte, logger lager.Logger) error {
+func (fake *FakeCcClient) StagingComplete(stagingGuid string, completionCallback string, payload []byte, trace tracing.SpanContext, logger lager.Logger) error {
 	fake.stagingCompleteMutex.Lock()
 	fake.stagingCompleteArgsForCall = append(fake.stagingCompleteArgsForCall, struct {
 		stagingGuid        string
 		completionCallback string
 		payload            []byte
+		trace              tracing.SpanContext
 		logger             lager.Logger
-	}{stagingGuid, completionCallback, payload, logger})
+	}{stagingGuid, completionCallback, payload, trace, logger})
 	fake.stagingCompleteMutex.Unlock()
 	if fake.StagingCompleteStub != nil {
-		return fake.StagingCompleteStub(stagingGuid, completionCallback, payload, logger)
+		return fake.StagingCompleteStub(stagingGuid, completionCallback, payload, trace, logger)
 	} else {
 		return fake.stagingCompleteReturns.result1
 	}
@@ -44,10 +47,10 @@ func (fake *FakeCcClient) StagingCompleteCallCount() int {
 	return len(fake.stagingCompleteArgsForCall)
 }
 
-func (fake *FakeCcClient) StagingCompleteArgsForCall(i int) (string, []byte, lager.Logger) {
+func (fake *FakeCcClient) StagingCompleteArgsForCall(i int) (string, string, []byte, tracing.SpanContext, lager.Logger) {
 	fake.stagingCompleteMutex.RLock()
 	defer fake.stagingCompleteMutex.RUnlock()
-	return fake.stagingCompleteArgsForCall[i].stagingGuid, fake.stagingCompleteArgsForCall[i].payload, fake.stagingCompleteArgsForCall[i].logger
+	return fake.stagingCompleteArgsForCall[i].stagingGuid, fake.stagingCompleteArgsForCall[i].completionCallback, fake.stagingCompleteArgsForCall[i].payload, fake.stagingCompleteArgsForCall[i].trace, fake.stagingCompleteArgsForCall[i].logger
 }
 
 func (fake *FakeCcClient) StagingCompleteReturns(result1 error) {
@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudfoundry/dropsonde"
 	"github.com/hashicorp/consul/api"
@@ -24,10 +26,15 @@ import (
 	"code.cloudfoundry.org/locket"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
 	"code.cloudfoundry.org/runtimeschema/cc_messages/flags"
+	"code.cloudfoundry.org/stager/audit"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cc_client"
 	"code.cloudfoundry.org/stager/config"
 	"code.cloudfoundry.org/stager/handlers"
+	"code.cloudfoundry.org/stager/redaction"
+	"code.cloudfoundry.org/stager/registration"
+	"code.cloudfoundry.org/stager/stager_metrics"
+	"code.cloudfoundry.org/stager/tracing"
 )
 
 var configPath = flag.String(
@@ -36,6 +43,12 @@ var configPath = flag.String(
 	"path to the stager configuration file",
 )
 
+var validateConfig = flag.Bool(
+	"validateConfig",
+	false,
+	"validate the stager configuration file, report every problem found and exit",
+)
+
 const (
 	dropsondeOrigin = "stager"
 )
@@ -45,31 +58,113 @@ func main() {
 
 	stagerConfig, err := config.NewStagerConfig(*configPath)
 	if err != nil {
+		if *validateConfig {
+			reportValidationErrors(err)
+			os.Exit(1)
+		}
 		panic(err.Error())
 	}
-	lifecycles := flags.LifecycleMap{}
-	for _, value := range stagerConfig.Lifecycles {
-		if err := lifecycles.Set(value); err != nil {
-			panic(err.Error())
-		}
+
+	err = config.Validate(stagerConfig)
+	if err != nil {
+		reportValidationErrors(err)
+		os.Exit(1)
+	}
+	if *validateConfig {
+		fmt.Println("stager config is valid")
+		os.Exit(0)
+	}
+
+	lifecycles, err := parseLifecycles(stagerConfig.Lifecycles)
+	if err != nil {
+		panic(err.Error())
 	}
 
 	logger, reconfigurableSink := lagerflags.NewFromConfig("stager", stagerConfig.LagerConfig)
 
+	redactor, err := redaction.NewRedactor(stagerConfig.LogRedactionPatterns)
+	if err != nil {
+		logger.Fatal("invalid-log-redaction-pattern", err)
+	}
+	logger = redaction.NewLogger(logger, redactor)
+
 	initializeDropsonde(logger, stagerConfig)
 
-	ccClient := cc_client.NewCcClient(stagerConfig.CCBaseUrl, stagerConfig.CCUsername, stagerConfig.CCPassword, stagerConfig.SkipCertVerify)
-	backends := initializeBackends(logger, lifecycles, stagerConfig)
+	ccClient := stager_metrics.NewCcClient(cc_client.NewCcClient(stagerConfig.CCBaseUrl, stagerConfig.CCUsername, stagerConfig.CCPassword, stagerConfig.SkipCertVerify))
+	currentLifecycleURLs := &atomic.Value{}
+	reloadableBackends := initializeBackends(logger, lifecycles, stagerConfig, currentLifecycleURLs)
+	backends := reloadableBackends.Backends()
 
-	handler := handlers.New(logger, ccClient, initializeBBSClient(logger, stagerConfig), backends, clock.NewClock())
+	reloader := handlers.NewConfigReloader(logger, reloadBackends(logger, reloadableBackends, currentLifecycleURLs))
 
-	clock := clock.NewClock()
-	consulClient, err := consuladapter.NewClientFromUrl(stagerConfig.ConsulCluster)
-	if err != nil {
-		logger.Fatal("new-client-failed", err)
+	retryPolicy := handlers.NewDesireTaskRetryPolicy(stagerConfig.DesireTaskMaxAttempts, time.Duration(stagerConfig.DesireTaskRetryTimeout))
+
+	var stagingQueue *handlers.StagingQueue
+	if stagerConfig.StagingWorkers > 0 {
+		stagingQueue = handlers.NewStagingQueue(logger, stagerConfig.StagingQueueSize, stagerConfig.StagingWorkers)
+	}
+
+	bbsClient := stager_metrics.NewBBSClient(initializeBBSClient(logger, stagerConfig))
+
+	var stagingLimiter *handlers.StagingLimiter
+	stagingLimits := handlers.StagingLimits{
+		MaxInFlight:                    stagerConfig.StagingMaxInFlight,
+		MaxInFlightPerApp:              stagerConfig.StagingMaxInFlightPerApp,
+		MaxInFlightPerIsolationSegment: stagerConfig.StagingMaxInFlightPerIsolationSegment,
+		CacheTTL:                       time.Duration(stagerConfig.StagingLimitsCacheTTL),
 	}
+	// the coalescer shares the limiter's cached task listing, so a limiter
+	// without limits is created for it when only coalescing is configured
+	if stagingLimits.Enabled() || stagerConfig.StagingCoalescePolicy != "" {
+		stagingLimiter = handlers.NewStagingLimiter(logger, bbsClient, clock.NewClock(), cc_messages.StagingTaskDomain, stagingLimits)
+	}
+
+	var stagingCoalescer *handlers.StagingCoalescer
+	if stagerConfig.StagingCoalescePolicy != "" {
+		stagingCoalescer, err = handlers.NewStagingCoalescer(logger, bbsClient, ccClient, stagingLimiter, cc_messages.StagingTaskDomain, stagerConfig.StagingCoalescePolicy)
+		if err != nil {
+			logger.Fatal("invalid-staging-coalesce-policy", err)
+		}
+	}
+
+	tracer, otlpExporter := initializeTracer(logger, stagerConfig, redactor)
 
-	_, portString, err := net.SplitHostPort(stagerConfig.ListenAddress)
+	auditor := audit.Discard
+	if stagerConfig.AuditLogPath != "" {
+		auditor, err = audit.NewFileRecorder(logger, stagerConfig.AuditLogPath, []byte(stagerConfig.AuditLogKey), redactor)
+		if err != nil {
+			logger.Fatal("failed-to-open-audit-log", err)
+		}
+	}
+
+	// Requests still queued when the grace period expires are reported to CC
+	// as interrupted before the stager exits.
+	var flushQueue func() int
+	if stagingQueue != nil {
+		flushQueue = stagingQueue.Flush
+	}
+	drainer := handlers.NewDrainer(logger, clock.NewClock(), time.Duration(stagerConfig.ShutdownGracePeriod), flushQueue)
+
+	// The lifecycle bundles are checked as of the latest reload.
+	lifecyclesCheck := handlers.LifecycleBundlesCheck(clock.NewClock(), stagerConfig.FileServerUrl, func() map[string]string {
+		return currentLifecycleURLs.Load().(map[string]string)
+	})
+
+	failureStore := handlers.NewFailureStore(stagerConfig.StagingFailureHistorySize)
+	// The admin endpoints share the plain HTTP listener, so their credentials
+	// need TLS in front of it; see handlers.AdminCredentials.
+	adminCredentials := handlers.AdminCredentials{Username: stagerConfig.AdminUsername, Password: stagerConfig.AdminPassword}
+
+	handler := handlers.New(logger, ccClient, bbsClient, backends, clock.NewClock(), tracer, auditor, retryPolicy, stagingQueue, stagingLimiter, stagingCoalescer, drainer, reloader, failureStore, adminCredentials, map[string]handlers.DependencyCheck{
+		"drain":      drainer.Draining,
+		"bbs":        handlers.BBSCheck(bbsClient),
+		"cc":         handlers.CCConfigCheck(stagerConfig.CCBaseUrl, stagerConfig.CCUsername, stagerConfig.CCPassword),
+		"lifecycles": lifecyclesCheck,
+	})
+
+	clock := clock.NewClock()
+
+	host, portString, err := net.SplitHostPort(stagerConfig.ListenAddress)
 	if err != nil {
 		logger.Fatal("failed-invalid-listen-address", err)
 	}
@@ -78,11 +173,31 @@ func main() {
 		logger.Fatal("failed-invalid-listen-port", err)
 	}
 
-	registrationRunner := initializeRegistrationRunner(logger, consulClient, portNum, clock)
-
 	members := grouper.Members{
 		{"server", http_server.New(stagerConfig.ListenAddress, handler)},
-		{"registration-runner", registrationRunner},
+		{"config-reloader", reloader},
+	}
+
+	if registrationRunner := initializeRegistrationRunner(logger, stagerConfig, host, portNum, clock); registrationRunner != nil {
+		members = append(members, grouper.Member{"registration-runner", registrationRunner})
+	}
+
+	if stagingQueue != nil {
+		members = append(grouper.Members{
+			{"staging-queue", stagingQueue},
+		}, members...)
+	}
+
+	// the exporter is stopped after the server and the queue, so that it
+	// still exports the spans of the last requests
+	if otlpExporter != nil {
+		members = append(grouper.Members{
+			{"otlp-exporter", otlpExporter},
+		}, members...)
+	}
+
+	if promAddr := stagerConfig.PrometheusListenAddress; promAddr != "" {
+		members = append(members, grouper.Member{"prometheus-server", http_server.New(promAddr, stager_metrics.Handler())})
 	}
 
 	if dbgAddr := stagerConfig.DebugServerConfig.DebugAddress; dbgAddr != "" {
@@ -91,6 +206,11 @@ func main() {
 		}, members...)
 	}
 
+	// Members are stopped in reverse order, so the drainer finishes in-flight
+	// requests and queued tasks before the stager deregisters and the server
+	// and queue stop.
+	members = append(members, grouper.Member{"drainer", drainer})
+
 	logger.Info("starting")
 
 	group := grouper.NewOrdered(os.Interrupt, members)
@@ -107,6 +227,21 @@ func main() {
 	logger.Info("stopped")
 }
 
+// reportValidationErrors writes every problem found in the config to stderr,
+// one per line.
+func reportValidationErrors(err error) {
+	validationErr, ok := err.(*config.ValidationError)
+	if !ok {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "invalid stager config:")
+	for _, message := range validationErr.Errors {
+		fmt.Fprintln(os.Stderr, "  "+message)
+	}
+}
+
 func initializeDropsonde(logger lager.Logger, stagerConfig config.StagerConfig) {
 	dropsondeDestination := fmt.Sprint("localhost:", stagerConfig.DropsondePort)
 	err := dropsonde.Initialize(dropsondeDestination, dropsondeOrigin)
@@ -115,37 +250,137 @@ func initializeDropsonde(logger lager.Logger, stagerConfig config.StagerConfig)
 	}
 }
 
-func initializeBackends(logger lager.Logger, lifecycles flags.LifecycleMap, stagerConfig config.StagerConfig) map[string]backend.Backend {
+// initializeTracer returns the tracer for staging requests, and the OTLP
+// exporter to run if spans are sent to a collector. Spans are written to
+// stdout instead if no collector is configured and tracing_stdout is set.
+// Requests without a trace context start a trace sampled with probability
+// tracing_sample_ratio, which defaults to 0 so that only the traces sampled
+// by CC are recorded.
+func initializeTracer(logger lager.Logger, stagerConfig config.StagerConfig, redactor *redaction.Redactor) (*tracing.Tracer, *tracing.OTLPExporter) {
+	if stagerConfig.TracingOTLPEndpoint != "" {
+		_, err := url.Parse(stagerConfig.TracingOTLPEndpoint)
+		if err != nil {
+			logger.Fatal("Invalid tracing OTLP endpoint", err)
+		}
+
+		exporter := tracing.NewOTLPExporter(logger, stagerConfig.TracingOTLPEndpoint, dropsondeOrigin, redactor)
+		return tracing.NewTracer(exporter, stagerConfig.TracingSampleRatio), exporter
+	}
+
+	if stagerConfig.TracingStdout {
+		return tracing.NewTracer(tracing.NewWriterExporter(dropsondeOrigin, os.Stdout, redactor), stagerConfig.TracingSampleRatio), nil
+	}
+
+	return tracing.NewTracer(nil, 0), nil
+}
+
+// initializeBackends returns reloadable backends for every lifecycle, so that
+// their configuration can be replaced without restarting the stager, and
+// stores the URLs of the configured lifecycle bundles in lifecycleURLs.
+func initializeBackends(logger lager.Logger, lifecycles flags.LifecycleMap, stagerConfig config.StagerConfig, lifecycleURLs *atomic.Value) *backend.ReloadableBackends {
+	backendConfig, err := newBackendConfig(lifecycles, stagerConfig)
+	if err != nil {
+		logger.Fatal("Invalid backend configuration", err)
+	}
+	lifecycleURLs.Store(backendConfig.LifecycleURLs())
+
+	return backend.NewReloadableBackends(newBackends(logger, backendConfig))
+}
+
+func newBackendConfig(lifecycles flags.LifecycleMap, stagerConfig config.StagerConfig) (backend.Config, error) {
 	_, err := url.Parse(stagerConfig.StagingTaskCallbackURL)
 	if err != nil {
-		logger.Fatal("Invalid staging task callback url", err)
+		return backend.Config{}, fmt.Errorf("invalid staging task callback url: %s", err)
 	}
 	if stagerConfig.DockerStagingStack == "" {
-		logger.Fatal("Invalid Docker staging stack", errors.New("dockerStagingStack cannot be blank"))
+		return backend.Config{}, errors.New("dockerStagingStack cannot be blank")
 	}
 
-	_, err = url.Parse(stagerConfig.ConsulCluster)
+	priorities, err := backend.NewPriorities(stagerConfig.StagingPriorityClasses, stagerConfig.StagingPriorityRules, stagerConfig.StagingDefaultPriorityClass)
 	if err != nil {
-		logger.Fatal("Error parsing consul agent URL", err)
+		return backend.Config{}, fmt.Errorf("invalid staging priority configuration: %s", err)
+	}
+
+	lifecycleBundles, err := backend.NewLifecycleBundles(stagerConfig.LifecycleBundles)
+	if err != nil {
+		return backend.Config{}, fmt.Errorf("invalid lifecycle bundles: %s", err)
+	}
+
+	failureClassifier, err := backend.NewFailureClassifier(stagerConfig.StagingFailureRules)
+	if err != nil {
+		return backend.Config{}, fmt.Errorf("invalid staging failure rules: %s", err)
 	}
-	config := backend.Config{
+
+	return backend.Config{
 		TaskDomain:               cc_messages.StagingTaskDomain,
 		StagerURL:                stagerConfig.StagingTaskCallbackURL,
 		FileServerURL:            stagerConfig.FileServerUrl,
 		CCUploaderURL:            stagerConfig.CCUploaderURL,
 		Lifecycles:               lifecycles,
+		LifecycleBundles:         lifecycleBundles,
 		InsecureDockerRegistries: stagerConfig.InsecureDockerRegistries,
 		ConsulCluster:            stagerConfig.ConsulCluster,
 		SkipCertVerify:           stagerConfig.SkipCertVerify,
 		PrivilegedContainers:     stagerConfig.PrivilegedContainers,
-		Sanitizer:                backend.SanitizeErrorMessage,
+		Sanitizer:                failureClassifier.Classify,
 		DockerStagingStack:       stagerConfig.DockerStagingStack,
-	}
+		Priorities:               priorities,
+	}, nil
+}
 
+func newBackends(logger lager.Logger, backendConfig backend.Config) map[string]backend.Backend {
 	return map[string]backend.Backend{
-		"buildpack": backend.NewTraditionalBackend(config, logger),
-		"docker":    backend.NewDockerBackend(config, logger),
+		"buildpack": backend.NewTraditionalBackend(backendConfig, logger),
+		"docker":    backend.NewDockerBackend(backendConfig, logger),
+	}
+}
+
+// reloadBackends returns a ReloadFunc that re-reads and validates the config
+// file, then swaps the backends built from it into the running backends all
+// at once. Staging requests that are already building their recipe finish
+// with the previous backend. Settings outside the backend configuration still
+// need a restart.
+func reloadBackends(logger lager.Logger, backends *backend.ReloadableBackends, lifecycleURLs *atomic.Value) handlers.ReloadFunc {
+	return func(reloadLogger lager.Logger) error {
+		stagerConfig, err := config.NewStagerConfig(*configPath)
+		if err != nil {
+			return err
+		}
+
+		err = config.Validate(stagerConfig)
+		if err != nil {
+			return err
+		}
+
+		lifecycles, err := parseLifecycles(stagerConfig.Lifecycles)
+		if err != nil {
+			return err
+		}
+
+		backendConfig, err := newBackendConfig(lifecycles, stagerConfig)
+		if err != nil {
+			return err
+		}
+
+		backends.Reload(newBackends(logger, backendConfig))
+		lifecycleURLs.Store(backendConfig.LifecycleURLs())
+
+		reloadLogger.Info("reloaded-backends", lager.Data{
+			"lifecycles":                 stagerConfig.Lifecycles,
+			"insecure-docker-registries": stagerConfig.InsecureDockerRegistries,
+		})
+		return nil
+	}
+}
+
+func parseLifecycles(values []string) (flags.LifecycleMap, error) {
+	lifecycles := flags.LifecycleMap{}
+	for _, value := range values {
+		if err := lifecycles.Set(value); err != nil {
+			return nil, err
+		}
 	}
+	return lifecycles, nil
 }
 
 func initializeBBSClient(logger lager.Logger, stagerConfig config.StagerConfig) bbs.Client {
@@ -165,13 +400,51 @@ func initializeBBSClient(logger lager.Logger, stagerConfig config.StagerConfig)
 	return bbsClient
 }
 
-func initializeRegistrationRunner(logger lager.Logger, consulClient consuladapter.Client, port int, clock clock.Clock) ifrit.Runner {
-	registration := &api.AgentServiceRegistration{
+// initializeRegistrationRunner returns the runner registering the stager with
+// the configured service registry, or nil if registration is disabled.
+func initializeRegistrationRunner(logger lager.Logger, stagerConfig config.StagerConfig, host string, port int, clock clock.Clock) ifrit.Runner {
+	switch stagerConfig.ServiceRegistration {
+	case registration.None:
+		logger.Info("service-registration-disabled")
+		return nil
+	case registration.File:
+		if stagerConfig.ServiceRegistrationFile == "" {
+			logger.Fatal("Invalid service registration file", errors.New("serviceRegistrationFile cannot be blank"))
+		}
+		address := stagerConfig.ServiceRegistrationAddress
+		if address == "" {
+			address = host
+		}
+		return registration.NewFileRunner(logger, stagerConfig.ServiceRegistrationFile, registration.Service{
+			Name:    "stager",
+			Address: address,
+			Port:    port,
+		})
+	case "", registration.Consul:
+		return initializeConsulRegistrationRunner(logger, stagerConfig, port, clock)
+	default:
+		logger.Fatal("Invalid service registration", registration.Validate(stagerConfig.ServiceRegistration))
+		return nil
+	}
+}
+
+func initializeConsulRegistrationRunner(logger lager.Logger, stagerConfig config.StagerConfig, port int, clock clock.Clock) ifrit.Runner {
+	_, err := url.Parse(stagerConfig.ConsulCluster)
+	if err != nil {
+		logger.Fatal("Error parsing consul agent URL", err)
+	}
+
+	consulClient, err := consuladapter.NewClientFromUrl(stagerConfig.ConsulCluster)
+	if err != nil {
+		logger.Fatal("new-client-failed", err)
+	}
+
+	serviceRegistration := &api.AgentServiceRegistration{
 		Name: "stager",
 		Port: port,
 		Check: &api.AgentServiceCheck{
 			TTL: "20s",
 		},
 	}
-	return locket.NewRegistrationRunner(logger, registration, consulClient, locket.RetryInterval, clock)
+	return locket.NewRegistrationRunner(logger, serviceRegistration, consulClient, locket.RetryInterval, clock)
 }
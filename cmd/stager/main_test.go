@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"code.cloudfoundry.org/bbs/models"
 	"code.cloudfoundry.org/bbs/models/test/model_helpers"
@@ -54,8 +57,13 @@ var _ = Describe("Stager", func() {
 			StagingTaskCallbackURL: stagerURL,
 			BBSAddress:             fakeBBS.URL(),
 			CCBaseUrl:              fakeCC.URL(),
+			CCUsername:             "cc-user",
+			CCPassword:             "cc-password",
+			CCUploaderURL:          "http://cc-uploader.example.com",
+			FileServerUrl:          "http://file-server.example.com",
 			DockerStagingStack:     "docker-staging-stack",
 			ConsulCluster:          consulRunner.URL(),
+			Lifecycles:             []string{"linux:lifecycle.zip"},
 		}
 
 		runner = testrunner.New(stagerConfig)
@@ -470,6 +478,56 @@ var _ = Describe("Stager", func() {
 				})
 			})
 		})
+
+		Describe("when a config reload is requested", func() {
+			It("does not serve the reload endpoint without admin credentials", func() {
+				req, err := requestGenerator.CreateRequest(stager.ReloadConfigRoute, nil, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				resp, err := httpClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				defer resp.Body.Close()
+
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+
+			Context("when admin credentials are configured", func() {
+				BeforeEach(func() {
+					runner.Config.AdminUsername = "admin"
+					runner.Config.AdminPassword = "admin-password"
+				})
+
+				It("rejects requests without the credentials", func() {
+					req, err := requestGenerator.CreateRequest(stager.ReloadConfigRoute, nil, nil)
+					Expect(err).NotTo(HaveOccurred())
+
+					resp, err := httpClient.Do(req)
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				})
+
+				It("reloads the backends", func() {
+					req, err := requestGenerator.CreateRequest(stager.ReloadConfigRoute, nil, nil)
+					Expect(err).NotTo(HaveOccurred())
+					req.SetBasicAuth("admin", "admin-password")
+
+					resp, err := httpClient.Do(req)
+					Expect(err).NotTo(HaveOccurred())
+					defer resp.Body.Close()
+
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					Eventually(runner.Session()).Should(gbytes.Say("reloaded-backends"))
+				})
+			})
+
+			It("reloads the backends on SIGHUP", func() {
+				runner.Session().Signal(syscall.SIGHUP)
+				Eventually(runner.Session()).Should(gbytes.Say("reloaded-backends"))
+				Consistently(runner.Session()).ShouldNot(gexec.Exit())
+			})
+		})
 	})
 
 	Context("when started with InsecureDockerRegistry set in the config", func() {
@@ -524,6 +582,90 @@ var _ = Describe("Stager", func() {
 		})
 	})
 
+	Describe("service registration without consul", func() {
+		BeforeEach(func() {
+			runner.Config.Lifecycles = []string{"linux:lifecycle.zip"}
+			runner.Config.ConsulCluster = ""
+		})
+
+		Context("when registration is disabled", func() {
+			BeforeEach(func() {
+				runner.Config.ServiceRegistration = "none"
+				runner.Start(stagerPath)
+				Eventually(runner.Session()).Should(gbytes.Say("Listening for staging requests!"))
+			})
+
+			It("does not register with consul", func() {
+				services, err := consulRunner.NewClient().Agent().Services()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(services).NotTo(HaveKey("stager"))
+			})
+		})
+
+		Context("when registering with a file", func() {
+			var registrationFile string
+
+			BeforeEach(func() {
+				dir, err := ioutil.TempDir("", "stager-registration")
+				Expect(err).NotTo(HaveOccurred())
+				registrationFile = filepath.Join(dir, "stager.json")
+
+				runner.Config.ServiceRegistration = "file"
+				runner.Config.ServiceRegistrationFile = registrationFile
+				runner.Start(stagerPath)
+				Eventually(runner.Session()).Should(gbytes.Say("Listening for staging requests!"))
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(filepath.Dir(registrationFile))
+			})
+
+			It("writes the service to the file", func() {
+				Eventually(func() ([]byte, error) {
+					return ioutil.ReadFile(registrationFile)
+				}).Should(MatchJSON(fmt.Sprintf(`{"name":"stager","address":"127.0.0.1","port":%d}`, stagerPort)))
+			})
+		})
+
+		Context("when registering with a file and a registration address", func() {
+			var registrationFile string
+
+			BeforeEach(func() {
+				dir, err := ioutil.TempDir("", "stager-registration")
+				Expect(err).NotTo(HaveOccurred())
+				registrationFile = filepath.Join(dir, "stager.json")
+
+				runner.Config.ServiceRegistration = "file"
+				runner.Config.ServiceRegistrationFile = registrationFile
+				runner.Config.ServiceRegistrationAddress = "stager.service.cf.internal"
+				runner.Start(stagerPath)
+				Eventually(runner.Session()).Should(gbytes.Say("Listening for staging requests!"))
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(filepath.Dir(registrationFile))
+			})
+
+			It("registers the configured address", func() {
+				Eventually(func() ([]byte, error) {
+					return ioutil.ReadFile(registrationFile)
+				}).Should(MatchJSON(fmt.Sprintf(`{"name":"stager","address":"stager.service.cf.internal","port":%d}`, stagerPort)))
+			})
+		})
+
+		Context("when the registration backend is unknown", func() {
+			BeforeEach(func() {
+				runner.Config.ServiceRegistration = "zookeeper"
+				runner.Start(stagerPath)
+			})
+
+			It("logs and errors", func() {
+				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
+				Eventually(runner.Session().Err).Should(gbytes.Say("service_registration: unknown service registration 'zookeeper'"))
+			})
+		})
+	})
+
 	Describe("-consulCluster arg", func() {
 		Context("when started with an invalid -consulCluster arg", func() {
 			BeforeEach(func() {
@@ -534,7 +676,7 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("Error parsing consul agent URL"))
+				Eventually(runner.Session().Err).Should(gbytes.Say("consul_cluster: "))
 			})
 		})
 	})
@@ -562,7 +704,7 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("Invalid staging task callback url"))
+				Eventually(runner.Session().Err).Should(gbytes.Say("staging_task_callback_url: "))
 			})
 		})
 	})
@@ -576,7 +718,7 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("missing port in address"))
+				Eventually(runner.Session().Err).Should(gbytes.Say("stager_listen_addr: .*missing port in address"))
 			})
 		})
 
@@ -588,11 +730,39 @@ var _ = Describe("Stager", func() {
 
 			It("logs and errors", func() {
 				Eventually(runner.Session().ExitCode()).ShouldNot(Equal(0))
-				Eventually(runner.Session()).Should(gbytes.Say("stager.failed-invalid-listen-port"))
+				Eventually(runner.Session().Err).Should(gbytes.Say("stager_listen_addr: "))
 			})
 		})
 	})
 
+	Describe("-validateConfig", func() {
+		Context("when the config is valid", func() {
+			BeforeEach(func() {
+				runner.Start(stagerPath, "-validateConfig")
+			})
+
+			It("reports that it is valid and exits successfully", func() {
+				Eventually(runner.Session()).Should(gexec.Exit(0))
+				Expect(runner.Session()).To(gbytes.Say("stager config is valid"))
+			})
+		})
+
+		Context("when the config has several problems", func() {
+			BeforeEach(func() {
+				runner.Config.CCBaseUrl = ""
+				runner.Config.DockerStagingStack = ""
+				runner.Config.Lifecycles = []string{"invalid form"}
+				runner.Start(stagerPath, "-validateConfig")
+			})
+
+			It("reports all of them and exits with an error", func() {
+				Eventually(runner.Session()).Should(gexec.Exit(1))
+				Expect(runner.Session().Err).To(gbytes.Say("cc_base_url: cannot be blank"))
+				Expect(runner.Session().Err).To(gbytes.Say("docker_staging_stack: cannot be blank"))
+				Expect(runner.Session().Err).To(gbytes.Say("lifecycles: 'invalid form'"))
+			})
+		})
+	})
 })
 
 func writeResponse(w http.ResponseWriter, message proto.Message) {
@@ -25,7 +25,7 @@ func New(config config.StagerConfig) *StagerRunner {
 	}
 }
 
-func (r *StagerRunner) Start(stagerBin string) {
+func (r *StagerRunner) Start(stagerBin string, args ...string) {
 	if r.session != nil {
 		panic("starting more than one stager runner!!!")
 	}
@@ -43,7 +43,7 @@ func (r *StagerRunner) Start(stagerBin string) {
 			stagerBin,
 			append([]string{
 				"-configPath", stagerFile.Name(),
-			})...,
+			}, args...)...,
 		),
 		gexec.NewPrefixedWriter("\x1b[32m[o]\x1b[95m[stager]\x1b[0m ", ginkgo.GinkgoWriter),
 		gexec.NewPrefixedWriter("\x1b[91m[e]\x1b[95m[stager]\x1b[0m ", ginkgo.GinkgoWriter),
@@ -2,54 +2,115 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/debugserver"
+	"code.cloudfoundry.org/durationjson"
 	"code.cloudfoundry.org/lager/lagerflags"
+	"code.cloudfoundry.org/stager/backend"
+	"github.com/ghodss/yaml"
 )
 
 type StagerConfig struct {
-	BBSAddress                string                        `json:"bbs_api_url"`
-	BBSCACert                 string                        `json:"bbs_ca_cert"`
-	BBSClientCert             string                        `json:"bbs_client_cert"`
-	BBSClientKey              string                        `json:"bbs_client_key"`
-	BBSClientSessionCacheSize int                           `json:"bbs_client_cache_size"`
-	BBSMaxIdleConnsPerHost    int                           `json:"bbs_max_idle_conns_per_host"`
-	CCBaseUrl                 string                        `json:"cc_base_url"`
-	CCPassword                string                        `json:"cc_basic_auth_password"`
-	CCUploaderURL             string                        `json:"cc_uploader_url"`
-	CCUsername                string                        `json:"cc_basic_auth_username"`
-	ConsulCluster             string                        `json:"consul_cluster"`
-	DebugServerConfig         debugserver.DebugServerConfig `json:"debug_server_config"`
-	DockerStagingStack        string                        `json:"docker_staging_stack"`
-	DropsondePort             int                           `json:"dropsonde_port"`
-	InsecureDockerRegistries  []string                      `json:"insecure_docker_registries"`
-	FileServerUrl             string                        `json:"file_server_url"`
-	LagerConfig               lagerflags.LagerConfig        `json:"lager_config"`
-	Lifecycles                []string                      `json:"lifecycles"`
-	ListenAddress             string                        `json:"stager_listen_addr"`
-	PrivilegedContainers      bool                          `json:"diego_privileged_containers"`
-	SkipCertVerify            bool                          `json:"skip_cert_verify"`
-	StagingTaskCallbackURL    string                        `json:"staging_task_callback_url"`
+	AdminPassword                         string                        `json:"admin_basic_auth_password"`
+	AdminPasswordFile                     string                        `json:"admin_basic_auth_password_file"`
+	AdminUsername                         string                        `json:"admin_basic_auth_username"`
+	AdminUsernameFile                     string                        `json:"admin_basic_auth_username_file"`
+	AuditLogKey                           string                        `json:"audit_log_hmac_key"`
+	AuditLogKeyFile                       string                        `json:"audit_log_hmac_key_file"`
+	AuditLogPath                          string                        `json:"audit_log_path"`
+	BBSAddress                            string                        `json:"bbs_api_url"`
+	BBSCACert                             string                        `json:"bbs_ca_cert"`
+	BBSClientCert                         string                        `json:"bbs_client_cert"`
+	BBSClientKey                          string                        `json:"bbs_client_key"`
+	BBSClientSessionCacheSize             int                           `json:"bbs_client_cache_size"`
+	BBSMaxIdleConnsPerHost                int                           `json:"bbs_max_idle_conns_per_host"`
+	CCBaseUrl                             string                        `json:"cc_base_url"`
+	CCPassword                            string                        `json:"cc_basic_auth_password"`
+	CCPasswordFile                        string                        `json:"cc_basic_auth_password_file"`
+	CCUploaderURL                         string                        `json:"cc_uploader_url"`
+	CCUsername                            string                        `json:"cc_basic_auth_username"`
+	CCUsernameFile                        string                        `json:"cc_basic_auth_username_file"`
+	ConsulCluster                         string                        `json:"consul_cluster"`
+	DebugServerConfig                     debugserver.DebugServerConfig `json:"debug_server_config"`
+	DesireTaskMaxAttempts                 int                           `json:"desire_task_max_attempts"`
+	DesireTaskRetryTimeout                durationjson.Duration         `json:"desire_task_retry_timeout"`
+	DockerStagingStack                    string                        `json:"docker_staging_stack"`
+	DropsondePort                         int                           `json:"dropsonde_port"`
+	InsecureDockerRegistries              []string                      `json:"insecure_docker_registries"`
+	FileServerUrl                         string                        `json:"file_server_url"`
+	LagerConfig                           lagerflags.LagerConfig        `json:"lager_config"`
+	LifecycleBundles                      []backend.LifecycleBundle     `json:"lifecycle_bundles"`
+	Lifecycles                            []string                      `json:"lifecycles"`
+	ListenAddress                         string                        `json:"stager_listen_addr"`
+	LogRedactionPatterns                  []string                      `json:"log_redaction_patterns"`
+	PrometheusListenAddress               string                        `json:"prometheus_listen_addr"`
+	PrivilegedContainers                  bool                          `json:"diego_privileged_containers"`
+	ServiceRegistration                   string                        `json:"service_registration"`
+	ServiceRegistrationAddress            string                        `json:"service_registration_address"`
+	ServiceRegistrationFile               string                        `json:"service_registration_file"`
+	ShutdownGracePeriod                   durationjson.Duration         `json:"shutdown_grace_period"`
+	SkipCertVerify                        bool                          `json:"skip_cert_verify"`
+	StagingCoalescePolicy                 string                        `json:"staging_coalesce_policy"`
+	StagingDefaultPriorityClass           string                        `json:"staging_default_priority_class"`
+	StagingFailureHistorySize             int                           `json:"staging_failure_history_size"`
+	StagingFailureRules                   []backend.FailureRule         `json:"staging_failure_rules"`
+	StagingLimitsCacheTTL                 durationjson.Duration         `json:"staging_limits_cache_ttl"`
+	StagingMaxInFlight                    int                           `json:"staging_max_in_flight"`
+	StagingMaxInFlightPerApp              int                           `json:"staging_max_in_flight_per_app"`
+	StagingMaxInFlightPerIsolationSegment int                           `json:"staging_max_in_flight_per_isolation_segment"`
+	StagingPriorityClasses                []backend.PriorityClass       `json:"staging_priority_classes"`
+	StagingPriorityRules                  []backend.PriorityRule        `json:"staging_priority_rules"`
+	StagingQueueSize                      int                           `json:"staging_queue_size"`
+	StagingTaskCallbackURL                string                        `json:"staging_task_callback_url"`
+	StagingWorkers                        int                           `json:"staging_workers"`
+	TracingOTLPEndpoint                   string                        `json:"tracing_otlp_endpoint"`
+	TracingSampleRatio                    float64                       `json:"tracing_sample_ratio"`
+	TracingStdout                         bool                          `json:"tracing_stdout"`
 }
 
 func DefaultStagerConfig() StagerConfig {
 	return StagerConfig{
 		BBSClientSessionCacheSize: 0,
 		BBSMaxIdleConnsPerHost:    0,
+		DesireTaskMaxAttempts:     3,
+		DesireTaskRetryTimeout:    durationjson.Duration(10 * time.Second),
 		DropsondePort:             3457,
 		LagerConfig:               lagerflags.DefaultLagerConfig(),
 		PrivilegedContainers:      false,
+		ServiceRegistration:       "consul",
+		ShutdownGracePeriod:       durationjson.Duration(30 * time.Second),
 		SkipCertVerify:            false,
+		StagingFailureHistorySize: 1000,
+		StagingLimitsCacheTTL:     durationjson.Duration(5 * time.Second),
+		StagingQueueSize:          1000,
+		StagingWorkers:            0,
 	}
 }
 
+// NewStagerConfig reads the config file at configPath, which is YAML if it
+// has a .yml or .yaml extension and JSON otherwise. Fields are then overridden
+// by STAGER_* environment variables, and secrets are read from any *_file
+// fields that are set.
 func NewStagerConfig(configPath string) (StagerConfig, error) {
 	configFile, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		return StagerConfig{}, err
 	}
 
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yml", ".yaml":
+		configFile, err = yaml.YAMLToJSON(configFile)
+		if err != nil {
+			return StagerConfig{}, err
+		}
+	}
+
 	stagerConfig := DefaultStagerConfig()
 
 	err = json.Unmarshal(configFile, &stagerConfig)
@@ -57,5 +118,49 @@ func NewStagerConfig(configPath string) (StagerConfig, error) {
 		return StagerConfig{}, err
 	}
 
+	err = applyEnvironment(&stagerConfig, os.LookupEnv)
+	if err != nil {
+		return StagerConfig{}, err
+	}
+
+	err = stagerConfig.readSecretFiles()
+	if err != nil {
+		return StagerConfig{}, err
+	}
+
 	return stagerConfig, nil
 }
+
+// readSecretFiles sets each secret from the file named by its *_file field,
+// so that secrets can be mounted into the stager rather than inlined. The BBS
+// TLS fields need no *_file field, as they are already paths; see README.md.
+func (c *StagerConfig) readSecretFiles() error {
+	secrets := []struct {
+		key   string
+		path  string
+		value *string
+	}{
+		{"admin_basic_auth_password", c.AdminPasswordFile, &c.AdminPassword},
+		{"admin_basic_auth_username", c.AdminUsernameFile, &c.AdminUsername},
+		{"audit_log_hmac_key", c.AuditLogKeyFile, &c.AuditLogKey},
+		{"cc_basic_auth_password", c.CCPasswordFile, &c.CCPassword},
+		{"cc_basic_auth_username", c.CCUsernameFile, &c.CCUsername},
+	}
+
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("%s and %s_file cannot both be set", secret.key, secret.key)
+		}
+
+		contents, err := ioutil.ReadFile(secret.path)
+		if err != nil {
+			return fmt.Errorf("reading %s_file: %s", secret.key, err)
+		}
+		*secret.value = strings.TrimRight(string(contents), "\r\n")
+	}
+
+	return nil
+}
@@ -1,6 +1,13 @@
 package config_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/durationjson"
+	"code.cloudfoundry.org/stager/backend"
 	. "code.cloudfoundry.org/stager/config"
 
 	. "github.com/onsi/ginkgo"
@@ -15,16 +22,30 @@ var _ = Describe("Config", func() {
 
 			Expect(stagerConfig.BBSClientSessionCacheSize).To(Equal(0))
 			Expect(stagerConfig.BBSMaxIdleConnsPerHost).To(Equal(0))
+			Expect(stagerConfig.DesireTaskMaxAttempts).To(Equal(3))
+			Expect(stagerConfig.DesireTaskRetryTimeout).To(Equal(durationjson.Duration(10 * time.Second)))
 			Expect(stagerConfig.DropsondePort).To(Equal(3457))
 			Expect(stagerConfig.PrivilegedContainers).NotTo(BeTrue())
 			Expect(stagerConfig.SkipCertVerify).NotTo(BeTrue())
+			Expect(stagerConfig.ServiceRegistration).To(Equal("consul"))
+			Expect(stagerConfig.ShutdownGracePeriod).To(Equal(durationjson.Duration(30 * time.Second)))
 			Expect(stagerConfig.BBSMaxIdleConnsPerHost).To(Equal(0))
+			Expect(stagerConfig.StagingCoalescePolicy).To(BeEmpty())
+			Expect(stagerConfig.StagingFailureHistorySize).To(Equal(1000))
+			Expect(stagerConfig.StagingLimitsCacheTTL).To(Equal(durationjson.Duration(5 * time.Second)))
+			Expect(stagerConfig.StagingMaxInFlight).To(Equal(0))
+			Expect(stagerConfig.StagingMaxInFlightPerApp).To(Equal(0))
+			Expect(stagerConfig.StagingMaxInFlightPerIsolationSegment).To(Equal(0))
+			Expect(stagerConfig.StagingQueueSize).To(Equal(1000))
+			Expect(stagerConfig.StagingWorkers).To(Equal(0))
 			Expect(stagerConfig.LagerConfig.LogLevel).To(Equal("info"))
 		})
 
 		It("reads from the config file and populates the config", func() {
 			stagerConfig, err := NewStagerConfig("../fixtures/stager_config.json")
 			Expect(err).ToNot(HaveOccurred())
+			Expect(stagerConfig.AdminPassword).To(Equal("admin_basic_auth_password"))
+			Expect(stagerConfig.AdminUsername).To(Equal("admin_basic_auth_username"))
 			Expect(stagerConfig.BBSAddress).To(Equal("http://bbs.example.com"))
 			Expect(stagerConfig.BBSCACert).To(Equal("bbs-ca-cert"))
 			Expect(stagerConfig.BBSClientCert).To(Equal("bbs-client-cert"))
@@ -37,16 +58,185 @@ var _ = Describe("Config", func() {
 			Expect(stagerConfig.CCUsername).To(Equal("cc_basic_auth_username"))
 			Expect(stagerConfig.ConsulCluster).To(Equal("consul_cluster"))
 			Expect(stagerConfig.DebugServerConfig.DebugAddress).To(Equal("debug_address"))
+			Expect(stagerConfig.DesireTaskMaxAttempts).To(Equal(5))
+			Expect(stagerConfig.DesireTaskRetryTimeout).To(Equal(durationjson.Duration(30 * time.Second)))
 			Expect(stagerConfig.DockerStagingStack).To(Equal("docker_staging_stack"))
 			Expect(stagerConfig.DropsondePort).To(Equal(12))
 			Expect(stagerConfig.InsecureDockerRegistries).To(Equal([]string{"insecure_docker_registries"}))
 			Expect(stagerConfig.FileServerUrl).To(Equal("file_server_url"))
 			Expect(stagerConfig.LagerConfig.LogLevel).To(Equal("fatal"))
 			Expect(stagerConfig.Lifecycles).To(Equal([]string{"lifecycles"}))
+			Expect(stagerConfig.LifecycleBundles).To(Equal([]backend.LifecycleBundle{{
+				Lifecycle: "buildpack",
+				Stack:     "cflinuxfs3",
+				URL:       "buildpack_app_lifecycle/buildpack_app_lifecycle.tgz",
+				Checksum:  "sha256:abc123",
+				Version:   "1.2.3",
+				RootFS:    "preloaded:cflinuxfs3",
+				CacheKey:  "buildpack-cflinuxfs3-lifecycle-1.2.3",
+			}}))
 			Expect(stagerConfig.ListenAddress).To(Equal("stager_listen_addr"))
 			Expect(stagerConfig.PrivilegedContainers).To(BeTrue())
+			Expect(stagerConfig.PrometheusListenAddress).To(Equal("prometheus_listen_addr"))
 			Expect(stagerConfig.SkipCertVerify).NotTo(BeTrue())
+			Expect(stagerConfig.StagingCoalescePolicy).To(Equal("cancel-older"))
+			Expect(stagerConfig.StagingDefaultPriorityClass).To(Equal("normal"))
+			Expect(stagerConfig.StagingFailureHistorySize).To(Equal(500))
+			oomExitCode := 137
+			Expect(stagerConfig.StagingFailureRules).To(Equal([]backend.FailureRule{
+				{Pattern: "OOM", ExitCode: &oomExitCode, Lifecycle: "buildpack", Id: "StagingOutOfMemory", Message: "staging ran out of memory"},
+			}))
+			Expect(stagerConfig.StagingLimitsCacheTTL).To(Equal(durationjson.Duration(2 * time.Second)))
+			Expect(stagerConfig.StagingMaxInFlight).To(Equal(100))
+			Expect(stagerConfig.StagingMaxInFlightPerApp).To(Equal(2))
+			Expect(stagerConfig.StagingMaxInFlightPerIsolationSegment).To(Equal(20))
+			Expect(stagerConfig.StagingPriorityClasses).To(Equal([]backend.PriorityClass{
+				{Name: "normal"},
+				{Name: "high", CpuWeight: 100, PlacementTags: []string{"fast-cells"}, QueuePriority: 10},
+			}))
+			Expect(stagerConfig.StagingPriorityRules).To(Equal([]backend.PriorityRule{
+				{IsolationSegment: "production", Lifecycle: "buildpack", EnvironmentVariable: "HOTFIX", EnvironmentValue: "true", Class: "high"},
+			}))
+			Expect(stagerConfig.StagingQueueSize).To(Equal(50))
+			Expect(stagerConfig.StagingWorkers).To(Equal(4))
 			Expect(stagerConfig.StagingTaskCallbackURL).To(Equal("staging_task_callback_url"))
+			Expect(stagerConfig.TracingOTLPEndpoint).To(Equal("http://otel-collector:4318"))
+			Expect(stagerConfig.TracingSampleRatio).To(Equal(0.25))
+			Expect(stagerConfig.TracingStdout).To(BeTrue())
+			Expect(stagerConfig.AuditLogPath).To(Equal("/var/vcap/sys/log/stager/audit.log"))
+			Expect(stagerConfig.AuditLogKey).To(Equal("audit_log_hmac_key"))
+			Expect(stagerConfig.LogRedactionPatterns).To(Equal([]string{"sk_live_[a-z0-9]+"}))
+			Expect(stagerConfig.ServiceRegistration).To(Equal("file"))
+			Expect(stagerConfig.ServiceRegistrationFile).To(Equal("/var/vcap/data/stager/registration.json"))
+			Expect(stagerConfig.ServiceRegistrationAddress).To(Equal("10.0.16.4"))
+			Expect(stagerConfig.ShutdownGracePeriod).To(Equal(durationjson.Duration(45 * time.Second)))
+		})
+
+		It("reads YAML config files", func() {
+			stagerConfig, err := NewStagerConfig("../fixtures/stager_config.yml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stagerConfig.BBSAddress).To(Equal("http://bbs.example.com"))
+			Expect(stagerConfig.CCBaseUrl).To(Equal("cc_base_url"))
+			Expect(stagerConfig.DesireTaskRetryTimeout).To(Equal(durationjson.Duration(30 * time.Second)))
+			Expect(stagerConfig.LagerConfig.LogLevel).To(Equal("debug"))
+			Expect(stagerConfig.Lifecycles).To(Equal([]string{
+				"buildpack/cflinuxfs3:buildpack_app_lifecycle.tgz",
+				"docker:docker_app_lifecycle.tgz",
+			}))
+			Expect(stagerConfig.StagingPriorityClasses).To(Equal([]backend.PriorityClass{{Name: "normal"}}))
+			Expect(stagerConfig.StagingQueueSize).To(Equal(1000))
+		})
+
+		Context("when STAGER_* environment variables are set", func() {
+			var env map[string]string
+
+			BeforeEach(func() {
+				env = map[string]string{
+					"STAGER_CC_BASE_URL":                       "https://cc.example.com",
+					"STAGER_STAGING_WORKERS":                   "8",
+					"STAGER_SKIP_CERT_VERIFY":                  "true",
+					"STAGER_DESIRE_TASK_RETRY_TIMEOUT":         "1m",
+					"STAGER_LIFECYCLES":                        "buildpack/cflinuxfs3:lifecycle.tgz,docker:docker.tgz",
+					"STAGER_LAGER_CONFIG_LOG_LEVEL":            "error",
+					"STAGER_DEBUG_SERVER_CONFIG_DEBUG_ADDRESS": "127.0.0.1:17017",
+					"STAGER_STAGING_PRIORITY_CLASSES":          `[{"name":"high","queue_priority":10}]`,
+				}
+				for name, value := range env {
+					os.Setenv(name, value)
+				}
+			})
+
+			AfterEach(func() {
+				for name := range env {
+					os.Unsetenv(name)
+				}
+			})
+
+			It("overrides the config file", func() {
+				stagerConfig, err := NewStagerConfig("../fixtures/stager_config.json")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stagerConfig.CCBaseUrl).To(Equal("https://cc.example.com"))
+				Expect(stagerConfig.StagingWorkers).To(Equal(8))
+				Expect(stagerConfig.SkipCertVerify).To(BeTrue())
+				Expect(stagerConfig.DesireTaskRetryTimeout).To(Equal(durationjson.Duration(time.Minute)))
+				Expect(stagerConfig.Lifecycles).To(Equal([]string{"buildpack/cflinuxfs3:lifecycle.tgz", "docker:docker.tgz"}))
+				Expect(stagerConfig.LagerConfig.LogLevel).To(Equal("error"))
+				Expect(stagerConfig.DebugServerConfig.DebugAddress).To(Equal("127.0.0.1:17017"))
+				Expect(stagerConfig.StagingPriorityClasses).To(Equal([]backend.PriorityClass{{Name: "high", QueuePriority: 10}}))
+				Expect(stagerConfig.BBSAddress).To(Equal("http://bbs.example.com"))
+			})
+
+			Context("when a variable cannot be parsed", func() {
+				BeforeEach(func() {
+					env["STAGER_STAGING_WORKERS"] = "many"
+					os.Setenv("STAGER_STAGING_WORKERS", "many")
+				})
+
+				It("returns an error naming the variable", func() {
+					_, err := NewStagerConfig("../fixtures/empty_config.json")
+					Expect(err).To(MatchError(ContainSubstring("STAGER_STAGING_WORKERS")))
+				})
+			})
+		})
+
+		Context("when secrets are given as files", func() {
+			var (
+				secretsDir string
+				configPath string
+			)
+
+			writeFile := func(name, contents string) string {
+				path := filepath.Join(secretsDir, name)
+				Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+				return path
+			}
+
+			BeforeEach(func() {
+				var err error
+				secretsDir, err = ioutil.TempDir("", "stager-secrets")
+				Expect(err).NotTo(HaveOccurred())
+
+				passwordFile := writeFile("password", "s3cr3t\n")
+				usernameFile := writeFile("username", "cc-user")
+				configPath = writeFile("config.yml", "cc_basic_auth_password_file: "+passwordFile+"\ncc_basic_auth_username_file: "+usernameFile+"\n")
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(secretsDir)
+			})
+
+			It("reads the secrets from the files", func() {
+				stagerConfig, err := NewStagerConfig(configPath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stagerConfig.CCPassword).To(Equal("s3cr3t"))
+				Expect(stagerConfig.CCUsername).To(Equal("cc-user"))
+			})
+
+			Context("when the secret is also set inline", func() {
+				BeforeEach(func() {
+					os.Setenv("STAGER_CC_BASIC_AUTH_PASSWORD", "inline")
+				})
+
+				AfterEach(func() {
+					os.Unsetenv("STAGER_CC_BASIC_AUTH_PASSWORD")
+				})
+
+				It("returns an error", func() {
+					_, err := NewStagerConfig(configPath)
+					Expect(err).To(MatchError("cc_basic_auth_password and cc_basic_auth_password_file cannot both be set"))
+				})
+			})
+
+			Context("when the file does not exist", func() {
+				BeforeEach(func() {
+					configPath = writeFile("config.yml", "cc_basic_auth_password_file: "+filepath.Join(secretsDir, "missing")+"\n")
+				})
+
+				It("returns an error", func() {
+					_, err := NewStagerConfig(configPath)
+					Expect(err).To(MatchError(ContainSubstring("reading cc_basic_auth_password_file")))
+				})
+			})
 		})
 	})
 })
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// EnvironmentPrefix prefixes the environment variables that override config
+// fields. Each variable is named after the field's JSON key in upper case, with
+// nested keys joined by underscores, e.g. STAGER_CC_BASE_URL or
+// STAGER_LAGER_CONFIG_LOG_LEVEL.
+const EnvironmentPrefix = "STAGER_"
+
+// applyEnvironment overrides the fields of the struct pointed to by config with
+// the environment variables returned by lookup. Values are parsed as JSON,
+// falling back to a plain string, so that durations can be given as "10s" and
+// string lists as comma-separated values.
+func applyEnvironment(config interface{}, lookup func(string) (string, bool)) error {
+	return applyEnvironmentToStruct(reflect.ValueOf(config).Elem(), EnvironmentPrefix, lookup)
+}
+
+func applyEnvironmentToStruct(value reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		key := strings.Split(valueType.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		name := prefix + strings.ToUpper(key)
+		field := value.Field(i)
+
+		if isNestedStruct(field) {
+			err := applyEnvironmentToStruct(field, name+"_", lookup)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		err := setFromEnvironment(field, raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// isNestedStruct returns true for structs whose fields are configured
+// individually, rather than types such as durations that unmarshal themselves.
+func isNestedStruct(field reflect.Value) bool {
+	if field.Kind() != reflect.Struct {
+		return false
+	}
+	_, ok := field.Addr().Interface().(json.Unmarshaler)
+	return !ok
+}
+
+func setFromEnvironment(field reflect.Value, raw string) error {
+	target := field.Addr().Interface()
+
+	if field.Kind() != reflect.String && json.Unmarshal([]byte(raw), target) == nil {
+		return nil
+	}
+
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+		values := []string{}
+		if raw != "" {
+			values = strings.Split(raw, ",")
+		}
+		field.Set(reflect.ValueOf(values).Convert(field.Type()))
+		return nil
+	}
+
+	quoted, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(quoted, target)
+}
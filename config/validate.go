@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages/flags"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/redaction"
+	"code.cloudfoundry.org/stager/registration"
+)
+
+// ValidationError lists every problem found in a stager config, each prefixed
+// by the JSON key of the offending field.
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid stager config: " + strings.Join(e.Errors, "; ")
+}
+
+func (e *ValidationError) add(key, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, key+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks the whole config and returns a *ValidationError reporting
+// every problem found, or nil if the config is valid.
+func Validate(c StagerConfig) error {
+	v := &ValidationError{}
+
+	v.requireURL("bbs_api_url", c.BBSAddress)
+	if strings.HasPrefix(c.BBSAddress, "https:") {
+		v.requireFile("bbs_ca_cert", c.BBSCACert)
+		v.requireFile("bbs_client_cert", c.BBSClientCert)
+		v.requireFile("bbs_client_key", c.BBSClientKey)
+	}
+
+	v.requireURL("cc_base_url", c.CCBaseUrl)
+	v.requireString("cc_basic_auth_username", c.CCUsername)
+	v.requireString("cc_basic_auth_password", c.CCPassword)
+	v.requireURL("cc_uploader_url", c.CCUploaderURL)
+	v.requireURL("file_server_url", c.FileServerUrl)
+	v.requireURL("staging_task_callback_url", c.StagingTaskCallbackURL)
+	v.requireString("docker_staging_stack", c.DockerStagingStack)
+
+	if len(c.Lifecycles) == 0 && len(c.LifecycleBundles) == 0 {
+		v.add("lifecycles", "cannot be empty unless lifecycle_bundles are configured")
+	}
+	lifecycles := flags.LifecycleMap{}
+	for _, lifecycle := range c.Lifecycles {
+		if err := lifecycles.Set(lifecycle); err != nil {
+			v.add("lifecycles", "'%s': %s", lifecycle, err)
+		}
+	}
+
+	if _, err := backend.NewLifecycleBundles(c.LifecycleBundles); err != nil {
+		v.add("lifecycle_bundles", "%s", err)
+	}
+
+	v.requireAddress("stager_listen_addr", c.ListenAddress)
+	if c.PrometheusListenAddress != "" {
+		v.requireAddress("prometheus_listen_addr", c.PrometheusListenAddress)
+	}
+	if c.DebugServerConfig.DebugAddress != "" {
+		v.requireAddress("debug_server_config.debug_address", c.DebugServerConfig.DebugAddress)
+	}
+
+	if err := registration.Validate(c.ServiceRegistration); err != nil {
+		v.add("service_registration", "%s", err)
+	}
+	switch c.ServiceRegistration {
+	case "", registration.Consul:
+		v.requireURL("consul_cluster", c.ConsulCluster)
+	case registration.File:
+		v.requireString("service_registration_file", c.ServiceRegistrationFile)
+		v.requireRegistrationAddress(c.ServiceRegistrationAddress, c.ListenAddress)
+	}
+
+	if c.TracingOTLPEndpoint != "" {
+		v.requireURL("tracing_otlp_endpoint", c.TracingOTLPEndpoint)
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		v.add("tracing_sample_ratio", "must be between 0 and 1")
+	}
+
+	if _, err := redaction.NewRedactor(c.LogRedactionPatterns); err != nil {
+		v.add("log_redaction_patterns", "%s", err)
+	}
+
+	if _, err := backend.NewPriorities(c.StagingPriorityClasses, c.StagingPriorityRules, c.StagingDefaultPriorityClass); err != nil {
+		v.add("staging_priority_classes", "%s", err)
+	}
+
+	if _, err := backend.NewFailureClassifier(c.StagingFailureRules); err != nil {
+		v.add("staging_failure_rules", "%s", err)
+	}
+
+	if (c.AdminUsername == "") != (c.AdminPassword == "") {
+		v.add("admin_basic_auth_username", "admin_basic_auth_username and admin_basic_auth_password must be set together")
+	}
+	if c.AuditLogPath != "" && c.AuditLogKey == "" {
+		v.add("audit_log_hmac_key", "must be set when audit_log_path is set")
+	}
+	if c.StagingFailureHistorySize < 0 {
+		v.add("staging_failure_history_size", "cannot be negative")
+	}
+	if c.StagingQueueSize < 0 {
+		v.add("staging_queue_size", "cannot be negative")
+	}
+	if c.StagingWorkers < 0 {
+		v.add("staging_workers", "cannot be negative")
+	}
+	if c.ShutdownGracePeriod < 0 {
+		v.add("shutdown_grace_period", "cannot be negative")
+	}
+
+	if len(v.Errors) > 0 {
+		return v
+	}
+	return nil
+}
+
+func (e *ValidationError) requireString(key, value string) {
+	if value == "" {
+		e.add(key, "cannot be blank")
+	}
+}
+
+func (e *ValidationError) requireURL(key, value string) {
+	if value == "" {
+		e.add(key, "cannot be blank")
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		e.add(key, "%s", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		e.add(key, "'%s' must be an http or https URL", value)
+		return
+	}
+	if u.Host == "" {
+		e.add(key, "'%s' has no host", value)
+	}
+}
+
+func (e *ValidationError) requireAddress(key, value string) {
+	if value == "" {
+		e.add(key, "cannot be blank")
+		return
+	}
+
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		e.add(key, "%s", err)
+		return
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		e.add(key, "%s", err)
+	}
+}
+
+// requireRegistrationAddress checks that the stager registers an address that
+// other components can reach: service_registration_address if it is set, or
+// else the host of the listen address, which must not be unspecified.
+func (e *ValidationError) requireRegistrationAddress(registrationAddress, listenAddress string) {
+	if registrationAddress != "" {
+		if isUnspecifiedHost(registrationAddress) {
+			e.add("service_registration_address", "'%s' is not a reachable address", registrationAddress)
+		}
+		return
+	}
+
+	host, _, err := net.SplitHostPort(listenAddress)
+	if err == nil && isUnspecifiedHost(host) {
+		e.add("service_registration_address", "must be set when stager_listen_addr listens on all interfaces")
+	}
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func (e *ValidationError) requireFile(key, path string) {
+	if path == "" {
+		e.add(key, "cannot be blank")
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		e.add(key, "%s", err)
+	}
+}
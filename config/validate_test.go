@@ -0,0 +1,211 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/stager/backend"
+	. "code.cloudfoundry.org/stager/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate", func() {
+	var stagerConfig StagerConfig
+
+	BeforeEach(func() {
+		stagerConfig = DefaultStagerConfig()
+		stagerConfig.BBSAddress = "http://bbs.service.cf.internal:8889"
+		stagerConfig.CCBaseUrl = "https://cc.service.cf.internal:9023"
+		stagerConfig.CCUsername = "cc-user"
+		stagerConfig.CCPassword = "cc-password"
+		stagerConfig.CCUploaderURL = "http://cc-uploader.service.cf.internal:9090"
+		stagerConfig.FileServerUrl = "http://file-server.service.cf.internal:8080"
+		stagerConfig.StagingTaskCallbackURL = "http://stager.service.cf.internal:8888"
+		stagerConfig.DockerStagingStack = "cflinuxfs3"
+		stagerConfig.Lifecycles = []string{"buildpack/cflinuxfs3:buildpack_app_lifecycle.tgz", "docker:docker_app_lifecycle.tgz"}
+		stagerConfig.ListenAddress = "0.0.0.0:8888"
+		stagerConfig.ConsulCluster = "http://127.0.0.1:8500"
+	})
+
+	validationErrors := func() []string {
+		err := Validate(stagerConfig)
+		Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+		return err.(*ValidationError).Errors
+	}
+
+	It("accepts a valid config", func() {
+		Expect(Validate(stagerConfig)).To(Succeed())
+	})
+
+	It("reports every problem at once", func() {
+		stagerConfig.CCBaseUrl = ""
+		stagerConfig.CCPassword = ""
+		stagerConfig.FileServerUrl = "file-server.service.cf.internal"
+		stagerConfig.DockerStagingStack = ""
+
+		Expect(validationErrors()).To(Equal([]string{
+			"cc_base_url: cannot be blank",
+			"cc_basic_auth_password: cannot be blank",
+			"file_server_url: 'file-server.service.cf.internal' must be an http or https URL",
+			"docker_staging_stack: cannot be blank",
+		}))
+	})
+
+	It("rejects URLs without a host", func() {
+		stagerConfig.BBSAddress = "http://"
+		Expect(validationErrors()).To(ConsistOf("bbs_api_url: 'http://' has no host"))
+	})
+
+	It("rejects lifecycles that cannot be parsed", func() {
+		stagerConfig.Lifecycles = []string{"invalid form"}
+		Expect(validationErrors()).To(ConsistOf(HavePrefix("lifecycles: 'invalid form': ")))
+	})
+
+	It("requires at least one lifecycle", func() {
+		stagerConfig.Lifecycles = nil
+		Expect(validationErrors()).To(ConsistOf("lifecycles: cannot be empty unless lifecycle_bundles are configured"))
+	})
+
+	It("accepts lifecycle bundles in place of lifecycles", func() {
+		stagerConfig.Lifecycles = nil
+		stagerConfig.LifecycleBundles = []backend.LifecycleBundle{
+			{Lifecycle: "docker", URL: "docker_app_lifecycle.tgz", Checksum: "sha256:abc123"},
+		}
+		Expect(Validate(stagerConfig)).To(Succeed())
+	})
+
+	It("rejects invalid lifecycle bundles", func() {
+		stagerConfig.LifecycleBundles = []backend.LifecycleBundle{
+			{Lifecycle: "docker", URL: "docker_app_lifecycle.tgz", Checksum: "crc32:abc123"},
+		}
+		Expect(validationErrors()).To(ConsistOf(HavePrefix("lifecycle_bundles: ")))
+	})
+
+	It("rejects invalid listen addresses", func() {
+		stagerConfig.ListenAddress = "portless"
+		stagerConfig.PrometheusListenAddress = "127.0.0.1:onehundred"
+		Expect(validationErrors()).To(ConsistOf(
+			ContainSubstring("stager_listen_addr: "),
+			ContainSubstring("prometheus_listen_addr: "),
+		))
+	})
+
+	Context("when the BBS is reached over https", func() {
+		var certDir string
+
+		BeforeEach(func() {
+			var err error
+			certDir, err = ioutil.TempDir("", "stager-config")
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, name := range []string{"ca.crt", "client.crt"} {
+				Expect(ioutil.WriteFile(filepath.Join(certDir, name), []byte("cert"), 0600)).To(Succeed())
+			}
+
+			stagerConfig.BBSAddress = "https://bbs.service.cf.internal:8889"
+			stagerConfig.BBSCACert = filepath.Join(certDir, "ca.crt")
+			stagerConfig.BBSClientCert = filepath.Join(certDir, "client.crt")
+			stagerConfig.BBSClientKey = filepath.Join(certDir, "client.key")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certDir)
+		})
+
+		It("requires the cert files to exist", func() {
+			Expect(validationErrors()).To(ConsistOf(HavePrefix("bbs_client_key: ")))
+		})
+	})
+
+	Context("service registration", func() {
+		It("rejects unknown registration backends", func() {
+			stagerConfig.ServiceRegistration = "zookeeper"
+			Expect(validationErrors()).To(ConsistOf("service_registration: unknown service registration 'zookeeper'"))
+		})
+
+		It("requires a file when registering with a file", func() {
+			stagerConfig.ServiceRegistration = "file"
+			stagerConfig.ServiceRegistrationAddress = "10.0.16.4"
+			Expect(validationErrors()).To(ConsistOf("service_registration_file: cannot be blank"))
+		})
+
+		Context("when registering with a file", func() {
+			BeforeEach(func() {
+				stagerConfig.ServiceRegistration = "file"
+				stagerConfig.ServiceRegistrationFile = "/var/vcap/data/stager/registration.json"
+			})
+
+			It("requires a registration address when listening on all interfaces", func() {
+				Expect(validationErrors()).To(ConsistOf("service_registration_address: must be set when stager_listen_addr listens on all interfaces"))
+
+				stagerConfig.ListenAddress = "[::]:8888"
+				Expect(validationErrors()).To(ConsistOf("service_registration_address: must be set when stager_listen_addr listens on all interfaces"))
+			})
+
+			It("registers the listen address when it names a host", func() {
+				stagerConfig.ListenAddress = "10.0.16.4:8888"
+				Expect(Validate(stagerConfig)).To(Succeed())
+			})
+
+			It("accepts a registration address", func() {
+				stagerConfig.ServiceRegistrationAddress = "stager.service.cf.internal"
+				Expect(Validate(stagerConfig)).To(Succeed())
+			})
+
+			It("rejects an unspecified registration address", func() {
+				stagerConfig.ServiceRegistrationAddress = "0.0.0.0"
+				Expect(validationErrors()).To(ConsistOf("service_registration_address: '0.0.0.0' is not a reachable address"))
+			})
+		})
+
+		It("does not require consul when registration is disabled", func() {
+			stagerConfig.ServiceRegistration = "none"
+			stagerConfig.ConsulCluster = ""
+			Expect(Validate(stagerConfig)).To(Succeed())
+		})
+	})
+
+	It("rejects invalid log redaction patterns", func() {
+		stagerConfig.LogRedactionPatterns = []string{"("}
+		Expect(validationErrors()).To(ConsistOf(HavePrefix("log_redaction_patterns: ")))
+	})
+
+	It("rejects invalid staging priorities", func() {
+		stagerConfig.StagingPriorityRules = []backend.PriorityRule{{Class: "missing"}}
+		Expect(validationErrors()).To(ConsistOf(HavePrefix("staging_priority_classes: ")))
+	})
+
+	It("requires admin credentials to be set together", func() {
+		stagerConfig.AdminUsername = "admin"
+		Expect(validationErrors()).To(ConsistOf("admin_basic_auth_username: admin_basic_auth_username and admin_basic_auth_password must be set together"))
+	})
+
+	It("requires an audit log key when the audit log is enabled", func() {
+		stagerConfig.AuditLogPath = "/var/vcap/sys/log/stager/audit.log"
+		Expect(validationErrors()).To(ConsistOf("audit_log_hmac_key: must be set when audit_log_path is set"))
+
+		stagerConfig.AuditLogKey = "some-key"
+		Expect(Validate(stagerConfig)).To(Succeed())
+	})
+
+	It("rejects a negative staging failure history size", func() {
+		stagerConfig.StagingFailureHistorySize = -1
+		Expect(validationErrors()).To(ConsistOf("staging_failure_history_size: cannot be negative"))
+	})
+
+	It("rejects a tracing sample ratio outside of 0 and 1", func() {
+		stagerConfig.TracingSampleRatio = 1.5
+		Expect(validationErrors()).To(ConsistOf("tracing_sample_ratio: must be between 0 and 1"))
+
+		stagerConfig.TracingSampleRatio = 0.1
+		Expect(Validate(stagerConfig)).To(Succeed())
+	})
+
+	It("rejects invalid staging failure rules", func() {
+		stagerConfig.StagingFailureRules = []backend.FailureRule{{Pattern: "(", Id: "SomeError"}}
+		Expect(validationErrors()).To(ConsistOf(HavePrefix("staging_failure_rules: failure rule 0 has an invalid pattern")))
+	})
+})
@@ -0,0 +1,127 @@
+package diego_errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+)
+
+// Error is an entry in the catalog of errors the stager reports. Errors are
+// matched by their code rather than their message, so errors.Is(err,
+// MissingAppId) holds for any error wrapping MissingAppId, with or without
+// details. HTTPStatus is the status the stager responds with when it rejects
+// a staging request with the error, or 0 for errors that are only reported
+// to CC when a staging task completes. Field names the staging request field
+// that a validation error is about, if any.
+type Error struct {
+	Code            string
+	HTTPStatus      int
+	CCErrorId       string
+	UserMessage     string
+	OperatorMessage string
+	Field           string
+}
+
+func (e *Error) Error() string {
+	return e.OperatorMessage
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetail returns an error of the same kind as e with details of this
+// occurrence appended to its messages.
+func (e *Error) WithDetail(format string, args ...interface{}) error {
+	return &detailedError{catalogError: e, detail: fmt.Sprintf(format, args...)}
+}
+
+type detailedError struct {
+	catalogError *Error
+	detail       string
+}
+
+func (e *detailedError) Error() string {
+	return e.catalogError.OperatorMessage + ": " + e.detail
+}
+
+func (e *detailedError) Unwrap() error {
+	return e.catalogError
+}
+
+// Lookup returns the catalog entry that err is, or wraps.
+func Lookup(err error) (*Error, bool) {
+	var catalogError *Error
+	if errors.As(err, &catalogError) {
+		return catalogError, true
+	}
+	return nil, false
+}
+
+// StagingError returns the error reported to CC for err, which must be, or
+// wrap, a catalog entry.
+func StagingError(err error) *cc_messages.StagingError {
+	catalogError, ok := Lookup(err)
+	if !ok {
+		return nil
+	}
+
+	message := catalogError.UserMessage
+	var detailed *detailedError
+	if errors.As(err, &detailed) {
+		message += ": " + detailed.detail
+	}
+	return &cc_messages.StagingError{Id: catalogError.CCErrorId, Message: message}
+}
+
+func newError(code string, httpStatus int, ccErrorId, userMessage, operatorMessage string) *Error {
+	return &Error{
+		Code:            code,
+		HTTPStatus:      httpStatus,
+		CCErrorId:       ccErrorId,
+		UserMessage:     userMessage,
+		OperatorMessage: operatorMessage,
+	}
+}
+
+// newRequestError returns an error for a staging request that cannot be
+// staged as given, so is not worth retrying.
+func newRequestError(code string, httpStatus int, field, message string) *Error {
+	requestError := newError(code, httpStatus, cc_messages.STAGING_ERROR, message, message)
+	requestError.Field = field
+	return requestError
+}
+
+// Staging requests rejected by the stager.
+var (
+	InvalidStagingRequest        = newRequestError("invalid_staging_request", http.StatusBadRequest, "", INVALID_STAGING_REQUEST_MESSAGE)
+	InvalidLifecycleData         = newRequestError("invalid_lifecycle_data", http.StatusBadRequest, "lifecycle_data", INVALID_LIFECYCLE_DATA_MESSAGE)
+	UnknownLifecycle             = newRequestError("unknown_lifecycle", http.StatusNotFound, "lifecycle", UNKNOWN_LIFECYCLE_MESSAGE)
+	MissingAppId                 = newRequestError("missing_app_id", http.StatusUnprocessableEntity, "app_id", MISSING_APP_ID_MESSAGE)
+	MissingAppBitsDownloadUri    = newRequestError("missing_app_bits_download_uri", http.StatusUnprocessableEntity, "lifecycle_data.app_bits_download_uri", MISSING_APP_BITS_DOWNLOAD_URI_MESSAGE)
+	MissingLifecycleData         = newRequestError("missing_lifecycle_data", http.StatusUnprocessableEntity, "lifecycle_data", MISSING_LIFECYCLE_DATA_MESSAGE)
+	NoCompilerDefined            = newRequestError("no_compiler_defined", http.StatusUnprocessableEntity, "lifecycle_data.stack", NO_COMPILER_DEFINED_MESSAGE)
+	MissingDockerImageUrl        = newRequestError("missing_docker_image_url", http.StatusUnprocessableEntity, "lifecycle_data.docker_image", MISSING_DOCKER_IMAGE_URL)
+	MissingDockerRegistry        = newRequestError("missing_docker_registry", http.StatusUnprocessableEntity, "", MISSING_DOCKER_REGISTRY)
+	MissingDockerCredentials     = newRequestError("missing_docker_credentials", http.StatusUnprocessableEntity, "lifecycle_data.docker_password", MISSING_DOCKER_CREDENTIALS)
+	InvalidDockerRegistryAddress = newRequestError("invalid_docker_registry_address", http.StatusUnprocessableEntity, "", INVALID_DOCKER_REGISTRY_ADDRESS)
+	StagingLimitExceeded         = newError("staging_limit_exceeded", http.StatusTooManyRequests, STAGING_LIMIT_EXCEEDED_ID, STAGING_LIMIT_EXCEEDED_MESSAGE, STAGING_LIMIT_EXCEEDED_MESSAGE)
+	StagingInProgress            = newError("staging_in_progress", http.StatusConflict, STAGING_IN_PROGRESS_ID, STAGING_IN_PROGRESS_MESSAGE, STAGING_IN_PROGRESS_MESSAGE)
+	StagingQueueFull             = newError("staging_queue_full", http.StatusServiceUnavailable, STAGING_QUEUE_FULL_ID, STAGING_QUEUE_FULL_MESSAGE, STAGING_QUEUE_FULL_MESSAGE)
+)
+
+// Staging tasks that failed or were cancelled.
+var (
+	StagingInterrupted       = newError("staging_interrupted", 0, STAGING_INTERRUPTED_ID, STAGING_INTERRUPTED_MESSAGE, STAGING_INTERRUPTED_MESSAGE)
+	StagingSuperseded        = newError("staging_superseded", 0, STAGING_SUPERSEDED_ID, STAGING_SUPERSEDED_MESSAGE, STAGING_SUPERSEDED_MESSAGE)
+	InvalidStagingResult     = newError("invalid_staging_result", 0, INVALID_STAGING_RESULT_ID, INVALID_STAGING_RESULT_MESSAGE, INVALID_STAGING_RESULT_MESSAGE)
+	InsufficientResources    = newError("insufficient_resources", 0, cc_messages.INSUFFICIENT_RESOURCES, INSUFFICIENT_RESOURCES_MESSAGE, INSUFFICIENT_RESOURCES_MESSAGE)
+	NoCompatibleCell         = newError("no_compatible_cell", 0, cc_messages.NO_COMPATIBLE_CELL, CELL_MISMATCH_MESSAGE, CELL_MISMATCH_MESSAGE)
+	CellCommunicationError   = newError("cell_communication_error", 0, cc_messages.CELL_COMMUNICATION_ERROR, CELL_COMMUNICATION_ERROR, CELL_COMMUNICATION_ERROR)
+	StagingOutOfMemory       = newError("staging_out_of_memory", 0, STAGING_OUT_OF_MEMORY_ID, "staging ran out of memory: increase the memory available to staging", "staging task was killed for running out of memory")
+	StagingDiskQuotaExceeded = newError("staging_disk_quota_exceeded", 0, STAGING_DISK_QUOTA_EXCEEDED_ID, "staging exceeded its disk quota: increase the disk available to staging or reduce the size of the app", "staging task was killed for exceeding its disk quota")
+	StagingTimedOut          = newError("staging_timed_out", 0, STAGING_TIMED_OUT_ID, "staging timed out: increase the staging timeout or reduce the work done while staging", "staging task timed out")
+)
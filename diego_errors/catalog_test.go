@@ -0,0 +1,64 @@
+package diego_errors_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/diego_errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Catalog", func() {
+	Describe("matching", func() {
+		It("matches errors with details to their catalog entry", func() {
+			err := diego_errors.StagingLimitExceeded.WithDetail("%d staging tasks in flight", 3)
+			Expect(err.Error()).To(Equal("staging concurrency limit exceeded: 3 staging tasks in flight"))
+			Expect(errors.Is(err, diego_errors.StagingLimitExceeded)).To(BeTrue())
+			Expect(errors.Is(err, diego_errors.StagingInProgress)).To(BeFalse())
+		})
+
+		It("matches entries by code rather than message", func() {
+			reworded := &diego_errors.Error{Code: "missing_app_id", OperatorMessage: "the app guid was not given"}
+			Expect(errors.Is(reworded, diego_errors.MissingAppId)).To(BeTrue())
+		})
+
+		It("finds entries wrapped by other errors", func() {
+			err := fmt.Errorf("building recipe: %w", diego_errors.NoCompilerDefined)
+			catalogError, ok := diego_errors.Lookup(err)
+			Expect(ok).To(BeTrue())
+			Expect(catalogError).To(Equal(diego_errors.NoCompilerDefined))
+			Expect(catalogError.Code).To(Equal("no_compiler_defined"))
+			Expect(catalogError.HTTPStatus).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("does not find errors outside the catalog", func() {
+			_, ok := diego_errors.Lookup(errors.New(diego_errors.MISSING_APP_ID_MESSAGE))
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("StagingError", func() {
+		It("reports the entry's CC error id and user message", func() {
+			Expect(diego_errors.StagingError(diego_errors.StagingTimedOut)).To(Equal(&cc_messages.StagingError{
+				Id:      diego_errors.STAGING_TIMED_OUT_ID,
+				Message: diego_errors.StagingTimedOut.UserMessage,
+			}))
+		})
+
+		It("includes the details of the error", func() {
+			err := diego_errors.StagingInProgress.WithDetail("%s", "some-app")
+			Expect(diego_errors.StagingError(err)).To(Equal(&cc_messages.StagingError{
+				Id:      diego_errors.STAGING_IN_PROGRESS_ID,
+				Message: "staging already in progress for app: some-app",
+			}))
+		})
+
+		It("returns nil for errors outside the catalog", func() {
+			Expect(diego_errors.StagingError(errors.New("boom"))).To(BeNil())
+		})
+	})
+})
@@ -12,4 +12,26 @@ const (
 	MISSING_DOCKER_REGISTRY               = "missing docker registry"
 	MISSING_DOCKER_CREDENTIALS            = "missing docker credentials"
 	INVALID_DOCKER_REGISTRY_ADDRESS       = "invalid docker registry address"
+	STAGING_LIMIT_EXCEEDED_MESSAGE        = "staging concurrency limit exceeded"
+	STAGING_IN_PROGRESS_MESSAGE           = "staging already in progress for app"
+	STAGING_SUPERSEDED_MESSAGE            = "staging superseded by a newer staging request"
+	INVALID_STAGING_RESULT_MESSAGE        = "invalid staging result"
+	INVALID_STAGING_REQUEST_MESSAGE       = "invalid staging request"
+	INVALID_LIFECYCLE_DATA_MESSAGE        = "invalid lifecycle data"
+	UNKNOWN_LIFECYCLE_MESSAGE             = "unknown lifecycle"
+	STAGING_INTERRUPTED_MESSAGE           = "staging was interrupted by the stager shutting down, retry staging"
+	STAGING_QUEUE_FULL_MESSAGE            = "staging queue is full, retry staging"
+)
+
+// Error ids reported to CC for failures that CC has no id of its own for.
+const (
+	STAGING_LIMIT_EXCEEDED_ID      = "StagingLimitExceeded"
+	STAGING_IN_PROGRESS_ID         = "StagingInProgress"
+	STAGING_SUPERSEDED_ID          = "StagingSuperseded"
+	INVALID_STAGING_RESULT_ID      = "InvalidStagingResult"
+	STAGING_OUT_OF_MEMORY_ID       = "StagingOutOfMemory"
+	STAGING_DISK_QUOTA_EXCEEDED_ID = "StagingDiskQuotaExceeded"
+	STAGING_TIMED_OUT_ID           = "StagingTimedOut"
+	STAGING_INTERRUPTED_ID         = "StagingInterrupted"
+	STAGING_QUEUE_FULL_ID          = "StagingQueueFull"
 )
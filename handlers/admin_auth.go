@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// AdminCredentials are the basic auth credentials required by admin
+// endpoints that expose operator-only detail or reload the configuration.
+// The admin endpoints are served on the stager's listen address, which
+// serves plain HTTP, so the credentials are only protected in transit if
+// that address is reached over TLS, e.g. through a TLS-terminating proxy or
+// a network that encrypts traffic between hosts. Credentials should not be
+// configured otherwise.
+type AdminCredentials struct {
+	Username string
+	Password string
+}
+
+// Wrap requires requests to handler to carry the admin credentials. Without
+// configured credentials the endpoint is not served at all, responding with
+// 404, rather than being left open.
+func (c AdminCredentials) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if c.Username == "" || c.Password == "" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		username, password, ok := req.BasicAuth()
+		if !ok || !c.matches(username, password) {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="stager admin"`)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+func (c AdminCredentials) matches(username, password string) bool {
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username)) == 1
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password)) == 1
+	return usernameMatches && passwordMatches
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/audit"
+	"code.cloudfoundry.org/stager/backend"
+)
+
+// statusResponseWriter remembers the status code written to the response so
+// that it can be recorded in the audit log.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func newStatusResponseWriter(resp http.ResponseWriter) *statusResponseWriter {
+	return &statusResponseWriter{ResponseWriter: resp, statusCode: http.StatusOK}
+}
+
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func newAuditEvent(action string, req *http.Request, stagingGuid string) audit.Event {
+	return audit.Event{
+		Action:      action,
+		Actor:       audit.Actor(req),
+		RemoteAddr:  req.RemoteAddr,
+		StagingGuid: stagingGuid,
+	}
+}
+
+// recordAuditEvent completes the event with the outcome of the request and
+// records it. A failed request always has a failure outcome; otherwise any
+// outcome already set on the event is kept. Errors are sanitized the same way
+// as for CC.
+func recordAuditEvent(auditor audit.Recorder, event audit.Event, statusCode int, err error) {
+	event.StatusCode = statusCode
+	if statusCode >= http.StatusBadRequest || err != nil {
+		event.Outcome = audit.OutcomeFailure
+	} else if event.Outcome == "" {
+		event.Outcome = audit.OutcomeSuccess
+	}
+
+	if err != nil {
+		stagingError := backend.StagingErrorFor(err)
+		event.ErrorId = stagingError.Id
+		event.Error = stagingError.Message
+	}
+
+	auditor.Record(event)
+}
+
+// stagingImage returns the image a docker staging request stages from.
+func stagingImage(request cc_messages.StagingRequestFromCC) string {
+	if request.Lifecycle != backend.DockerLifecycleName || request.LifecycleData == nil {
+		return ""
+	}
+
+	var lifecycleData cc_messages.DockerStagingData
+	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
+	if err != nil {
+		return ""
+	}
+	return lifecycleData.DockerImageUrl
+}
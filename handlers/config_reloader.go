@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/stager_metrics"
+)
+
+const (
+	ConfigReloadsSucceededCounter = stager_metrics.Counter("ConfigReloadsSucceeded")
+	ConfigReloadsFailedCounter    = stager_metrics.Counter("ConfigReloadsFailed")
+)
+
+// ReloadFunc re-reads the stager configuration and applies it, leaving the
+// running configuration untouched if it returns an error.
+type ReloadFunc func(logger lager.Logger) error
+
+// ConfigReloader reloads the stager configuration when the process receives
+// SIGHUP or when an operator POSTs to the reload endpoint. Reloads never run
+// concurrently.
+type ConfigReloader struct {
+	logger lager.Logger
+	reload ReloadFunc
+	lock   sync.Mutex
+}
+
+func NewConfigReloader(logger lager.Logger, reload ReloadFunc) *ConfigReloader {
+	return &ConfigReloader{
+		logger: logger.Session("config-reloader"),
+		reload: reload,
+	}
+}
+
+func (r *ConfigReloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	logger := r.logger.Session("reload")
+	logger.Info("starting")
+
+	err := r.reload(logger)
+	if err != nil {
+		ConfigReloadsFailedCounter.Increment()
+		logger.Error("failed", err)
+		return err
+	}
+
+	ConfigReloadsSucceededCounter.Increment()
+	logger.Info("finished")
+	return nil
+}
+
+// ReloadConfig serves the admin reload endpoint, which is only routed behind
+// the admin credentials. It responds with 404 if reloading is not configured.
+func (r *ConfigReloader) ReloadConfig(resp http.ResponseWriter, req *http.Request) {
+	if r == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+
+	err := r.Reload()
+	if err != nil {
+		responseJson, _ := json.Marshal(map[string]string{"error": err.Error()})
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		resp.Write(responseJson)
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(`{"status":"reloaded"}`))
+}
+
+// Run reloads the configuration on every SIGHUP until signalled to stop.
+func (r *ConfigReloader) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	close(ready)
+
+	for {
+		select {
+		case <-hangups:
+			r.Reload()
+		case <-signals:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package handlers_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/handlers"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConfigReloader", func() {
+	var (
+		logger    *lagertest.TestLogger
+		reloadErr error
+		reloads   chan struct{}
+		reloader  *handlers.ConfigReloader
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		reloadErr = nil
+		reloads = make(chan struct{}, 10)
+		reloader = handlers.NewConfigReloader(logger, func(lager.Logger) error {
+			reloads <- struct{}{}
+			return reloadErr
+		})
+	})
+
+	Describe("ReloadConfig", func() {
+		var responseRecorder *httptest.ResponseRecorder
+
+		JustBeforeEach(func() {
+			responseRecorder = httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/v1/admin/reload", nil)
+			Expect(err).NotTo(HaveOccurred())
+			reloader.ReloadConfig(responseRecorder, req)
+		})
+
+		It("reloads the config", func() {
+			Expect(reloads).To(HaveLen(1))
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"status":"reloaded"}`))
+		})
+
+		Context("when the reload fails", func() {
+			BeforeEach(func() {
+				reloadErr = errors.New("invalid stager config: lifecycles: cannot be empty")
+			})
+
+			It("responds with the error", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusUnprocessableEntity))
+				Expect(responseRecorder.Body.String()).To(MatchJSON(`{"error":"invalid stager config: lifecycles: cannot be empty"}`))
+			})
+		})
+
+		Context("when reloading is not configured", func() {
+			BeforeEach(func() {
+				reloader = nil
+			})
+
+			It("responds with Not Found", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("Run", func() {
+		var process ifrit.Process
+
+		BeforeEach(func() {
+			process = ginkgomon.Invoke(reloader)
+		})
+
+		AfterEach(func() {
+			ginkgomon.Interrupt(process)
+		})
+
+		It("reloads the config on SIGHUP", func() {
+			Expect(syscall.Kill(syscall.Getpid(), syscall.SIGHUP)).To(Succeed())
+			Eventually(reloads).Should(Receive())
+		})
+	})
+})
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/stager_metrics"
+)
+
+const (
+	StagingRequestsRejectedWhileDrainingCounter = stager_metrics.Counter("StagingRequestsRejectedWhileDraining")
+
+	DefaultShutdownGracePeriod = 30 * time.Second
+)
+
+var ErrDraining = errors.New("stager is draining")
+
+// Drainer tracks in-flight staging work so that the stager can shut down
+// without losing it. Once signalled it stops admitting new staging requests,
+// and then waits up to the grace period for tracked work to finish before
+// exiting. If the grace period expires it calls flush, if set, so that queued
+// requests are reported to CC as failed rather than dropped. A nil Drainer
+// admits and tracks nothing.
+type Drainer struct {
+	logger      lager.Logger
+	clock       clock.Clock
+	gracePeriod time.Duration
+	flush       func() int
+
+	lock     sync.Mutex
+	draining bool
+	inFlight int
+	idle     chan struct{}
+}
+
+func NewDrainer(logger lager.Logger, clock clock.Clock, gracePeriod time.Duration, flush func() int) *Drainer {
+	return &Drainer{
+		logger:      logger.Session("drainer"),
+		clock:       clock,
+		gracePeriod: gracePeriod,
+		flush:       flush,
+	}
+}
+
+// Admit tracks a new unit of work unless the stager is draining, in which case
+// it returns false.
+func (d *Drainer) Admit() bool {
+	if d == nil {
+		return true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.inFlight++
+	return true
+}
+
+// Track tracks a unit of work that must be finished even while draining, such
+// as a staging request that has already been accepted.
+func (d *Drainer) Track() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.inFlight++
+}
+
+// Done marks a unit of work tracked by Admit or Track as finished.
+func (d *Drainer) Done() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.inFlight--
+	if d.inFlight == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// Draining returns ErrDraining once the drainer has been signalled, so that it
+// can be used as a readiness check.
+func (d *Drainer) Draining(logger lager.Logger) error {
+	if d == nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.draining {
+		return ErrDraining
+	}
+	return nil
+}
+
+// Wrap tracks every request to handler. If admit is true new requests are
+// rejected with 503 while draining, otherwise they are served until the grace
+// period ends.
+func (d *Drainer) Wrap(handler http.Handler, admit bool) http.Handler {
+	if d == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if admit {
+			if !d.Admit() {
+				StagingRequestsRejectedWhileDrainingCounter.Increment()
+				resp.Header().Set("Retry-After", StagingQueueRetryAfter)
+				resp.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			d.Track()
+		}
+		defer d.Done()
+
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+func (d *Drainer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := d.logger.Session("run", lager.Data{"grace-period": d.gracePeriod.String()})
+
+	close(ready)
+
+	<-signals
+
+	d.lock.Lock()
+	d.draining = true
+	inFlight := d.inFlight
+	idle := make(chan struct{})
+	if inFlight == 0 {
+		close(idle)
+	} else {
+		d.idle = idle
+	}
+	d.lock.Unlock()
+
+	timer := d.clock.NewTimer(d.gracePeriod)
+	defer timer.Stop()
+
+	logger.Info("draining", lager.Data{"in-flight": inFlight})
+
+	select {
+	case <-idle:
+		logger.Info("drained")
+	case <-timer.C():
+		flushed := 0
+		if d.flush != nil {
+			flushed = d.flush()
+		}
+
+		d.lock.Lock()
+		inFlight = d.inFlight
+		d.lock.Unlock()
+		logger.Info("grace-period-expired", lager.Data{"flushed": flushed, "abandoned": inFlight})
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/handlers"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Drainer", func() {
+	var (
+		logger    *lagertest.TestLogger
+		fakeClock *fakeclock.FakeClock
+		drainer   *handlers.Drainer
+		process   ifrit.Process
+		flushed   int
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		flushed = 0
+		drainer = handlers.NewDrainer(logger, fakeClock, time.Minute, func() int {
+			flushed++
+			return 2
+		})
+		process = ifrit.Invoke(drainer)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		fakeClock.Increment(time.Minute)
+		Eventually(process.Wait()).Should(Receive())
+	})
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/v1/staging/a-guid", nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	okHandler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusAccepted)
+	})
+
+	Context("before it is signalled", func() {
+		It("serves requests", func() {
+			Expect(serve(drainer.Wrap(okHandler, true)).Code).To(Equal(http.StatusAccepted))
+		})
+
+		It("is ready", func() {
+			Expect(drainer.Draining(logger)).To(Succeed())
+		})
+	})
+
+	Context("when it is signalled", func() {
+		Context("with nothing in flight", func() {
+			It("exits immediately", func() {
+				process.Signal(os.Interrupt)
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+			})
+		})
+
+		Context("with work in flight", func() {
+			BeforeEach(func() {
+				Expect(drainer.Admit()).To(BeTrue())
+				drainer.Track()
+				process.Signal(os.Interrupt)
+				Eventually(logger).Should(gbytes.Say("draining"))
+			})
+
+			It("is no longer ready", func() {
+				Expect(drainer.Draining(logger)).To(MatchError(handlers.ErrDraining))
+			})
+
+			It("rejects new staging requests with a Retry-After header", func() {
+				Expect(drainer.Admit()).To(BeFalse())
+
+				recorder := serve(drainer.Wrap(okHandler, true))
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(recorder.Header().Get("Retry-After")).To(Equal(handlers.StagingQueueRetryAfter))
+			})
+
+			It("continues to serve requests that must not be lost", func() {
+				Expect(serve(drainer.Wrap(okHandler, false)).Code).To(Equal(http.StatusAccepted))
+			})
+
+			It("exits once the work has finished", func() {
+				drainer.Done()
+				Consistently(process.Wait()).ShouldNot(Receive())
+
+				drainer.Done()
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+			})
+
+			It("does not flush the queue while waiting for the work", func() {
+				drainer.Done()
+				drainer.Done()
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+				Expect(flushed).To(Equal(0))
+			})
+
+			It("flushes the queue and exits when the grace period expires", func() {
+				fakeClock.WaitForWatcherAndIncrement(time.Minute)
+				Eventually(process.Wait()).Should(Receive(BeNil()))
+				Expect(flushed).To(Equal(1))
+				Expect(logger).To(gbytes.Say(`grace-period-expired.*"flushed":2`))
+			})
+		})
+	})
+
+	Context("when it is nil", func() {
+		It("admits everything", func() {
+			var nilDrainer *handlers.Drainer
+			Expect(nilDrainer.Admit()).To(BeTrue())
+			Expect(nilDrainer.Draining(logger)).To(Succeed())
+			Expect(serve(nilDrainer.Wrap(okHandler, true)).Code).To(Equal(http.StatusAccepted))
+		})
+	})
+})
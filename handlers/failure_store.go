@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+)
+
+// StagingFailure records why a staging task failed in the detail that CC is
+// not given: the raw failure reason from Diego and the exit code appended to
+// it by the executor. The cell the task ran on is not recorded, as the BBS
+// neither includes it in the completion callback nor keeps it once the task
+// has completed; the task guid finds the task in the cell logs.
+type StagingFailure struct {
+	StagingGuid   string    `json:"staging_guid"`
+	AppId         string    `json:"app_id,omitempty"`
+	Lifecycle     string    `json:"lifecycle"`
+	FailureReason string    `json:"failure_reason"`
+	ExitCode      *int      `json:"exit_code,omitempty"`
+	ErrorId       string    `json:"error_id,omitempty"`
+	ErrorMessage  string    `json:"error_message,omitempty"`
+	FailedAt      time.Time `json:"failed_at"`
+}
+
+func newStagingFailure(task *models.TaskCallbackResponse, annotation backend.StagingTaskAnnotation, response cc_messages.StagingResponseForCC, failedAt time.Time) StagingFailure {
+	failure := StagingFailure{
+		StagingGuid:   task.TaskGuid,
+		AppId:         annotation.AppId,
+		Lifecycle:     annotation.Lifecycle,
+		FailureReason: task.FailureReason,
+		FailedAt:      failedAt,
+	}
+
+	if exitCode, ok := backend.FailureExitCode(task.FailureReason); ok {
+		failure.ExitCode = &exitCode
+	}
+
+	if response.Error != nil {
+		failure.ErrorId = response.Error.Id
+		failure.ErrorMessage = response.Error.Message
+	}
+
+	return failure
+}
+
+func (f StagingFailure) logData() lager.Data {
+	data := lager.Data{
+		"staging-guid":   f.StagingGuid,
+		"app-id":         f.AppId,
+		"lifecycle":      f.Lifecycle,
+		"failure-reason": f.FailureReason,
+		"error-id":       f.ErrorId,
+	}
+	if f.ExitCode != nil {
+		data["exit-code"] = *f.ExitCode
+	}
+	return data
+}
+
+// FailureStore keeps the most recent staging failures in memory, keyed by
+// staging guid, so that operators can see why staging failed without digging
+// through BBS and cell logs. A nil FailureStore records nothing.
+type FailureStore struct {
+	size int
+
+	lock     sync.Mutex
+	failures map[string]StagingFailure
+	order    []string
+}
+
+func NewFailureStore(size int) *FailureStore {
+	return &FailureStore{
+		size:     size,
+		failures: map[string]StagingFailure{},
+	}
+}
+
+// Record stores a failure, evicting the oldest one if the store is full.
+func (s *FailureStore) Record(failure StagingFailure) {
+	if s == nil || s.size <= 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.failures[failure.StagingGuid]; !ok {
+		if len(s.order) == s.size {
+			delete(s.failures, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.order = append(s.order, failure.StagingGuid)
+	}
+	s.failures[failure.StagingGuid] = failure
+}
+
+func (s *FailureStore) Get(stagingGuid string) (StagingFailure, bool) {
+	if s == nil {
+		return StagingFailure{}, false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	failure, ok := s.failures[stagingGuid]
+	return failure, ok
+}
+
+// List returns the stored failures, most recent first.
+func (s *FailureStore) List() []StagingFailure {
+	failures := []StagingFailure{}
+	if s == nil {
+		return failures
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := len(s.order) - 1; i >= 0; i-- {
+		failures = append(failures, s.failures[s.order[i]])
+	}
+	return failures
+}
+
+// ListFailures serves the admin endpoint listing recent staging failures. It
+// responds with 404 if failures are not being recorded.
+func (s *FailureStore) ListFailures(resp http.ResponseWriter, req *http.Request) {
+	if s == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, map[string][]StagingFailure{"failures": s.List()})
+}
+
+// GetFailure serves the admin endpoint for the failure of a single staging
+// task.
+func (s *FailureStore) GetFailure(resp http.ResponseWriter, req *http.Request) {
+	failure, ok := s.Get(req.FormValue(":staging_guid"))
+	if !ok {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, failure)
+}
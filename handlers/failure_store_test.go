@@ -0,0 +1,185 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/stager/handlers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FailureStore", func() {
+	var (
+		store    *handlers.FailureStore
+		failedAt time.Time
+	)
+
+	BeforeEach(func() {
+		store = handlers.NewFailureStore(2)
+		failedAt = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("returns recorded failures by staging guid", func() {
+		store.Record(handlers.StagingFailure{StagingGuid: "guid-1", FailureReason: "Exited with status 1"})
+
+		failure, ok := store.Get("guid-1")
+		Expect(ok).To(BeTrue())
+		Expect(failure.FailureReason).To(Equal("Exited with status 1"))
+
+		_, ok = store.Get("guid-2")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("evicts the oldest failure once full", func() {
+		store.Record(handlers.StagingFailure{StagingGuid: "guid-1"})
+		store.Record(handlers.StagingFailure{StagingGuid: "guid-2"})
+		store.Record(handlers.StagingFailure{StagingGuid: "guid-3"})
+
+		_, ok := store.Get("guid-1")
+		Expect(ok).To(BeFalse())
+		Expect(store.List()).To(Equal([]handlers.StagingFailure{
+			{StagingGuid: "guid-3"},
+			{StagingGuid: "guid-2"},
+		}))
+	})
+
+	It("replaces a failure recorded again for the same staging guid", func() {
+		store.Record(handlers.StagingFailure{StagingGuid: "guid-1", FailureReason: "first"})
+		store.Record(handlers.StagingFailure{StagingGuid: "guid-1", FailureReason: "second"})
+
+		Expect(store.List()).To(Equal([]handlers.StagingFailure{
+			{StagingGuid: "guid-1", FailureReason: "second"},
+		}))
+	})
+
+	It("records nothing when nil", func() {
+		var nilStore *handlers.FailureStore
+		nilStore.Record(handlers.StagingFailure{StagingGuid: "guid-1"})
+		Expect(nilStore.List()).To(BeEmpty())
+	})
+
+	Describe("admin endpoints", func() {
+		var responseRecorder *httptest.ResponseRecorder
+
+		BeforeEach(func() {
+			responseRecorder = httptest.NewRecorder()
+			exitCode := 223
+			store.Record(handlers.StagingFailure{
+				StagingGuid:   "guid-1",
+				AppId:         "app-1",
+				Lifecycle:     "buildpack",
+				FailureReason: "Exited with status 223",
+				ExitCode:      &exitCode,
+				ErrorId:       "StagingError",
+				ErrorMessage:  "staging failed",
+				FailedAt:      failedAt,
+			})
+		})
+
+		It("lists the recorded failures", func() {
+			req, err := http.NewRequest("GET", "/v1/admin/staging_failures", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			store.ListFailures(responseRecorder, req)
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(responseRecorder.Body.String()).To(MatchJSON(`{"failures": [{
+				"staging_guid": "guid-1",
+				"app_id": "app-1",
+				"lifecycle": "buildpack",
+				"failure_reason": "Exited with status 223",
+				"exit_code": 223,
+				"error_id": "StagingError",
+				"error_message": "staging failed",
+				"failed_at": "2026-10-19T12:00:00Z"
+			}]}`))
+		})
+
+		It("returns the failure for a staging guid", func() {
+			req, err := http.NewRequest("GET", "/v1/admin/staging_failures/guid-1", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Form = url.Values{":staging_guid": {"guid-1"}}
+
+			store.GetFailure(responseRecorder, req)
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+			Expect(responseRecorder.Body.String()).To(ContainSubstring(`"failure_reason":"Exited with status 223"`))
+		})
+
+		It("responds with 404 for an unknown staging guid", func() {
+			req, err := http.NewRequest("GET", "/v1/admin/staging_failures/unknown", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Form = url.Values{":staging_guid": {"unknown"}}
+
+			store.GetFailure(responseRecorder, req)
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
+
+var _ = Describe("AdminCredentials", func() {
+	var (
+		credentials      handlers.AdminCredentials
+		responseRecorder *httptest.ResponseRecorder
+		req              *http.Request
+	)
+
+	BeforeEach(func() {
+		credentials = handlers.AdminCredentials{Username: "admin", Password: "secret"}
+		responseRecorder = httptest.NewRecorder()
+
+		var err error
+		req, err = http.NewRequest("GET", "/v1/admin/staging_failures", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		credentials.Wrap(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.WriteHeader(http.StatusTeapot)
+		})).ServeHTTP(responseRecorder, req)
+	})
+
+	Context("with the admin credentials", func() {
+		BeforeEach(func() {
+			req.SetBasicAuth("admin", "secret")
+		})
+
+		It("serves the request", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusTeapot))
+		})
+	})
+
+	Context("with the wrong credentials", func() {
+		BeforeEach(func() {
+			req.SetBasicAuth("admin", "wrong")
+		})
+
+		It("responds with 401", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(responseRecorder.Header().Get("WWW-Authenticate")).To(HavePrefix("Basic"))
+		})
+	})
+
+	Context("without credentials", func() {
+		It("responds with 401", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("when no admin credentials are configured", func() {
+		BeforeEach(func() {
+			credentials = handlers.AdminCredentials{}
+			req.SetBasicAuth("", "")
+		})
+
+		It("does not serve the endpoint", func() {
+			Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -7,20 +7,28 @@ import (
 	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/stager"
+	"code.cloudfoundry.org/stager/audit"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/tracing"
 	"github.com/tedsuo/rata"
 )
 
-func New(logger lager.Logger, ccClient cc_client.CcClient, bbsClient bbs.Client, backends map[string]backend.Backend, clock clock.Clock) http.Handler {
+func New(logger lager.Logger, ccClient cc_client.CcClient, bbsClient bbs.Client, backends map[string]backend.Backend, clock clock.Clock, tracer *tracing.Tracer, auditor audit.Recorder, retryPolicy DesireTaskRetryPolicy, queue *StagingQueue, limiter *StagingLimiter, coalescer *StagingCoalescer, drainer *Drainer, reloader *ConfigReloader, failures *FailureStore, admin AdminCredentials, readinessChecks map[string]DependencyCheck) http.Handler {
 
-	stagingHandler := NewStagingHandler(logger, backends, bbsClient)
-	stagingCompletedHandler := NewStagingCompletionHandler(logger, ccClient, backends, clock)
+	stagingHandler := NewStagingHandler(logger, backends, bbsClient, ccClient, clock, tracer, auditor, retryPolicy, queue, limiter, coalescer, drainer)
+	stagingCompletedHandler := NewStagingCompletionHandler(logger, ccClient, backends, clock, tracer, auditor, failures, coalescer)
+	healthHandler := NewHealthHandler(logger, readinessChecks)
 
 	actions := rata.Handlers{
-		stager.StageRoute:            http.HandlerFunc(stagingHandler.Stage),
-		stager.StopStagingRoute:      http.HandlerFunc(stagingHandler.StopStaging),
-		stager.StagingCompletedRoute: http.HandlerFunc(stagingCompletedHandler.StagingComplete),
+		stager.StageRoute:            drainer.Wrap(http.HandlerFunc(stagingHandler.Stage), true),
+		stager.StopStagingRoute:      drainer.Wrap(http.HandlerFunc(stagingHandler.StopStaging), false),
+		stager.StagingCompletedRoute: drainer.Wrap(http.HandlerFunc(stagingCompletedHandler.StagingComplete), false),
+		stager.HealthzRoute:          http.HandlerFunc(healthHandler.Healthz),
+		stager.ReadyzRoute:           http.HandlerFunc(healthHandler.Readyz),
+		stager.ReloadConfigRoute:     admin.Wrap(http.HandlerFunc(reloader.ReloadConfig)),
+		stager.StagingFailuresRoute:  admin.Wrap(http.HandlerFunc(failures.ListFailures)),
+		stager.StagingFailureRoute:   admin.Wrap(http.HandlerFunc(failures.GetFailure)),
 	}
 
 	handler, err := rata.NewRouter(stager.Routes, actions)
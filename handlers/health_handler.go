@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/backend"
+)
+
+const (
+	HealthStatusOK          = "ok"
+	HealthStatusUnavailable = "unavailable"
+
+	lifecycleBundleCheckTimeout = 5 * time.Second
+	lifecycleBundleCheckTTL     = 30 * time.Second
+)
+
+// DependencyCheck returns an error if a dependency of the stager is not
+// ready to serve staging requests.
+type DependencyCheck func(logger lager.Logger) error
+
+type HealthHandler interface {
+	Healthz(resp http.ResponseWriter, req *http.Request)
+	Readyz(resp http.ResponseWriter, req *http.Request)
+}
+
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+type healthHandler struct {
+	logger lager.Logger
+	checks map[string]DependencyCheck
+}
+
+// NewHealthHandler serves /healthz, which succeeds whenever the stager is
+// running, and /readyz, which runs every dependency check and succeeds only
+// if all of them pass.
+func NewHealthHandler(logger lager.Logger, checks map[string]DependencyCheck) HealthHandler {
+	return &healthHandler{
+		logger: logger.Session("health-handler"),
+		checks: checks,
+	}
+}
+
+func (handler *healthHandler) Healthz(resp http.ResponseWriter, req *http.Request) {
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(`{"status":"ok"}`))
+}
+
+func (handler *healthHandler) Readyz(resp http.ResponseWriter, req *http.Request) {
+	logger := handler.logger.Session("readyz")
+
+	response := ReadinessResponse{
+		Status:       HealthStatusOK,
+		Dependencies: map[string]DependencyStatus{},
+	}
+
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, check := range handler.checks {
+		wg.Add(1)
+		go func(name string, check DependencyCheck) {
+			defer wg.Done()
+
+			status := DependencyStatus{Status: HealthStatusOK}
+			err := check(logger.Session(name))
+			if err != nil {
+				logger.Info("dependency-unavailable", lager.Data{"dependency": name, "error": err.Error()})
+				status = DependencyStatus{Status: HealthStatusUnavailable, Error: err.Error()}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			response.Dependencies[name] = status
+			if err != nil {
+				response.Status = HealthStatusUnavailable
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	statusCode := http.StatusOK
+	if response.Status != HealthStatusOK {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	responseJson, _ := json.Marshal(response)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(statusCode)
+	resp.Write(responseJson)
+}
+
+// BBSCheck verifies that the BBS responds to a ping.
+func BBSCheck(bbsClient bbs.Client) DependencyCheck {
+	return func(logger lager.Logger) error {
+		if !bbsClient.Ping(logger) {
+			return errors.New("bbs did not respond to ping")
+		}
+		return nil
+	}
+}
+
+// CCConfigCheck verifies that the CC client has a usable base URL and
+// credentials.
+func CCConfigCheck(baseURL, username, password string) DependencyCheck {
+	return func(logger lager.Logger) error {
+		parsed, err := url.Parse(baseURL)
+		if err != nil {
+			return fmt.Errorf("invalid cc base url: %s", err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+			return fmt.Errorf("invalid cc base url '%s'", baseURL)
+		}
+		if username == "" || password == "" {
+			return errors.New("missing cc basic auth credentials")
+		}
+		return nil
+	}
+}
+
+// LifecycleBundlesCheck verifies that every lifecycle bundle returned by
+// lifecycles can be downloaded, from the file server for relative paths. The
+// bundles are checked concurrently and the outcome is cached for
+// lifecycleBundleCheckTTL, or until the bundles change, so that /readyz does
+// not request them on every hit. The errors it returns only name the
+// lifecycle; the reason is logged.
+func LifecycleBundlesCheck(clock clock.Clock, fileServerURL string, lifecycles func() map[string]string) DependencyCheck {
+	checker := &lifecycleBundlesChecker{
+		clock:         clock,
+		fileServerURL: fileServerURL,
+		httpClient:    &http.Client{Timeout: lifecycleBundleCheckTimeout},
+	}
+
+	return func(logger lager.Logger) error {
+		return checker.check(logger, lifecycles())
+	}
+}
+
+type lifecycleBundlesChecker struct {
+	clock         clock.Clock
+	fileServerURL string
+	httpClient    *http.Client
+
+	// lock is held while checking, so concurrent hits wait for one check
+	lock       sync.Mutex
+	checked    map[string]string
+	checkedAt  time.Time
+	checkedErr error
+}
+
+func (c *lifecycleBundlesChecker) check(logger lager.Logger, lifecycles map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.clock.Now()
+	if c.checked != nil && now.Sub(c.checkedAt) < lifecycleBundleCheckTTL && reflect.DeepEqual(c.checked, lifecycles) {
+		return c.checkedErr
+	}
+
+	errs := make(chan error, len(lifecycles))
+	for lifecycle, path := range lifecycles {
+		go func(lifecycle, path string) {
+			errs <- c.checkBundle(logger, lifecycle, path)
+		}(lifecycle, path)
+	}
+
+	var err error
+	for range lifecycles {
+		if bundleErr := <-errs; bundleErr != nil && err == nil {
+			err = bundleErr
+		}
+	}
+
+	c.checked = lifecycles
+	c.checkedAt = now
+	c.checkedErr = err
+	return err
+}
+
+func (c *lifecycleBundlesChecker) checkBundle(logger lager.Logger, lifecycle, path string) error {
+	unavailable := fmt.Errorf("lifecycle '%s' bundle is unavailable", lifecycle)
+
+	bundleURL, err := backend.LifecycleBundleURL(c.fileServerURL, path)
+	if err != nil {
+		logger.Error("invalid-lifecycle-bundle-url", err, lager.Data{"lifecycle": lifecycle})
+		return unavailable
+	}
+
+	response, err := c.httpClient.Head(bundleURL.String())
+	if err != nil {
+		logger.Error("lifecycle-bundle-request-failed", err, lager.Data{"lifecycle": lifecycle})
+		return unavailable
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		logger.Info("lifecycle-bundle-unavailable", lager.Data{"lifecycle": lifecycle, "status": response.StatusCode})
+		return unavailable
+	}
+	return nil
+}
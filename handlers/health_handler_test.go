@@ -0,0 +1,235 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/handlers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("HealthHandler", func() {
+	var (
+		logger           *lagertest.TestLogger
+		checks           map[string]handlers.DependencyCheck
+		responseRecorder *httptest.ResponseRecorder
+		handler          handlers.HealthHandler
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		checks = map[string]handlers.DependencyCheck{}
+		responseRecorder = httptest.NewRecorder()
+	})
+
+	JustBeforeEach(func() {
+		handler = handlers.NewHealthHandler(logger, checks)
+	})
+
+	Describe("Healthz", func() {
+		It("succeeds without running any dependency checks", func() {
+			checks["bbs"] = func(lager.Logger) error {
+				Fail("dependency check should not run")
+				return nil
+			}
+
+			req, err := http.NewRequest("GET", "/healthz", nil)
+			Expect(err).NotTo(HaveOccurred())
+			handler.Healthz(responseRecorder, req)
+
+			Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Readyz", func() {
+		var readiness handlers.ReadinessResponse
+
+		JustBeforeEach(func() {
+			req, err := http.NewRequest("GET", "/readyz", nil)
+			Expect(err).NotTo(HaveOccurred())
+			handler.Readyz(responseRecorder, req)
+
+			Expect(json.Unmarshal(responseRecorder.Body.Bytes(), &readiness)).To(Succeed())
+		})
+
+		Context("when every dependency is ready", func() {
+			BeforeEach(func() {
+				checks["bbs"] = func(lager.Logger) error { return nil }
+				checks["cc"] = func(lager.Logger) error { return nil }
+			})
+
+			It("reports each dependency as ok", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+				Expect(readiness.Status).To(Equal(handlers.HealthStatusOK))
+				Expect(readiness.Dependencies).To(Equal(map[string]handlers.DependencyStatus{
+					"bbs": {Status: handlers.HealthStatusOK},
+					"cc":  {Status: handlers.HealthStatusOK},
+				}))
+			})
+		})
+
+		Context("when a dependency is not ready", func() {
+			BeforeEach(func() {
+				checks["bbs"] = func(lager.Logger) error { return errors.New("boom") }
+				checks["cc"] = func(lager.Logger) error { return nil }
+			})
+
+			It("responds with 503 and the failing dependency", func() {
+				Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(readiness.Status).To(Equal(handlers.HealthStatusUnavailable))
+				Expect(readiness.Dependencies).To(Equal(map[string]handlers.DependencyStatus{
+					"bbs": {Status: handlers.HealthStatusUnavailable, Error: "boom"},
+					"cc":  {Status: handlers.HealthStatusOK},
+				}))
+			})
+		})
+	})
+
+	Describe("BBSCheck", func() {
+		var fakeBBSClient *fake_bbs.FakeClient
+
+		BeforeEach(func() {
+			fakeBBSClient = &fake_bbs.FakeClient{}
+		})
+
+		It("succeeds when the BBS responds to a ping", func() {
+			fakeBBSClient.PingReturns(true)
+			Expect(handlers.BBSCheck(fakeBBSClient)(logger)).To(Succeed())
+		})
+
+		It("fails when the BBS does not respond to a ping", func() {
+			fakeBBSClient.PingReturns(false)
+			Expect(handlers.BBSCheck(fakeBBSClient)(logger)).To(HaveOccurred())
+		})
+	})
+
+	Describe("CCConfigCheck", func() {
+		It("succeeds with a valid URL and credentials", func() {
+			Expect(handlers.CCConfigCheck("https://cc.example.com", "user", "pass")(logger)).To(Succeed())
+		})
+
+		It("fails without a host", func() {
+			Expect(handlers.CCConfigCheck("cc.example.com", "user", "pass")(logger)).To(HaveOccurred())
+		})
+
+		It("fails without credentials", func() {
+			Expect(handlers.CCConfigCheck("https://cc.example.com", "", "pass")(logger)).To(HaveOccurred())
+		})
+	})
+
+	Describe("LifecycleBundlesCheck", func() {
+		var (
+			fileServer *ghttp.Server
+			fakeClock  *fakeclock.FakeClock
+			lifecycles map[string]string
+			check      handlers.DependencyCheck
+		)
+
+		BeforeEach(func() {
+			fileServer = ghttp.NewServer()
+			fakeClock = fakeclock.NewFakeClock(time.Now())
+			lifecycles = map[string]string{}
+		})
+
+		JustBeforeEach(func() {
+			check = handlers.LifecycleBundlesCheck(fakeClock, fileServer.URL(), func() map[string]string {
+				return lifecycles
+			})
+		})
+
+		AfterEach(func() {
+			fileServer.Close()
+		})
+
+		It("succeeds when the bundles are served by the file server", func() {
+			fileServer.RouteToHandler("HEAD", "/v1/static/buildpack/cflinuxfs3.tgz", ghttp.RespondWith(http.StatusOK, nil))
+			lifecycles["buildpack/cflinuxfs3"] = "buildpack/cflinuxfs3.tgz"
+
+			Expect(check(logger)).To(Succeed())
+		})
+
+		It("requests absolute bundle URLs directly", func() {
+			fileServer.RouteToHandler("HEAD", "/docker.tgz", ghttp.RespondWith(http.StatusOK, nil))
+
+			check := handlers.LifecycleBundlesCheck(fakeClock, "http://file-server.invalid", func() map[string]string {
+				return map[string]string{"docker": fileServer.URL() + "/docker.tgz"}
+			})
+			Expect(check(logger)).To(Succeed())
+		})
+
+		It("checks the bundles concurrently", func() {
+			release := make(chan struct{})
+			blocked := func(http.ResponseWriter, *http.Request) { <-release }
+			fileServer.RouteToHandler("HEAD", "/v1/static/buildpack.tgz", blocked)
+			fileServer.RouteToHandler("HEAD", "/v1/static/docker.tgz", blocked)
+			lifecycles["buildpack"] = "buildpack.tgz"
+			lifecycles["docker"] = "docker.tgz"
+
+			checked := make(chan error, 1)
+			go func() { checked <- check(logger) }()
+
+			Eventually(func() int { return len(fileServer.ReceivedRequests()) }).Should(Equal(2))
+			close(release)
+			Eventually(checked).Should(Receive(BeNil()))
+		})
+
+		Context("when a bundle is missing", func() {
+			BeforeEach(func() {
+				fileServer.RouteToHandler("HEAD", "/v1/static/docker.tgz", ghttp.RespondWith(http.StatusNotFound, nil))
+				lifecycles["docker"] = "docker.tgz"
+			})
+
+			It("fails naming only the lifecycle", func() {
+				err := check(logger)
+				Expect(err).To(MatchError("lifecycle 'docker' bundle is unavailable"))
+				Expect(logger).To(gbytes.Say("lifecycle-bundle-unavailable"))
+			})
+		})
+
+		It("fails for an unknown scheme without returning the reason", func() {
+			lifecycles["docker"] = "ftp://example.com/docker.tgz"
+
+			Expect(check(logger)).To(MatchError("lifecycle 'docker' bundle is unavailable"))
+			Expect(logger).To(gbytes.Say("unknown scheme"))
+		})
+
+		Context("when the bundles have been checked", func() {
+			BeforeEach(func() {
+				fileServer.RouteToHandler("HEAD", "/v1/static/docker.tgz", ghttp.RespondWith(http.StatusOK, nil))
+				lifecycles["docker"] = "docker.tgz"
+			})
+
+			JustBeforeEach(func() {
+				Expect(check(logger)).To(Succeed())
+				Expect(fileServer.ReceivedRequests()).To(HaveLen(1))
+			})
+
+			It("reuses the outcome until it expires", func() {
+				Expect(check(logger)).To(Succeed())
+				Expect(fileServer.ReceivedRequests()).To(HaveLen(1))
+
+				fakeClock.Increment(time.Minute)
+				Expect(check(logger)).To(Succeed())
+				Expect(fileServer.ReceivedRequests()).To(HaveLen(2))
+			})
+
+			It("checks again when the bundles change", func() {
+				fileServer.RouteToHandler("HEAD", "/v1/static/buildpack.tgz", ghttp.RespondWith(http.StatusNotFound, nil))
+				lifecycles = map[string]string{"docker": "docker.tgz", "buildpack": "buildpack.tgz"}
+
+				Expect(check(logger)).To(MatchError("lifecycle 'buildpack' bundle is unavailable"))
+				Expect(fileServer.ReceivedRequests()).To(HaveLen(3))
+			})
+		})
+	})
+})
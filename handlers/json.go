@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func writeJSON(resp http.ResponseWriter, statusCode int, body interface{}) {
+	responseJson, _ := json.Marshal(body)
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(statusCode)
+	resp.Write(responseJson)
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import "code.cloudfoundry.org/stager/stager_metrics"
+
+// The Prometheus collectors for the handlers' metrics are registered when the
+// package is loaded, so that /metrics exports them from startup rather than
+// from their first increment.
+func init() {
+	stager_metrics.RegisterCounters(
+		StagingStartRequestsReceivedCounter,
+		StagingStopRequestsReceivedCounter,
+		StagingDesireTaskRetriedCounter,
+		StagingDesireTaskFailedCounter,
+		ConfigReloadsSucceededCounter,
+		ConfigReloadsFailedCounter,
+		StagingTasksSupersededCounter,
+		StagingRequestsCoalescedCounter,
+		StagingRequestsRejectedWhileDrainingCounter,
+		stagingSuccessCounter,
+		stagingFailureCounter,
+		StagingRequestsQueuedCounter,
+		StagingRequestsRejectedCounter,
+		StagingRequestsThrottledCounter,
+	)
+	stager_metrics.RegisterDurations(
+		stagingSuccessDuration,
+		stagingFailureDuration,
+	)
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/diego_errors"
+	"code.cloudfoundry.org/stager/stager_metrics"
+	"code.cloudfoundry.org/stager/tracing"
+)
+
+const (
+	StagingTasksSupersededCounter   = stager_metrics.Counter("StagingTasksSuperseded")
+	StagingRequestsCoalescedCounter = stager_metrics.Counter("StagingRequestsCoalesced")
+
+	// CoalescePolicyCancelOlder cancels in-flight staging tasks for the same
+	// app and lifecycle in favour of the new request.
+	CoalescePolicyCancelOlder = "cancel-older"
+	// CoalescePolicyRejectNewer rejects the new request while a staging task
+	// for the same app and lifecycle is in flight.
+	CoalescePolicyRejectNewer = "reject-newer"
+)
+
+var ErrStagingInProgress = diego_errors.StagingInProgress
+var ErrUnknownCoalescePolicy = errors.New("unknown staging coalesce policy")
+
+// maxSupersededTasks bounds the superseded tasks remembered while waiting for
+// their completion callbacks.
+const maxSupersededTasks = 1000
+
+// StagingCoalescer detects staging requests for apps that already have a
+// staging task in flight and resolves the duplicate according to its policy.
+// In-flight tasks are taken from the limiter if there is one, which includes
+// the tasks it has admitted since its cached listing, and listed from the BBS
+// otherwise.
+type StagingCoalescer struct {
+	logger    lager.Logger
+	bbsClient bbs.Client
+	ccClient  cc_client.CcClient
+	limiter   *StagingLimiter
+	domain    string
+	policy    string
+
+	lock            sync.Mutex
+	superseded      map[string]struct{}
+	supersededOrder []string
+}
+
+// DuplicateStagingTask is an in-flight staging task for the same app and
+// lifecycle as a new staging request.
+type DuplicateStagingTask struct {
+	TaskGuid   string
+	Annotation backend.StagingTaskAnnotation
+}
+
+func NewStagingCoalescer(logger lager.Logger, bbsClient bbs.Client, ccClient cc_client.CcClient, limiter *StagingLimiter, domain, policy string) (*StagingCoalescer, error) {
+	switch policy {
+	case CoalescePolicyCancelOlder, CoalescePolicyRejectNewer:
+	default:
+		return nil, fmt.Errorf("%s: '%s'", ErrUnknownCoalescePolicy, policy)
+	}
+
+	return &StagingCoalescer{
+		logger:     logger.Session("staging-coalescer"),
+		bbsClient:  bbsClient,
+		ccClient:   ccClient,
+		limiter:    limiter,
+		domain:     domain,
+		policy:     policy,
+		superseded: map[string]struct{}{},
+	}, nil
+}
+
+// Coalesce finds the in-flight staging tasks for the same app and lifecycle
+// as the request. With the reject-newer policy it returns an error wrapping
+// ErrStagingInProgress if there are any; with the cancel-older policy it
+// returns them, to be superseded once the new request has been accepted.
+// Failing to list the in-flight tasks does not block the request.
+func (c *StagingCoalescer) Coalesce(stagingGuid string, request cc_messages.StagingRequestFromCC) ([]DuplicateStagingTask, error) {
+	logger := c.logger.Session("coalesce", lager.Data{"staging-guid": stagingGuid, "app-id": request.AppId})
+
+	inFlight, err := c.inFlightTasks(logger)
+	if err != nil {
+		logger.Error("failed-to-list-staging-tasks", err)
+		return nil, nil
+	}
+
+	duplicates := []DuplicateStagingTask{}
+	for taskGuid, annotation := range inFlight {
+		if taskGuid == stagingGuid || !duplicatesRequest(annotation, request) {
+			continue
+		}
+
+		StagingRequestsCoalescedCounter.Increment()
+
+		if c.policy == CoalescePolicyRejectNewer {
+			logger.Info("rejecting-duplicate-staging-request", lager.Data{"in-flight-task-guid": taskGuid})
+			return nil, ErrStagingInProgress.WithDetail("%s", request.AppId)
+		}
+
+		duplicates = append(duplicates, DuplicateStagingTask{TaskGuid: taskGuid, Annotation: annotation})
+	}
+
+	return duplicates, nil
+}
+
+// Supersede reports the duplicate tasks to CC as superseded and cancels them.
+// It must only be called once the task of the request that supersedes them
+// has been desired, so that a rejected, flushed or failed request does not
+// lose both stagings.
+func (c *StagingCoalescer) Supersede(duplicates []DuplicateStagingTask) {
+	if c == nil {
+		return
+	}
+
+	for _, duplicate := range duplicates {
+		c.supersede(c.logger, duplicate.TaskGuid, duplicate.Annotation)
+	}
+}
+
+// WasSuperseded returns true, once, for a task this coalescer superseded, so
+// that the completion callback of the cancelled task is not reported to CC a
+// second time. Tasks superseded by other stager instances are not known.
+func (c *StagingCoalescer) WasSuperseded(taskGuid string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.superseded[taskGuid]; !ok {
+		return false
+	}
+	delete(c.superseded, taskGuid)
+	return true
+}
+
+func (c *StagingCoalescer) markSuperseded(taskGuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// forget the oldest marks first, including those already consumed
+	for len(c.supersededOrder) >= maxSupersededTasks {
+		delete(c.superseded, c.supersededOrder[0])
+		c.supersededOrder = c.supersededOrder[1:]
+	}
+	c.superseded[taskGuid] = struct{}{}
+	c.supersededOrder = append(c.supersededOrder, taskGuid)
+}
+
+func (c *StagingCoalescer) supersede(logger lager.Logger, taskGuid string, annotation backend.StagingTaskAnnotation) {
+	logger = logger.Session("supersede", lager.Data{"superseded-task-guid": taskGuid})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	StagingTasksSupersededCounter.Increment()
+	c.markSuperseded(taskGuid)
+
+	response := reportStagingFailure(logger, c.ccClient, tracing.ParseTraceparent(annotation.Traceparent), taskGuid, annotation.CompletionCallback, diego_errors.StagingSuperseded)
+	stager_metrics.IncrementStagingFailure(annotation.Lifecycle, response.Error.Id, stager_metrics.StagingFailureSourceTask)
+
+	err := c.bbsClient.CancelTask(logger, taskGuid)
+	if err != nil && !models.ErrResourceNotFound.Equal(err) {
+		logger.Error("cancel-task-failed", err)
+	}
+}
+
+func (c *StagingCoalescer) inFlightTasks(logger lager.Logger) (map[string]backend.StagingTaskAnnotation, error) {
+	if c.limiter != nil {
+		return c.limiter.InFlightTasks(logger), nil
+	}
+
+	tasks, err := c.bbsClient.TasksByDomain(logger, c.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	inFlight := map[string]backend.StagingTaskAnnotation{}
+	for _, task := range tasks {
+		if task.State != models.Task_Pending && task.State != models.Task_Running {
+			continue
+		}
+		inFlight[task.TaskGuid] = inFlightTaskFromTask(task).annotation
+	}
+	return inFlight, nil
+}
+
+func duplicatesRequest(annotation backend.StagingTaskAnnotation, request cc_messages.StagingRequestFromCC) bool {
+	return annotation.AppId != "" &&
+		annotation.AppId == request.AppId &&
+		annotation.Lifecycle == request.Lifecycle
+}
@@ -0,0 +1,220 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/cc_client/fakes"
+	"code.cloudfoundry.org/stager/diego_errors"
+	"code.cloudfoundry.org/stager/handlers"
+	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StagingCoalescer", func() {
+	var (
+		fakeMetricSender *fake_metric_sender.FakeMetricSender
+		fakeBBSClient    *fake_bbs.FakeClient
+		fakeCCClient     *fakes.FakeCcClient
+		policy           string
+		coalescer        *handlers.StagingCoalescer
+		request          cc_messages.StagingRequestFromCC
+		duplicates       []handlers.DuplicateStagingTask
+		coalesceErr      error
+	)
+
+	stagingTask := func(guid, appId, lifecycle string, state models.Task_State) *models.Task {
+		return &models.Task{
+			TaskGuid: guid,
+			State:    state,
+			TaskDefinition: &models.TaskDefinition{
+				Annotation: `{"lifecycle":"` + lifecycle + `","completion_callback":"http://cc/` + guid + `","app_id":"` + appId + `"}`,
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		fakeMetricSender = fake_metric_sender.NewFakeMetricSender()
+		metrics.Initialize(fakeMetricSender, nil)
+
+		fakeBBSClient = &fake_bbs.FakeClient{}
+		fakeCCClient = &fakes.FakeCcClient{}
+		policy = handlers.CoalescePolicyRejectNewer
+
+		request = cc_messages.StagingRequestFromCC{
+			AppId:     "app-1",
+			Lifecycle: "buildpack",
+		}
+
+		fakeBBSClient.TasksByDomainReturns([]*models.Task{
+			stagingTask("older-guid", "app-1", "buildpack", models.Task_Running),
+			stagingTask("completed-guid", "app-1", "buildpack", models.Task_Completed),
+			stagingTask("docker-guid", "app-1", "docker", models.Task_Running),
+			stagingTask("other-app-guid", "app-2", "buildpack", models.Task_Pending),
+			stagingTask("new-guid", "app-1", "buildpack", models.Task_Pending),
+		}, nil)
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		coalescer, err = handlers.NewStagingCoalescer(lagertest.NewTestLogger("test"), fakeBBSClient, fakeCCClient, nil, "staging-domain", policy)
+		Expect(err).NotTo(HaveOccurred())
+
+		duplicates, coalesceErr = coalescer.Coalesce("new-guid", request)
+	})
+
+	It("rejects unknown policies", func() {
+		_, err := handlers.NewStagingCoalescer(lagertest.NewTestLogger("test"), fakeBBSClient, fakeCCClient, nil, "staging-domain", "bogus")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("with the reject-newer policy", func() {
+		BeforeEach(func() {
+			policy = handlers.CoalescePolicyRejectNewer
+		})
+
+		It("lists the tasks in the staging domain", func() {
+			Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+			_, domain := fakeBBSClient.TasksByDomainArgsForCall(0)
+			Expect(domain).To(Equal("staging-domain"))
+		})
+
+		It("rejects the request", func() {
+			Expect(coalesceErr).To(HaveOccurred())
+			Expect(coalesceErr.Error()).To(HavePrefix(diego_errors.STAGING_IN_PROGRESS_MESSAGE))
+			Expect(fakeMetricSender.GetCounter("StagingRequestsCoalesced")).To(Equal(uint64(1)))
+		})
+
+		It("does not cancel the in-flight task", func() {
+			Expect(fakeBBSClient.CancelTaskCallCount()).To(Equal(0))
+		})
+
+		Context("when no other task is in flight for the app", func() {
+			BeforeEach(func() {
+				request.AppId = "app-3"
+			})
+
+			It("accepts the request", func() {
+				Expect(coalesceErr).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when listing the tasks fails", func() {
+			BeforeEach(func() {
+				fakeBBSClient.TasksByDomainReturns(nil, errors.New("boom"))
+			})
+
+			It("accepts the request", func() {
+				Expect(coalesceErr).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Context("with the cancel-older policy", func() {
+		BeforeEach(func() {
+			policy = handlers.CoalescePolicyCancelOlder
+		})
+
+		It("accepts the request", func() {
+			Expect(coalesceErr).NotTo(HaveOccurred())
+		})
+
+		It("returns only the older in-flight task for the same app and lifecycle", func() {
+			Expect(duplicates).To(HaveLen(1))
+			Expect(duplicates[0].TaskGuid).To(Equal("older-guid"))
+			Expect(duplicates[0].Annotation.CompletionCallback).To(Equal("http://cc/older-guid"))
+		})
+
+		It("does not cancel or report anything until the duplicates are superseded", func() {
+			Expect(fakeBBSClient.CancelTaskCallCount()).To(Equal(0))
+			Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(0))
+			Expect(coalescer.WasSuperseded("older-guid")).To(BeFalse())
+		})
+
+		Context("when the duplicates are superseded", func() {
+			JustBeforeEach(func() {
+				coalescer.Supersede(duplicates)
+			})
+
+			It("cancels the older task", func() {
+				Expect(fakeBBSClient.CancelTaskCallCount()).To(Equal(1))
+				_, taskGuid := fakeBBSClient.CancelTaskArgsForCall(0)
+				Expect(taskGuid).To(Equal("older-guid"))
+				Expect(fakeMetricSender.GetCounter("StagingTasksSuperseded")).To(Equal(uint64(1)))
+				Expect(fakeMetricSender.GetCounter("StagingFailed" + backend.STAGING_SUPERSEDED)).To(Equal(uint64(1)))
+			})
+
+			It("reports the superseded task to CC", func() {
+				Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
+				guid, callback, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+				Expect(guid).To(Equal("older-guid"))
+				Expect(callback).To(Equal("http://cc/older-guid"))
+
+				var response cc_messages.StagingResponseForCC
+				Expect(json.Unmarshal(payload, &response)).To(Succeed())
+				Expect(response.Error.Id).To(Equal(backend.STAGING_SUPERSEDED))
+			})
+
+			It("remembers the superseded task once", func() {
+				Expect(coalescer.WasSuperseded("older-guid")).To(BeTrue())
+				Expect(coalescer.WasSuperseded("older-guid")).To(BeFalse())
+				Expect(coalescer.WasSuperseded("other-app-guid")).To(BeFalse())
+			})
+		})
+
+		Context("with a limiter", func() {
+			var limiter *handlers.StagingLimiter
+
+			BeforeEach(func() {
+				limiter = handlers.NewStagingLimiter(lagertest.NewTestLogger("test"), fakeBBSClient, fakeclock.NewFakeClock(time.Now()), "staging-domain", handlers.StagingLimits{MaxInFlight: 10})
+				limiter.InFlightTasks(lagertest.NewTestLogger("test"))
+			})
+
+			JustBeforeEach(func() {
+				var err error
+				coalescer, err = handlers.NewStagingCoalescer(lagertest.NewTestLogger("test"), fakeBBSClient, fakeCCClient, limiter, "staging-domain", policy)
+				Expect(err).NotTo(HaveOccurred())
+
+				duplicates, coalesceErr = coalescer.Coalesce("new-guid", request)
+			})
+
+			It("reuses the limiter's cached listing", func() {
+				// once by the limiter, once by the coalescer without a limiter
+				Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(2))
+				Expect(duplicates).To(HaveLen(1))
+				Expect(duplicates[0].TaskGuid).To(Equal("older-guid"))
+			})
+
+			Context("when a task for the app was admitted since the listing", func() {
+				BeforeEach(func() {
+					annotation := backend.StagingTaskAnnotation{AppId: "app-1"}
+					annotation.Lifecycle = "buildpack"
+					annotation.CompletionCallback = "http://cc/admitted-guid"
+					Expect(limiter.Admit("admitted-guid", annotation)).To(Succeed())
+				})
+
+				It("returns it as a duplicate before it is listed", func() {
+					Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(2))
+					callbacks := map[string]string{}
+					for _, duplicate := range duplicates {
+						callbacks[duplicate.TaskGuid] = duplicate.Annotation.CompletionCallback
+					}
+					Expect(callbacks).To(Equal(map[string]string{
+						"older-guid":    "http://cc/older-guid",
+						"admitted-guid": "http://cc/admitted-guid",
+					}))
+				})
+			})
+		})
+	})
+})
@@ -3,42 +3,69 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"time"
 
 	"code.cloudfoundry.org/bbs/models"
 	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
-	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/audit"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/stager_metrics"
+	"code.cloudfoundry.org/stager/tracing"
 )
 
 const (
 	// Metrics
-	stagingSuccessCounter  = metric.Counter("StagingRequestsSucceeded")
-	stagingSuccessDuration = metric.Duration("StagingRequestSucceededDuration")
-	stagingFailureCounter  = metric.Counter("StagingRequestsFailed")
-	stagingFailureDuration = metric.Duration("StagingRequestFailedDuration")
+	stagingSuccessCounter  = stager_metrics.Counter("StagingRequestsSucceeded")
+	stagingSuccessDuration = stager_metrics.Duration("StagingRequestSucceededDuration")
+	stagingFailureCounter  = stager_metrics.Counter("StagingRequestsFailed")
+	stagingFailureDuration = stager_metrics.Duration("StagingRequestFailedDuration")
 )
 
+// placementErrorIds are the errors of staging tasks that failed before they
+// were placed on a cell.
+var placementErrorIds = map[string]bool{
+	cc_messages.INSUFFICIENT_RESOURCES:   true,
+	cc_messages.NO_COMPATIBLE_CELL:       true,
+	cc_messages.CELL_COMMUNICATION_ERROR: true,
+}
+
 type CompletionHandler interface {
 	StagingComplete(resp http.ResponseWriter, req *http.Request)
 }
 
 type completionHandler struct {
-	ccClient cc_client.CcClient
-	backends map[string]backend.Backend
-	logger   lager.Logger
-	clock    clock.Clock
+	ccClient  cc_client.CcClient
+	backends  map[string]backend.Backend
+	logger    lager.Logger
+	clock     clock.Clock
+	tracer    *tracing.Tracer
+	auditor   audit.Recorder
+	failures  *FailureStore
+	coalescer *StagingCoalescer
 }
 
-func NewStagingCompletionHandler(logger lager.Logger, ccClient cc_client.CcClient, backends map[string]backend.Backend, clock clock.Clock) CompletionHandler {
+func NewStagingCompletionHandler(logger lager.Logger, ccClient cc_client.CcClient, backends map[string]backend.Backend, clock clock.Clock, tracer *tracing.Tracer, auditor audit.Recorder, failures *FailureStore, coalescer *StagingCoalescer) CompletionHandler {
+	if tracer == nil {
+		tracer = tracing.NewTracer(nil, 0)
+	}
+
+	if auditor == nil {
+		auditor = audit.Discard
+	}
+
 	return &completionHandler{
-		ccClient: ccClient,
-		backends: backends,
-		logger:   logger.Session("completion-handler"),
-		clock:    clock,
+		ccClient:  ccClient,
+		backends:  backends,
+		logger:    logger.Session("completion-handler"),
+		clock:     clock,
+		tracer:    tracer,
+		auditor:   auditor,
+		failures:  failures,
+		coalescer: coalescer,
 	}
 }
 
@@ -48,8 +75,23 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		"guid": taskGuid,
 	})
 
+	statusWriter := newStatusResponseWriter(res)
+	res = statusWriter
+	event := newAuditEvent(audit.ActionStagingCompleted, req, taskGuid)
+
+	var response cc_messages.StagingResponseForCC
+	var err error
+	defer func() {
+		if err == nil && response.Error != nil {
+			event.Outcome = audit.OutcomeFailure
+			event.ErrorId = response.Error.Id
+			event.Error = response.Error.Message
+		}
+		recordAuditEvent(handler.auditor, event, statusWriter.statusCode, err)
+	}()
+
 	task := &models.TaskCallbackResponse{}
-	err := json.NewDecoder(req.Body).Decode(task)
+	err = json.NewDecoder(req.Body).Decode(task)
 	if err != nil {
 		handler.logger.Error("parsing-incoming-task-failed", err)
 		res.WriteHeader(http.StatusBadRequest)
@@ -62,13 +104,36 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
-	var annotation cc_messages.StagingTaskAnnotation
+	var annotation backend.StagingTaskAnnotation
 	err = json.Unmarshal([]byte(task.Annotation), &annotation)
 	if err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		logger.Error("parsing-annotation-failed", err)
 		return
 	}
+	event.AppId = annotation.AppId
+	event.Lifecycle = annotation.Lifecycle
+
+	// The staging request's trace is resumed from the annotation, with the
+	// task itself recorded as a span from its creation until now.
+	trace := tracing.ParseTraceparent(annotation.Traceparent)
+	if trace.IsValid() {
+		taskSpan := handler.tracer.StartSpanAt("staging-task", trace, time.Unix(0, task.CreatedAt))
+		taskSpan.SetAttribute("task_guid", taskGuid)
+		taskSpan.SetAttribute("failed", strconv.FormatBool(task.Failed))
+		taskSpan.EndAt(handler.clock.Now(), nil)
+	}
+
+	// CC was already told that a superseded task failed when it was cancelled
+	if task.Failed && handler.coalescer.WasSuperseded(taskGuid) {
+		logger.Info("ignoring-superseded-task-completion")
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	span := handler.tracer.StartSpan("staging-complete", trace)
+	span.SetAttribute("staging_guid", taskGuid)
+	defer func() { span.End(err) }()
 
 	backend := handler.backends[annotation.Lifecycle]
 	if backend == nil {
@@ -77,7 +142,7 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
-	response, err := backend.BuildStagingResponse(task)
+	response, err = backend.BuildStagingResponse(task)
 	if err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		logger.Error("get-staging-response-failed", err)
@@ -97,11 +162,19 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
+	// CC only receives the sanitized error, so the detail of the failure is
+	// kept for operators.
+	if task.Failed || response.Error != nil {
+		failure := newStagingFailure(task, annotation, response, handler.clock.Now())
+		logger.Info("staging-failure-details", failure.logData())
+		handler.failures.Record(failure)
+	}
+
 	logger.Info("posting-staging-complete", lager.Data{
 		"payload": responseJson,
 	})
 
-	err = handler.ccClient.StagingComplete(taskGuid, annotation.CompletionCallback, responseJson, logger)
+	err = handler.ccClient.StagingComplete(taskGuid, annotation.CompletionCallback, responseJson, span.Context, logger)
 	if err != nil {
 		logger.Error("cc-staging-complete-failed", err)
 		if responseErr, ok := err.(*cc_client.BadResponseError); ok {
@@ -112,16 +185,35 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
-	handler.reportMetrics(task)
+	handler.reportMetrics(task, annotation, response)
 
 	logger.Info("posted-staging-complete")
 	res.WriteHeader(http.StatusOK)
 }
 
-func (handler *completionHandler) reportMetrics(task *models.TaskCallbackResponse) {
+func (handler *completionHandler) reportMetrics(task *models.TaskCallbackResponse, annotation backend.StagingTaskAnnotation, response cc_messages.StagingResponseForCC) {
 	duration := handler.clock.Now().Sub(time.Unix(0, task.CreatedAt))
-	if task.Failed {
+
+	var errorId string
+	if response.Error != nil {
+		errorId = response.Error.Id
+	}
+	stager_metrics.ObserveStagingDuration(annotation.Lifecycle, annotation.Stack, annotation.IsolationSegment, errorId, duration)
+
+	// The callback does not say when the task was placed on a cell, so the
+	// time spent queued is only known for tasks that never were.
+	if placementErrorIds[errorId] {
+		err := stager_metrics.ObserveStagingQueueDuration(annotation.Lifecycle, annotation.Stack, duration)
+		if err != nil {
+			handler.logger.Error("failed-to-send-staging-queue-duration-metric", err)
+		}
+	}
+
+	// A task that succeeded with an invalid result is reported to CC as a
+	// staging error, so it is counted as a failure.
+	if task.Failed || response.Error != nil {
 		stagingFailureCounter.Increment()
+		stager_metrics.IncrementStagingFailure(annotation.Lifecycle, errorId, stager_metrics.StagingFailureSourceTask)
 		err := stagingFailureDuration.Send(duration)
 		if err != nil {
 			handler.logger.Error("failed-to-send-staging-failed-duration-metric", err)
@@ -134,3 +226,23 @@ func (handler *completionHandler) reportMetrics(task *models.TaskCallbackRespons
 		stagingSuccessCounter.Increment()
 	}
 }
+
+// reportStagingFailure delivers a failed staging response to CC for a staging
+// request that has already been accepted, the same way the completion handler
+// does for a failed task. It returns the response delivered to CC.
+func reportStagingFailure(logger lager.Logger, ccClient cc_client.CcClient, trace tracing.SpanContext, stagingGuid, completionCallback string, stagingErr error) cc_messages.StagingResponseForCC {
+	response := cc_messages.StagingResponseForCC{
+		Error: backend.StagingErrorFor(stagingErr),
+	}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("marshal-staging-failure-failed", err)
+		return response
+	}
+
+	err = ccClient.StagingComplete(stagingGuid, completionCallback, responseJson, trace, logger)
+	if err != nil {
+		logger.Error("report-staging-failure-failed", err)
+	}
+	return response
+}
@@ -11,20 +11,25 @@ import (
 	"strings"
 	"time"
 
+	"code.cloudfoundry.org/bbs/fake_bbs"
 	"code.cloudfoundry.org/bbs/models"
 	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/audit"
+	fake_audit "code.cloudfoundry.org/stager/audit/fakes"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/backend/fake_backend"
 	"code.cloudfoundry.org/stager/cc_client"
 	"code.cloudfoundry.org/stager/cc_client/fakes"
 	"code.cloudfoundry.org/stager/handlers"
+	"code.cloudfoundry.org/stager/tracing"
 	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
 	"github.com/cloudfoundry/dropsonde/metrics"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("StagingCompletedHandler", func() {
@@ -38,6 +43,11 @@ var _ = Describe("StagingCompletedHandler", func() {
 		fakeClock           *fakeclock.FakeClock
 		metricSender        *fake.FakeMetricSender
 		stagingDurationNano time.Duration
+		tracer              *tracing.Tracer
+		spans               *gbytes.Buffer
+		fakeAuditor         *fake_audit.FakeRecorder
+		failureStore        *handlers.FailureStore
+		logBuffer           *gbytes.Buffer
 
 		responseRecorder *httptest.ResponseRecorder
 		handler          handlers.CompletionHandler
@@ -46,6 +56,8 @@ var _ = Describe("StagingCompletedHandler", func() {
 	BeforeEach(func() {
 		logger = lager.NewLogger("fakelogger")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.DEBUG))
+		logBuffer = gbytes.NewBuffer()
+		logger.RegisterSink(lager.NewWriterSink(logBuffer, lager.INFO))
 
 		stagingDurationNano = 900900
 		metricSender = fake.NewFakeMetricSender()
@@ -57,8 +69,13 @@ var _ = Describe("StagingCompletedHandler", func() {
 
 		fakeClock = fakeclock.NewFakeClock(time.Now())
 
+		spans = gbytes.NewBuffer()
+		fakeAuditor = &fake_audit.FakeRecorder{}
+		failureStore = handlers.NewFailureStore(10)
+		tracer = tracing.NewTracer(tracing.NewWriterExporter("stager", spans, nil), 1)
+
 		responseRecorder = httptest.NewRecorder()
-		handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, map[string]backend.Backend{"fake": fakeBackend}, fakeClock)
+		handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, map[string]backend.Backend{"fake": fakeBackend}, fakeClock, tracer, fakeAuditor, failureStore, nil)
 	})
 
 	JustBeforeEach(func() {
@@ -201,11 +218,61 @@ var _ = Describe("StagingCompletedHandler", func() {
 
 			It("posts the response builder's result to CC", func() {
 				Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
-				guid, payload, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+				guid, _, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
 				Expect(guid).To(Equal("the-task-guid"))
 				Expect(payload).To(Equal(backendResponseJson))
 			})
 
+			Context("when the staging task carries a trace context", func() {
+				BeforeEach(func() {
+					var err error
+					annotationJson, err = json.Marshal(backend.StagingTaskAnnotation{
+						StagingTaskAnnotation: cc_messages.StagingTaskAnnotation{Lifecycle: "fake"},
+						Traceparent:           "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("propagates the trace to CC", func() {
+					Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
+					_, _, _, trace, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+					Expect(trace.Traceparent()).To(HavePrefix("00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+				})
+
+				It("exports the staging task and completion spans", func() {
+					Expect(spans).To(gbytes.Say(`"parentSpanId":"00f067aa0ba902b7","name":"staging-task"`))
+					Expect(spans).To(gbytes.Say(`"parentSpanId":"00f067aa0ba902b7","name":"staging-complete"`))
+				})
+			})
+
+			Context("when the staging task was never placed on a cell", func() {
+				BeforeEach(func() {
+					var err error
+					annotationJson, err = json.Marshal(backend.StagingTaskAnnotation{
+						StagingTaskAnnotation: cc_messages.StagingTaskAnnotation{Lifecycle: "fake"},
+						Stack:                 "some-stack",
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					backendResponse = cc_messages.StagingResponseForCC{
+						Error: &cc_messages.StagingError{Id: cc_messages.INSUFFICIENT_RESOURCES, Message: "insufficient resources"},
+					}
+				})
+
+				It("emits the time it spent queued", func() {
+					Expect(metricSender.GetValue("StagingQueueDuration")).To(Equal(fake.Metric{
+						Value: float64(stagingDurationNano),
+						Unit:  "nanos",
+					}))
+				})
+			})
+
+			Context("when the staging task was placed on a cell", func() {
+				It("does not emit a queue duration", func() {
+					Expect(metricSender.GetValue("StagingQueueDuration")).To(Equal(fake.Metric{}))
+				})
+			})
+
 			Context("when the CC request succeeds", func() {
 				It("increments the staging success counter", func() {
 					Expect(metricSender.GetCounter("StagingRequestsSucceeded")).To(BeEquivalentTo(1))
@@ -224,6 +291,27 @@ var _ = Describe("StagingCompletedHandler", func() {
 				})
 			})
 
+			Context("when the backend rejects the staging result", func() {
+				BeforeEach(func() {
+					backendResponse = cc_messages.StagingResponseForCC{
+						Error: &cc_messages.StagingError{Id: backend.INVALID_STAGING_RESULT, Message: "invalid staging result: process_types is missing"},
+					}
+				})
+
+				It("counts the staging as failed", func() {
+					Expect(metricSender.GetCounter("StagingRequestsSucceeded")).To(BeEquivalentTo(0))
+					Expect(metricSender.GetCounter("StagingRequestsFailed")).To(BeEquivalentTo(1))
+					Expect(metricSender.GetCounter("StagingFailedInvalidStagingResult")).To(BeEquivalentTo(1))
+				})
+
+				It("records the failure for operators", func() {
+					failure, ok := failureStore.Get("the-task-guid")
+					Expect(ok).To(BeTrue())
+					Expect(failure.ErrorId).To(Equal(backend.INVALID_STAGING_RESULT))
+					Expect(failure.FailureReason).To(BeEmpty())
+				})
+			})
+
 			Context("when the CC request fails", func() {
 				BeforeEach(func() {
 					fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{504})
@@ -256,9 +344,11 @@ var _ = Describe("StagingCompletedHandler", func() {
 
 	Context("when a staging task fails", func() {
 		var backendResponseJson []byte
+		var failureReason string
 
 		BeforeEach(func() {
 			backendResponse = cc_messages.StagingResponseForCC{}
+			failureReason = "because I said so"
 
 			var err error
 			backendResponseJson, err = json.Marshal(backendResponse)
@@ -273,7 +363,7 @@ var _ = Describe("StagingCompletedHandler", func() {
 				TaskGuid:      "the-task-guid",
 				CreatedAt:     createdAt,
 				Failed:        true,
-				FailureReason: "because I said so",
+				FailureReason: failureReason,
 				Result:        `{}`,
 				Annotation: `{
 					"lifecycle": "fake",
@@ -287,7 +377,7 @@ var _ = Describe("StagingCompletedHandler", func() {
 
 		It("posts the result to CC as an error", func() {
 			Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
-			guid, payload, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+			guid, _, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
 			Expect(guid).To(Equal("the-task-guid"))
 			Expect(payload).To(Equal(backendResponseJson))
 		})
@@ -301,6 +391,87 @@ var _ = Describe("StagingCompletedHandler", func() {
 			Expect(metricSender.GetCounter("StagingRequestsFailed")).To(BeEquivalentTo(1))
 		})
 
+		Context("when the failure is categorised", func() {
+			BeforeEach(func() {
+				backendResponse = cc_messages.StagingResponseForCC{
+					Error: &cc_messages.StagingError{Id: cc_messages.INSUFFICIENT_RESOURCES, Message: "insufficient resources"},
+				}
+			})
+
+			It("counts the failure by its error id", func() {
+				Expect(metricSender.GetCounter("StagingFailedInsufficientResources")).To(BeEquivalentTo(1))
+			})
+
+			It("records the failure in the audit log", func() {
+				Expect(fakeAuditor.RecordCallCount()).To(Equal(1))
+				event := fakeAuditor.RecordArgsForCall(0)
+				Expect(event.Action).To(Equal(audit.ActionStagingCompleted))
+				Expect(event.AppId).To(Equal("the-app-id"))
+				Expect(event.StatusCode).To(Equal(http.StatusOK))
+				Expect(event.Outcome).To(Equal(audit.OutcomeFailure))
+				Expect(event.ErrorId).To(Equal(cc_messages.INSUFFICIENT_RESOURCES))
+			})
+		})
+
+		Context("when the failure reason carries detail that CC is not sent", func() {
+			BeforeEach(func() {
+				failureReason = "Exited with status 223"
+				backendResponse = cc_messages.StagingResponseForCC{
+					Error: &cc_messages.StagingError{Id: cc_messages.STAGING_ERROR, Message: "staging failed"},
+				}
+			})
+
+			It("records the raw failure reason and exit code", func() {
+				failure, ok := failureStore.Get("the-task-guid")
+				Expect(ok).To(BeTrue())
+				Expect(failure.StagingGuid).To(Equal("the-task-guid"))
+				Expect(failure.AppId).To(Equal("the-app-id"))
+				Expect(failure.Lifecycle).To(Equal("fake"))
+				Expect(failure.FailureReason).To(Equal("Exited with status 223"))
+				Expect(failure.ExitCode).NotTo(BeNil())
+				Expect(*failure.ExitCode).To(Equal(223))
+				Expect(failure.ErrorId).To(Equal(cc_messages.STAGING_ERROR))
+				Expect(failure.ErrorMessage).To(Equal("staging failed"))
+				Expect(failure.FailedAt).To(Equal(fakeClock.Now()))
+			})
+
+			It("logs the details keyed by staging guid", func() {
+				Expect(logBuffer).To(gbytes.Say(`staging-failure-details.*"exit-code":223,"failure-reason":"Exited with status 223".*"staging-guid":"the-task-guid"`))
+			})
+
+			It("sends CC only the sanitized error", func() {
+				_, _, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+				Expect(string(payload)).NotTo(ContainSubstring("Exited with status"))
+			})
+		})
+
+		Context("when the task was superseded by this stager", func() {
+			BeforeEach(func() {
+				fakeBBSClient := &fake_bbs.FakeClient{}
+				fakeBBSClient.TasksByDomainReturns([]*models.Task{
+					{
+						TaskGuid:       "the-task-guid",
+						State:          models.Task_Running,
+						TaskDefinition: &models.TaskDefinition{Annotation: `{"lifecycle":"fake","app_id":"the-app-id"}`},
+					},
+				}, nil)
+
+				coalescer, err := handlers.NewStagingCoalescer(logger, fakeBBSClient, &fakes.FakeCcClient{}, nil, "staging-domain", handlers.CoalescePolicyCancelOlder)
+				Expect(err).NotTo(HaveOccurred())
+				duplicates, err := coalescer.Coalesce("new-guid", cc_messages.StagingRequestFromCC{AppId: "the-app-id", Lifecycle: "fake"})
+				Expect(err).NotTo(HaveOccurred())
+				coalescer.Supersede(duplicates)
+
+				handler = handlers.NewStagingCompletionHandler(logger, fakeCCClient, map[string]backend.Backend{"fake": fakeBackend}, fakeClock, tracer, fakeAuditor, failureStore, coalescer)
+			})
+
+			It("does not report the cancellation to CC again", func() {
+				Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(0))
+				Expect(responseRecorder.Code).To(Equal(http.StatusOK))
+				Expect(metricSender.GetCounter("StagingRequestsFailed")).To(BeEquivalentTo(0))
+			})
+		})
+
 		It("emits the time it took to stage unsuccesfully", func() {
 			Expect(metricSender.GetValue("StagingRequestFailedDuration")).To(Equal(fake.Metric{
 				Value: 900900,
@@ -1,23 +1,59 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"code.cloudfoundry.org/bbs"
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
-	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/audit"
 	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/diego_errors"
+	"code.cloudfoundry.org/stager/stager_metrics"
+	"code.cloudfoundry.org/stager/tracing"
 )
 
 const (
-	StagingStartRequestsReceivedCounter = metric.Counter("StagingStartRequestsReceived")
-	StagingStopRequestsReceivedCounter  = metric.Counter("StagingStopRequestsReceived")
+	StagingStartRequestsReceivedCounter = stager_metrics.Counter("StagingStartRequestsReceived")
+	StagingStopRequestsReceivedCounter  = stager_metrics.Counter("StagingStopRequestsReceived")
+	StagingDesireTaskRetriedCounter     = stager_metrics.Counter("StagingDesireTaskRetried")
+	StagingDesireTaskFailedCounter      = stager_metrics.Counter("StagingDesireTaskFailed")
+
+	DefaultDesireTaskInitialBackoff = 250 * time.Millisecond
+	DefaultDesireTaskMaxBackoff     = 2 * time.Second
 )
 
+var errStagingQueueFull = diego_errors.StagingQueueFull
+
+type DesireTaskRetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Timeout        time.Duration
+}
+
+// NewDesireTaskRetryPolicy returns a policy with the configured attempts and
+// timeout, backing off between attempts by the default amounts.
+func NewDesireTaskRetryPolicy(maxAttempts int, timeout time.Duration) DesireTaskRetryPolicy {
+	return DesireTaskRetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: DefaultDesireTaskInitialBackoff,
+		MaxBackoff:     DefaultDesireTaskMaxBackoff,
+		Timeout:        timeout,
+	}
+}
+
 type StagingHandler interface {
 	Stage(resp http.ResponseWriter, req *http.Request)
 	StopStaging(resp http.ResponseWriter, req *http.Request)
@@ -27,25 +63,89 @@ type stagingHandler struct {
 	logger      lager.Logger
 	backends    map[string]backend.Backend
 	diegoClient bbs.Client
+	ccClient    cc_client.CcClient
+	clock       clock.Clock
+	tracer      *tracing.Tracer
+	auditor     audit.Recorder
+	retryPolicy DesireTaskRetryPolicy
+	queue       *StagingQueue
+	limiter     *StagingLimiter
+	coalescer   *StagingCoalescer
+	drainer     *Drainer
 }
 
+// NewStagingHandler returns a handler that desires staging tasks on the BBS.
+// If queue is nil tasks are desired synchronously within the Stage request,
+// otherwise they are handed to the queue and any failure is reported to CC
+// through the staging completion callback. If coalescer or limiter are not
+// nil they are consulted, in that order, before any task is desired. The trace
+// context of each request is carried to the completion handler in the task
+// annotation. Every request is recorded by auditor. Queued requests are
+// tracked by drainer until they have been desired.
 func NewStagingHandler(
 	logger lager.Logger,
 	backends map[string]backend.Backend,
 	bbsClient bbs.Client,
+	ccClient cc_client.CcClient,
+	clock clock.Clock,
+	tracer *tracing.Tracer,
+	auditor audit.Recorder,
+	retryPolicy DesireTaskRetryPolicy,
+	queue *StagingQueue,
+	limiter *StagingLimiter,
+	coalescer *StagingCoalescer,
+	drainer *Drainer,
 ) StagingHandler {
 	logger = logger.Session("staging-handler")
 
+	if retryPolicy.MaxAttempts < 1 {
+		retryPolicy.MaxAttempts = 1
+	}
+
+	if tracer == nil {
+		tracer = tracing.NewTracer(nil, 0)
+	}
+
+	if auditor == nil {
+		auditor = audit.Discard
+	}
+
 	return &stagingHandler{
 		logger:      logger,
 		backends:    backends,
 		diegoClient: bbsClient,
+		ccClient:    ccClient,
+		clock:       clock,
+		tracer:      tracer,
+		auditor:     auditor,
+		retryPolicy: retryPolicy,
+		queue:       queue,
+		limiter:     limiter,
+		coalescer:   coalescer,
+		drainer:     drainer,
 	}
 }
 
 func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request) {
 	stagingGuid := req.FormValue(":staging_guid")
-	logger := handler.logger.Session("staging-request", lager.Data{"staging-guid": stagingGuid})
+
+	span := handler.tracer.StartSpanFromRequest("stage", req)
+	span.SetAttribute("staging_guid", stagingGuid)
+
+	statusWriter := newStatusResponseWriter(resp)
+	resp = statusWriter
+	event := newAuditEvent(audit.ActionStage, req, stagingGuid)
+
+	var err error
+	defer func() {
+		span.End(err)
+		recordAuditEvent(handler.auditor, event, statusWriter.statusCode, err)
+	}()
+
+	logger := handler.logger.Session("staging-request", lager.Data{
+		"staging-guid": stagingGuid,
+		"traceparent":  span.Context.Traceparent(),
+	})
 
 	requestBody, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -58,7 +158,8 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 	err = json.Unmarshal(requestBody, &stagingRequest)
 	if err != nil {
 		logger.Error("unmarshal-request-failed", err)
-		resp.WriteHeader(http.StatusBadRequest)
+		err = diego_errors.InvalidStagingRequest.WithDetail("%s", err)
+		writeErrorResponse(resp, http.StatusBadRequest, newErrorResponse(err))
 		return
 	}
 
@@ -68,10 +169,18 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 	}
 	logger.Info("environment", lager.Data{"keys": envNames})
 
+	span.SetAttribute("lifecycle", stagingRequest.Lifecycle)
+	event.AppId = stagingRequest.AppId
+	event.Lifecycle = stagingRequest.Lifecycle
+	event.Image = stagingImage(stagingRequest)
+
 	backend, ok := handler.backends[stagingRequest.Lifecycle]
 	if !ok {
+		err = diego_errors.UnknownLifecycle.WithDetail("'%s'", stagingRequest.Lifecycle)
 		logger.Error("backend-not-found", err, lager.Data{"backend": stagingRequest.Lifecycle})
-		resp.WriteHeader(http.StatusNotFound)
+		response := newErrorResponse(err)
+		response.SupportedLifecycles = handler.supportedLifecycles()
+		writeErrorResponse(resp, http.StatusNotFound, response)
 		return
 	}
 
@@ -79,8 +188,83 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 
 	taskDef, guid, domain, err := backend.BuildRecipe(stagingGuid, stagingRequest)
 	if err != nil {
-		logger.Error("recipe-building-failed", err, lager.Data{"staging-request": stagingRequest})
-		handler.doErrorResponse(resp, err.Error())
+		logger.Error("recipe-building-failed", err, stagingRequestLogData(stagingGuid, stagingRequest))
+		handler.doErrorResponse(resp, http.StatusInternalServerError, stagingRequest.Lifecycle, err)
+		return
+	}
+
+	err = setTraceparent(taskDef, span.Context)
+	if err != nil {
+		logger.Error("set-task-traceparent-failed", err)
+		err = nil
+	}
+
+	// duplicates are only superseded once this request has been desired, so
+	// that a rejected, flushed or failed request does not cancel the staging
+	// in flight
+	var duplicates []DuplicateStagingTask
+	if handler.coalescer != nil {
+		duplicates, err = handler.coalescer.Coalesce(stagingGuid, stagingRequest)
+		if err != nil {
+			handler.doErrorResponse(resp, http.StatusConflict, stagingRequest.Lifecycle, err)
+			return
+		}
+	}
+
+	if handler.limiter != nil {
+		err = handler.limiter.Admit(guid, admittedTaskAnnotation(taskDef, stagingRequest))
+		if err != nil {
+			handler.doErrorResponse(resp, http.StatusTooManyRequests, stagingRequest.Lifecycle, err)
+			return
+		}
+	}
+
+	if handler.queue != nil {
+		// Accepted requests are tracked until they leave the queue, so that
+		// the stager waits for them when it drains. Requests still queued
+		// when the grace period expires are flushed and reported to CC as
+		// interrupted.
+		handler.drainer.Track()
+
+		// the request is audited as accepted, and its outcome once it leaves
+		// the queue; no response is written for the latter, so it has no
+		// status code
+		queuedEvent := event
+		queuedEvent.Action = audit.ActionDesireQueuedTask
+
+		queued := handler.queue.Enqueue(backend.Priority(stagingRequest).QueuePriority, func() {
+			defer handler.drainer.Done()
+			if handler.coalescer.WasSuperseded(guid) {
+				// a newer request superseded this one while it was queued and
+				// has already been reported to CC
+				logger.Info("skipping-superseded-task", lager.Data{"task_guid": guid})
+				handler.recordDesireResult(guid, diego_errors.StagingSuperseded)
+				recordAuditEvent(handler.auditor, queuedEvent, 0, diego_errors.StagingSuperseded)
+				return
+			}
+			err := handler.desireQueuedTask(logger, span.Context, stagingGuid, stagingRequest, guid, domain, taskDef)
+			if err == nil {
+				handler.coalescer.Supersede(duplicates)
+			}
+			recordAuditEvent(handler.auditor, queuedEvent, 0, err)
+		}, func() {
+			defer handler.drainer.Done()
+			err := handler.abandonQueuedTask(logger, span.Context, stagingGuid, stagingRequest, guid)
+			recordAuditEvent(handler.auditor, queuedEvent, 0, err)
+		})
+		if !queued {
+			handler.drainer.Done()
+			logger.Info("staging-queue-full")
+			err = errStagingQueueFull
+			handler.recordDesireResult(guid, err)
+			resp.Header().Set("Retry-After", StagingQueueRetryAfter)
+			handler.doErrorResponse(resp, http.StatusServiceUnavailable, stagingRequest.Lifecycle, err)
+			return
+		}
+
+		logger.Info("queued-task", lager.Data{"task_guid": guid})
+		event.Outcome = audit.OutcomeAccepted
+		resp.WriteHeader(http.StatusAccepted)
 		return
 	}
 
@@ -89,34 +273,250 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 		"callback_url": taskDef.CompletionCallbackUrl,
 	})
 
-	err = handler.diegoClient.DesireTask(logger, guid, domain, taskDef)
-	if models.ErrResourceExists.Equal(err) {
-		err = nil
+	err = handler.desireTask(logger, req.Context(), span.Context, guid, domain, taskDef)
+	handler.recordDesireResult(guid, err)
+	if err != nil {
+		logger.Error("staging-failed", err, stagingRequestLogData(stagingGuid, stagingRequest))
+		handler.doErrorResponse(resp, http.StatusInternalServerError, stagingRequest.Lifecycle, err)
+		return
 	}
 
+	handler.coalescer.Supersede(duplicates)
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (handler *stagingHandler) desireQueuedTask(
+	logger lager.Logger,
+	trace tracing.SpanContext,
+	stagingGuid string,
+	stagingRequest cc_messages.StagingRequestFromCC,
+	guid string,
+	domain string,
+	taskDef *models.TaskDefinition,
+) error {
+	logger.Info("desiring-task", lager.Data{
+		"task_guid":    guid,
+		"callback_url": taskDef.CompletionCallbackUrl,
+	})
+
+	err := handler.desireTask(logger, context.Background(), trace, guid, domain, taskDef)
+	handler.recordDesireResult(guid, err)
 	if err != nil {
-		logger.Error("staging-failed", err, lager.Data{"staging-request": stagingRequest})
-		handler.doErrorResponse(resp, err.Error())
+		logger.Error("staging-failed", err, stagingRequestLogData(stagingGuid, stagingRequest))
+		response := reportStagingFailure(logger, handler.ccClient, trace, stagingGuid, stagingRequest.CompletionCallback, err)
+		stager_metrics.IncrementStagingFailure(stagingRequest.Lifecycle, response.Error.Id, stager_metrics.StagingFailureSourceRequest)
+	}
+	return err
+}
+
+// abandonQueuedTask reports a staging request that was accepted but never
+// desired to CC, so that it can be retried rather than waiting forever.
+func (handler *stagingHandler) abandonQueuedTask(logger lager.Logger, trace tracing.SpanContext, stagingGuid string, stagingRequest cc_messages.StagingRequestFromCC, guid string) error {
+	err := diego_errors.StagingInterrupted
+	handler.recordDesireResult(guid, err)
+	logger.Info("abandoning-queued-task", lager.Data{"task_guid": guid})
+	response := reportStagingFailure(logger, handler.ccClient, trace, stagingGuid, stagingRequest.CompletionCallback, err)
+	stager_metrics.IncrementStagingFailure(stagingRequest.Lifecycle, response.Error.Id, stager_metrics.StagingFailureSourceRequest)
+	return err
+}
+
+// desireTask desires the task on the BBS, retrying transient failures with
+// exponential backoff until the retry policy is exhausted, the policy timeout
+// elapses or ctx is cancelled.
+func (handler *stagingHandler) desireTask(logger lager.Logger, ctx context.Context, trace tracing.SpanContext, guid, domain string, taskDef *models.TaskDefinition) (err error) {
+	span := handler.tracer.StartSpan("desire-task", trace)
+	span.SetAttribute("task_guid", guid)
+	defer func() { span.End(err) }()
+
+	policy := handler.retryPolicy
+
+	var deadline time.Time
+	if policy.Timeout > 0 {
+		deadline = handler.clock.Now().Add(policy.Timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = handler.diegoClient.DesireTask(logger, guid, domain, taskDef)
+		if err == nil || models.ErrResourceExists.Equal(err) {
+			span.SetAttribute("attempts", strconv.Itoa(attempt))
+			return nil
+		}
+
+		if attempt >= policy.MaxAttempts || !isTransientBBSError(err) {
+			StagingDesireTaskFailedCounter.Increment()
+			return err
+		}
+
+		if !deadline.IsZero() && handler.clock.Now().Add(backoff).After(deadline) {
+			logger.Info("desire-task-retry-deadline-exceeded", lager.Data{"attempt": attempt})
+			StagingDesireTaskFailedCounter.Increment()
+			return err
+		}
+
+		logger.Info("retrying-desire-task", lager.Data{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+			"error":   err.Error(),
+		})
+		StagingDesireTaskRetriedCounter.Increment()
+
+		timer := handler.clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Info("desire-task-retry-cancelled", lager.Data{"attempt": attempt})
+			StagingDesireTaskFailedCounter.Increment()
+			return err
+		}
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// setTraceparent records the staging request's span in the task annotation, so
+// that the completion callback continues the same trace.
+func setTraceparent(taskDef *models.TaskDefinition, trace tracing.SpanContext) error {
+	if !trace.IsValid() {
+		return nil
+	}
+	return backend.SetTraceparent(taskDef, trace.Traceparent())
+}
+
+// stagingRequestLogData identifies a staging request in the logs without its
+// environment, lifecycle data or callback URL, which may hold secrets.
+func stagingRequestLogData(stagingGuid string, request cc_messages.StagingRequestFromCC) lager.Data {
+	return lager.Data{
+		"staging-guid": stagingGuid,
+		"app-id":       request.AppId,
+		"lifecycle":    request.Lifecycle,
+	}
+}
+
+// admittedTaskAnnotation returns the annotation of the task for the request,
+// as it will be listed once the task has been desired.
+func admittedTaskAnnotation(taskDef *models.TaskDefinition, request cc_messages.StagingRequestFromCC) backend.StagingTaskAnnotation {
+	var annotation backend.StagingTaskAnnotation
+	json.Unmarshal([]byte(taskDef.Annotation), &annotation)
+
+	annotation.Lifecycle = request.Lifecycle
+	annotation.CompletionCallback = request.CompletionCallback
+	annotation.AppId = request.AppId
+	annotation.IsolationSegment = request.IsolationSegment
+	return annotation
+}
+
+// isTransientBBSError returns true for errors that indicate the BBS was
+// briefly unreachable or unable to serve the request, e.g. during a leader
+// election, rather than that the request itself was rejected. The BBS client
+// reports a response without a protobuf body, such as the 503 served while
+// there is no leader, as an invalid protobuf message.
+func isTransientBBSError(err error) bool {
+	if bbsErr, ok := err.(*models.Error); ok {
+		switch bbsErr.Type {
+		case models.Error_Deadlock, models.Error_Timeout, models.Error_InvalidProtobufMessage:
+			return true
+		}
+		return false
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return true
+	}
+
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
+
+func (handler *stagingHandler) recordDesireResult(guid string, err error) {
+	if handler.limiter == nil {
 		return
 	}
 
-	resp.WriteHeader(http.StatusAccepted)
+	if err != nil {
+		handler.limiter.Release(guid)
+	} else {
+		handler.limiter.Desired(guid)
+	}
 }
 
-func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, message string) {
-	response := cc_messages.StagingResponseForCC{
-		Error: backend.SanitizeErrorMessage(message),
+// ErrorResponse is the body of a rejected staging request. Code and Field
+// are those of the error in the diego_errors catalog, if it is catalogued.
+// Error carries the error in the form CC reads from staging responses.
+type ErrorResponse struct {
+	Code                string                    `json:"code"`
+	Message             string                    `json:"message"`
+	Field               string                    `json:"field,omitempty"`
+	SupportedLifecycles []string                  `json:"supported_lifecycles,omitempty"`
+	Error               *cc_messages.StagingError `json:"error"`
+}
+
+const internalErrorCode = "internal_error"
+
+func newErrorResponse(err error) ErrorResponse {
+	stagingError := backend.StagingErrorFor(err)
+	response := ErrorResponse{
+		Code:    internalErrorCode,
+		Message: stagingError.Message,
+		Error:   stagingError,
 	}
-	responseJson, _ := json.Marshal(response)
 
-	resp.WriteHeader(http.StatusInternalServerError)
-	resp.Write(responseJson)
+	if catalogError, ok := diego_errors.Lookup(err); ok {
+		response.Code = catalogError.Code
+		response.Field = catalogError.Field
+	}
+	return response
+}
+
+func writeErrorResponse(resp http.ResponseWriter, statusCode int, response ErrorResponse) {
+	writeJSON(resp, statusCode, response)
+}
+
+// doErrorResponse rejects a staging request with err. Errors from the
+// diego_errors catalog are rejected with their own status, and any other error
+// with statusCode.
+func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, statusCode int, lifecycle string, err error) {
+	if catalogError, ok := diego_errors.Lookup(err); ok && catalogError.HTTPStatus != 0 {
+		statusCode = catalogError.HTTPStatus
+	}
+
+	response := newErrorResponse(err)
+	stager_metrics.IncrementStagingFailure(lifecycle, response.Error.Id, stager_metrics.StagingFailureSourceRequest)
+
+	writeErrorResponse(resp, statusCode, response)
+}
+
+func (handler *stagingHandler) supportedLifecycles() []string {
+	lifecycles := []string{}
+	for lifecycle := range handler.backends {
+		lifecycles = append(lifecycles, lifecycle)
+	}
+	sort.Strings(lifecycles)
+	return lifecycles
 }
 
 func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.Request) {
 	taskGuid := req.FormValue(":staging_guid")
 	logger := handler.logger.Session("stop-staging-request", lager.Data{"staging-guid": taskGuid})
 
+	statusWriter := newStatusResponseWriter(resp)
+	resp = statusWriter
+	event := newAuditEvent(audit.ActionStopStaging, req, taskGuid)
+
+	var err error
+	defer func() { recordAuditEvent(handler.auditor, event, statusWriter.statusCode, err) }()
+
 	task, err := handler.diegoClient.TaskByGuid(logger, taskGuid)
 	if err != nil {
 		if models.ErrResourceNotFound.Equal(err) {
@@ -129,13 +529,15 @@ func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.R
 		return
 	}
 
-	var annotation cc_messages.StagingTaskAnnotation
+	var annotation backend.StagingTaskAnnotation
 	err = json.Unmarshal([]byte(task.Annotation), &annotation)
 	if err != nil {
 		logger.Error("failed-to-unmarshal-task-annotation", err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	event.AppId = annotation.AppId
+	event.Lifecycle = annotation.Lifecycle
 
 	resp.WriteHeader(http.StatusAccepted)
 	StagingStopRequestsReceivedCounter.Increment()
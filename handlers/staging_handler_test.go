@@ -4,24 +4,38 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"time"
 
+	"code.cloudfoundry.org/bbs"
 	"code.cloudfoundry.org/bbs/fake_bbs"
 	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/stager/audit"
+	fake_audit "code.cloudfoundry.org/stager/audit/fakes"
 	"code.cloudfoundry.org/stager/backend"
 	"code.cloudfoundry.org/stager/backend/fake_backend"
+	"code.cloudfoundry.org/stager/cc_client/fakes"
+	"code.cloudfoundry.org/stager/diego_errors"
 	"code.cloudfoundry.org/stager/handlers"
+	"code.cloudfoundry.org/stager/tracing"
 	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
 	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/ghttp"
 )
 
 var _ = Describe("StagingHandler", func() {
@@ -31,7 +45,12 @@ var _ = Describe("StagingHandler", func() {
 
 		logger          lager.Logger
 		fakeDiegoClient *fake_bbs.FakeClient
+		fakeCCClient    *fakes.FakeCcClient
 		fakeBackend     *fake_backend.FakeBackend
+		retryPolicy     handlers.DesireTaskRetryPolicy
+		tracer          *tracing.Tracer
+		spans           *gbytes.Buffer
+		fakeAuditor     *fake_audit.FakeRecorder
 
 		responseRecorder *httptest.ResponseRecorder
 		handler          handlers.StagingHandler
@@ -47,20 +66,42 @@ var _ = Describe("StagingHandler", func() {
 		fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "", "", nil)
 
 		fakeDiegoClient = &fake_bbs.FakeClient{}
+		fakeCCClient = &fakes.FakeCcClient{}
+
+		spans = gbytes.NewBuffer()
+		fakeAuditor = &fake_audit.FakeRecorder{}
+		tracer = tracing.NewTracer(tracing.NewWriterExporter("stager", spans, nil), 1)
 
 		responseRecorder = httptest.NewRecorder()
-		handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient)
+		retryPolicy = handlers.DesireTaskRetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Timeout:        time.Second,
+		}
+		handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, nil, nil, nil, nil)
 	})
 
 	Describe("Stage", func() {
 		var (
 			stagingRequestJson []byte
+			traceparent        string
 		)
 
+		BeforeEach(func() {
+			traceparent = ""
+		})
+
 		JustBeforeEach(func() {
 			req, err := http.NewRequest("PUT", "/v1/staging/a-staging-guid", bytes.NewReader(stagingRequestJson))
 			Expect(err).NotTo(HaveOccurred())
 
+			if traceparent != "" {
+				req.Header.Set("traceparent", traceparent)
+			}
+			req.SetBasicAuth("cc-user", "password")
+			req.RemoteAddr = "10.0.0.1:1234"
+
 			req.Form = url.Values{":staging_guid": {"a-staging-guid"}}
 
 			handler.Stage(responseRecorder, req)
@@ -88,6 +129,20 @@ var _ = Describe("StagingHandler", func() {
 				Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
 			})
 
+			It("records the request in the audit log", func() {
+				Expect(fakeAuditor.RecordCallCount()).To(Equal(1))
+				Expect(fakeAuditor.RecordArgsForCall(0)).To(Equal(audit.Event{
+					Action:      audit.ActionStage,
+					Actor:       "unverified-user:cc-user",
+					RemoteAddr:  "10.0.0.1:1234",
+					StagingGuid: "a-staging-guid",
+					AppId:       "myapp",
+					Lifecycle:   "fake-backend",
+					StatusCode:  http.StatusAccepted,
+					Outcome:     audit.OutcomeSuccess,
+				}))
+			})
+
 			It("builds a staging recipe", func() {
 				Expect(fakeBackend.BuildRecipeCallCount()).To(Equal(1))
 
@@ -108,6 +163,33 @@ var _ = Describe("StagingHandler", func() {
 					Expect(resultingTaskDef).To(Equal(fakeTaskDef))
 				})
 
+				Context("when the request carries a trace context", func() {
+					BeforeEach(func() {
+						traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+						fakeBackend.BuildRecipeReturns(&models.TaskDefinition{Annotation: `{"lifecycle":"fake-backend"}`}, "a-guid", "a-domain", nil)
+					})
+
+					It("records the staging span in the task annotation", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+						_, _, _, taskDef := fakeDiegoClient.DesireTaskArgsForCall(0)
+
+						var annotation backend.StagingTaskAnnotation
+						Expect(json.Unmarshal([]byte(taskDef.Annotation), &annotation)).To(Succeed())
+						Expect(annotation.Lifecycle).To(Equal("fake-backend"))
+
+						trace := tracing.ParseTraceparent(annotation.Traceparent)
+						Expect(trace.IsValid()).To(BeTrue())
+						Expect(trace.Traceparent()).To(HavePrefix("00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+						Expect(trace.Traceparent()).NotTo(Equal(traceparent))
+					})
+
+					It("exports the stage and desire-task spans within the incoming trace", func() {
+						Expect(spans).To(gbytes.Say(`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`))
+						Expect(spans).To(gbytes.Say(`"name":"desire-task"`))
+						Expect(spans).To(gbytes.Say(`"parentSpanId":"00f067aa0ba902b7","name":"stage"`))
+					})
+				})
+
 				Context("when the task has already been created", func() {
 					BeforeEach(func() {
 						fakeDiegoClient.DesireTaskReturns(models.NewError(models.Error_ResourceExists, "ok, this task already exists"))
@@ -118,6 +200,103 @@ var _ = Describe("StagingHandler", func() {
 					})
 				})
 
+				Context("when desiring the task fails transiently", func() {
+					BeforeEach(func() {
+						fakeDiegoClient.DesireTaskStub = func(lager.Logger, string, string, *models.TaskDefinition) error {
+							if fakeDiegoClient.DesireTaskCallCount() == 1 {
+								return &url.Error{Op: "Post", URL: "http://bbs", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+							}
+							return nil
+						}
+					})
+
+					It("retries the desire", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(2))
+						Expect(logger).To(gbytes.Say("retrying-desire-task"))
+					})
+
+					It("returns an Accepted response", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+					})
+
+					It("increments the retried counter", func() {
+						Expect(fakeMetricSender.GetCounter("StagingDesireTaskRetried")).To(Equal(uint64(1)))
+						Expect(fakeMetricSender.GetCounter("StagingDesireTaskFailed")).To(Equal(uint64(0)))
+					})
+
+					Context("when the BBS responds with a 503 during a leader election", func() {
+						var bbsServer *ghttp.Server
+
+						BeforeEach(func() {
+							bbsServer = ghttp.NewServer()
+							bbsServer.RouteToHandler("POST", "/v1/tasks/desire.r2", ghttp.RespondWith(http.StatusServiceUnavailable, "no leader"))
+							bbsClient := bbs.NewClient(bbsServer.URL())
+
+							fakeDiegoClient.DesireTaskStub = func(logger lager.Logger, guid, domain string, taskDef *models.TaskDefinition) error {
+								if fakeDiegoClient.DesireTaskCallCount() == 1 {
+									return bbsClient.DesireTask(logger, guid, domain, taskDef)
+								}
+								return nil
+							}
+						})
+
+						AfterEach(func() {
+							bbsServer.Close()
+						})
+
+						It("retries the desire", func() {
+							Expect(bbsServer.ReceivedRequests()).To(HaveLen(1))
+							Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(2))
+							Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+						})
+					})
+
+					Context("when the retried desire reports the task already exists", func() {
+						BeforeEach(func() {
+							fakeDiegoClient.DesireTaskStub = func(lager.Logger, string, string, *models.TaskDefinition) error {
+								if fakeDiegoClient.DesireTaskCallCount() == 1 {
+									return models.NewError(models.Error_Timeout, "request timed out")
+								}
+								return models.ErrResourceExists
+							}
+						})
+
+						It("returns an Accepted response", func() {
+							Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+						})
+					})
+
+					Context("when every attempt fails", func() {
+						BeforeEach(func() {
+							fakeDiegoClient.DesireTaskStub = nil
+							fakeDiegoClient.DesireTaskReturns(models.NewError(models.Error_Deadlock, "deadlock detected"))
+						})
+
+						It("gives up after the maximum number of attempts", func() {
+							Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(3))
+						})
+
+						It("returns an internal service error status code", func() {
+							Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+						})
+
+						It("increments the retried and failed counters", func() {
+							Expect(fakeMetricSender.GetCounter("StagingDesireTaskRetried")).To(Equal(uint64(2)))
+							Expect(fakeMetricSender.GetCounter("StagingDesireTaskFailed")).To(Equal(uint64(1)))
+						})
+					})
+				})
+
+				Context("when the BBS rejects the request", func() {
+					BeforeEach(func() {
+						fakeDiegoClient.DesireTaskReturns(models.NewError(models.Error_InvalidRequest, "503 in the task definition"))
+					})
+
+					It("does not retry", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+					})
+				})
+
 				Context("create task fails for any other reason", func() {
 					var desireError error
 
@@ -126,6 +305,10 @@ var _ = Describe("StagingHandler", func() {
 						fakeDiegoClient.DesireTaskReturns(desireError)
 					})
 
+					It("does not retry", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+					})
+
 					It("logs the failure", func() {
 						Expect(logger).To(gbytes.Say("staging-failed"))
 					})
@@ -134,6 +317,19 @@ var _ = Describe("StagingHandler", func() {
 						Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
 					})
 
+					It("counts the failure by its error id", func() {
+						Expect(fakeMetricSender.GetCounter("StagingFailedStagingError")).To(Equal(uint64(1)))
+					})
+
+					It("records the sanitized failure in the audit log", func() {
+						Expect(fakeAuditor.RecordCallCount()).To(Equal(1))
+						event := fakeAuditor.RecordArgsForCall(0)
+						Expect(event.StatusCode).To(Equal(http.StatusInternalServerError))
+						Expect(event.Outcome).To(Equal(audit.OutcomeFailure))
+						Expect(event.ErrorId).To(Equal(cc_messages.STAGING_ERROR))
+						Expect(event.Error).To(Equal("staging failed"))
+					})
+
 					Context("when the response builder succeeds", func() {
 						var responseForCC cc_messages.StagingResponseForCC
 
@@ -155,6 +351,368 @@ var _ = Describe("StagingHandler", func() {
 				})
 			})
 
+			Context("when duplicate staging requests are coalesced", func() {
+				BeforeEach(func() {
+					coalescer, err := handlers.NewStagingCoalescer(logger, fakeDiegoClient, fakeCCClient, nil, "a-domain", handlers.CoalescePolicyRejectNewer)
+					Expect(err).NotTo(HaveOccurred())
+					handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, nil, nil, coalescer, nil)
+
+					fakeDiegoClient.TasksByDomainReturns([]*models.Task{
+						{
+							TaskGuid: "older-guid",
+							State:    models.Task_Pending,
+							TaskDefinition: &models.TaskDefinition{
+								Annotation: `{"lifecycle":"fake-backend","app_id":"myapp"}`,
+							},
+						},
+					}, nil)
+				})
+
+				It("does not desire the task", func() {
+					Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(0))
+				})
+
+				It("returns Conflict with a StagingInProgress error", func() {
+					Expect(responseRecorder.Code).To(Equal(http.StatusConflict))
+
+					var response cc_messages.StagingResponseForCC
+					Expect(json.NewDecoder(responseRecorder.Body).Decode(&response)).To(Succeed())
+					Expect(response.Error.Id).To(Equal(backend.STAGING_IN_PROGRESS))
+				})
+			})
+
+			Context("when older staging tasks are superseded", func() {
+				newHandler := func(limits handlers.StagingLimits) {
+					limiter := handlers.NewStagingLimiter(logger, fakeDiegoClient, clock.NewClock(), "a-domain", limits)
+					coalescer, err := handlers.NewStagingCoalescer(logger, fakeDiegoClient, fakeCCClient, limiter, "a-domain", handlers.CoalescePolicyCancelOlder)
+					Expect(err).NotTo(HaveOccurred())
+					handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, nil, limiter, coalescer, nil)
+				}
+
+				BeforeEach(func() {
+					newHandler(handlers.StagingLimits{})
+
+					fakeDiegoClient.TasksByDomainReturns([]*models.Task{
+						{
+							TaskGuid: "older-guid",
+							State:    models.Task_Running,
+							TaskDefinition: &models.TaskDefinition{
+								Annotation: `{"lifecycle":"fake-backend","app_id":"myapp","completion_callback":"http://cc/older-guid"}`,
+							},
+						},
+					}, nil)
+					fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "a-guid", "a-domain", nil)
+				})
+
+				It("cancels the older task after desiring the new one", func() {
+					Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+					Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+					Expect(fakeDiegoClient.CancelTaskCallCount()).To(Equal(1))
+					_, taskGuid := fakeDiegoClient.CancelTaskArgsForCall(0)
+					Expect(taskGuid).To(Equal("older-guid"))
+				})
+
+				It("shares the limiter's task listing with the coalescer", func() {
+					Expect(fakeDiegoClient.TasksByDomainCallCount()).To(Equal(1))
+				})
+
+				Context("when the new task is not admitted", func() {
+					BeforeEach(func() {
+						newHandler(handlers.StagingLimits{MaxInFlightPerApp: 1})
+					})
+
+					It("keeps the older task", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusTooManyRequests))
+						Expect(fakeDiegoClient.CancelTaskCallCount()).To(Equal(0))
+						Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when desiring the new task fails", func() {
+					BeforeEach(func() {
+						fakeDiegoClient.DesireTaskReturns(errors.New("boom"))
+					})
+
+					It("keeps the older task", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
+						Expect(fakeDiegoClient.CancelTaskCallCount()).To(Equal(0))
+						Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the new request is queued", func() {
+					var (
+						queue     *handlers.StagingQueue
+						coalescer *handlers.StagingCoalescer
+					)
+
+					BeforeEach(func() {
+						queue = handlers.NewStagingQueue(logger, 1, 1)
+						limiter := handlers.NewStagingLimiter(logger, fakeDiegoClient, clock.NewClock(), "a-domain", handlers.StagingLimits{})
+						var err error
+						coalescer, err = handlers.NewStagingCoalescer(logger, fakeDiegoClient, fakeCCClient, limiter, "a-domain", handlers.CoalescePolicyCancelOlder)
+						Expect(err).NotTo(HaveOccurred())
+						handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, queue, limiter, coalescer, nil)
+					})
+
+					It("keeps the older task while the new one is queued", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+						Expect(fakeDiegoClient.CancelTaskCallCount()).To(Equal(0))
+						Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(0))
+					})
+
+					It("cancels the older task once the new one has been desired", func() {
+						process := ifrit.Invoke(queue)
+						defer ginkgomon.Interrupt(process)
+
+						Eventually(fakeDiegoClient.CancelTaskCallCount).Should(Equal(1))
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+						_, taskGuid := fakeDiegoClient.CancelTaskArgsForCall(0)
+						Expect(taskGuid).To(Equal("older-guid"))
+					})
+
+					Context("when a newer request supersedes the queued one", func() {
+						It("does not desire the queued task", func() {
+							coalescer.Supersede([]handlers.DuplicateStagingTask{{TaskGuid: "a-guid"}})
+
+							process := ifrit.Invoke(queue)
+							defer ginkgomon.Interrupt(process)
+
+							Eventually(queue.Len).Should(Equal(0))
+							Consistently(fakeDiegoClient.DesireTaskCallCount).Should(Equal(0))
+						})
+					})
+
+					Context("when the queue is flushed before the new task is desired", func() {
+						It("keeps the older task", func() {
+							Expect(queue.Flush()).To(Equal(1))
+
+							Expect(fakeDiegoClient.CancelTaskCallCount()).To(Equal(0))
+							Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
+							guid, _, _, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+							Expect(guid).To(Equal("a-staging-guid"))
+						})
+					})
+
+					Context("when desiring the new task fails", func() {
+						BeforeEach(func() {
+							fakeDiegoClient.DesireTaskReturns(errors.New("boom"))
+						})
+
+						It("keeps the older task", func() {
+							process := ifrit.Invoke(queue)
+							defer ginkgomon.Interrupt(process)
+
+							Eventually(fakeCCClient.StagingCompleteCallCount).Should(Equal(1))
+							guid, _, _, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+							Expect(guid).To(Equal("a-staging-guid"))
+							Consistently(fakeDiegoClient.CancelTaskCallCount).Should(Equal(0))
+						})
+					})
+				})
+			})
+
+			Context("when staging limits are configured", func() {
+				BeforeEach(func() {
+					limiter := handlers.NewStagingLimiter(logger, fakeDiegoClient, clock.NewClock(), "a-domain", handlers.StagingLimits{MaxInFlightPerApp: 1})
+					handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, nil, limiter, nil, nil)
+
+					fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "a-guid", "a-domain", nil)
+				})
+
+				Context("when the app is below its limit", func() {
+					It("desires the task", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+						Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+					})
+				})
+
+				Context("when the app is at its limit", func() {
+					BeforeEach(func() {
+						fakeDiegoClient.TasksByDomainReturns([]*models.Task{
+							{
+								TaskGuid: "another-guid",
+								State:    models.Task_Running,
+								TaskDefinition: &models.TaskDefinition{
+									Annotation: `{"lifecycle":"fake-backend","app_id":"myapp"}`,
+								},
+							},
+						}, nil)
+					})
+
+					It("does not desire the task", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(0))
+					})
+
+					It("returns Too Many Requests with a StagingLimitExceeded error", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusTooManyRequests))
+
+						var response cc_messages.StagingResponseForCC
+						Expect(json.NewDecoder(responseRecorder.Body).Decode(&response)).To(Succeed())
+						Expect(response.Error.Id).To(Equal(backend.STAGING_LIMIT_EXCEEDED))
+					})
+				})
+			})
+
+			Context("when an intake queue is configured", func() {
+				var (
+					queue   *handlers.StagingQueue
+					process ifrit.Process
+				)
+
+				BeforeEach(func() {
+					queue = handlers.NewStagingQueue(logger, 1, 1)
+					handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, queue, nil, nil, nil)
+
+					fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "a-guid", "a-domain", nil)
+				})
+
+				Context("when the queue is being processed", func() {
+					BeforeEach(func() {
+						process = ifrit.Invoke(queue)
+					})
+
+					AfterEach(func() {
+						ginkgomon.Interrupt(process)
+					})
+
+					It("returns an Accepted response", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusAccepted))
+					})
+
+					It("queues the request with the priority the backend classifies it with", func() {
+						Expect(fakeBackend.PriorityCallCount()).To(Equal(1))
+						Expect(fakeBackend.PriorityArgsForCall(0).AppId).To(Equal("myapp"))
+					})
+
+					auditedEvents := func() map[string]audit.Event {
+						Eventually(fakeAuditor.RecordCallCount).Should(Equal(2))
+						events := map[string]audit.Event{}
+						for i := 0; i < fakeAuditor.RecordCallCount(); i++ {
+							event := fakeAuditor.RecordArgsForCall(i)
+							events[event.Action] = event
+						}
+						return events
+					}
+
+					It("desires the task asynchronously", func() {
+						Eventually(fakeDiegoClient.DesireTaskCallCount).Should(Equal(1))
+					})
+
+					It("audits the request as accepted and then the outcome of desiring its task", func() {
+						events := auditedEvents()
+						Expect(events[audit.ActionStage].Outcome).To(Equal(audit.OutcomeAccepted))
+						Expect(events[audit.ActionDesireQueuedTask].StagingGuid).To(Equal("a-staging-guid"))
+						Expect(events[audit.ActionDesireQueuedTask].Outcome).To(Equal(audit.OutcomeSuccess))
+					})
+
+					Context("when desiring the task fails", func() {
+						BeforeEach(func() {
+							fakeDiegoClient.DesireTaskReturns(errors.New("some task create error"))
+						})
+
+						It("reports the failure to CC", func() {
+							Eventually(fakeCCClient.StagingCompleteCallCount).Should(Equal(1))
+
+							guid, _, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+							Expect(guid).To(Equal("a-staging-guid"))
+
+							var response cc_messages.StagingResponseForCC
+							Expect(json.Unmarshal(payload, &response)).To(Succeed())
+							Expect(response.Error).To(Equal(backend.SanitizeErrorMessage("some task create error")))
+						})
+
+						It("audits the failure", func() {
+							events := auditedEvents()
+							Expect(events[audit.ActionDesireQueuedTask].Outcome).To(Equal(audit.OutcomeFailure))
+						})
+					})
+				})
+
+				Context("when a drainer is configured", func() {
+					var (
+						drainer      *handlers.Drainer
+						drainerClock *fakeclock.FakeClock
+					)
+
+					BeforeEach(func() {
+						drainerClock = fakeclock.NewFakeClock(time.Now())
+						drainer = handlers.NewDrainer(logger, drainerClock, time.Minute, queue.Flush)
+						handler = handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, fakeCCClient, clock.NewClock(), tracer, fakeAuditor, retryPolicy, queue, nil, nil, drainer)
+					})
+
+					It("does not finish draining until the queued task has been desired", func() {
+						drainerProcess := ifrit.Invoke(drainer)
+						drainerProcess.Signal(os.Interrupt)
+						Consistently(drainerProcess.Wait()).ShouldNot(Receive())
+
+						process = ifrit.Invoke(queue)
+						defer ginkgomon.Interrupt(process)
+
+						Eventually(drainerProcess.Wait()).Should(Receive(BeNil()))
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(1))
+					})
+
+					It("reports the queued task to CC as interrupted when the grace period expires", func() {
+						Expect(queue.Len()).To(Equal(1))
+
+						drainerProcess := ifrit.Invoke(drainer)
+						drainerProcess.Signal(os.Interrupt)
+						drainerClock.WaitForWatcherAndIncrement(time.Minute)
+						Eventually(drainerProcess.Wait()).Should(Receive(BeNil()))
+
+						Expect(queue.Len()).To(Equal(0))
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(0))
+						Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
+
+						_, _, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+						var response cc_messages.StagingResponseForCC
+						Expect(json.Unmarshal(payload, &response)).To(Succeed())
+						Expect(response.Error.Id).To(Equal(diego_errors.STAGING_INTERRUPTED_ID))
+					})
+				})
+
+				Context("when the queue is flushed before the task is desired", func() {
+					It("reports the request to CC as interrupted", func() {
+						Expect(queue.Flush()).To(Equal(1))
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(0))
+						Expect(fakeCCClient.StagingCompleteCallCount()).To(Equal(1))
+
+						guid, _, payload, _, _ := fakeCCClient.StagingCompleteArgsForCall(0)
+						Expect(guid).To(Equal("a-staging-guid"))
+
+						var response cc_messages.StagingResponseForCC
+						Expect(json.Unmarshal(payload, &response)).To(Succeed())
+						Expect(response.Error).To(Equal(&cc_messages.StagingError{
+							Id:      diego_errors.STAGING_INTERRUPTED_ID,
+							Message: diego_errors.STAGING_INTERRUPTED_MESSAGE,
+						}))
+					})
+				})
+
+				Context("when the queue is full", func() {
+					BeforeEach(func() {
+						Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+					})
+
+					It("returns Service Unavailable with a Retry-After header", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusServiceUnavailable))
+						Expect(responseRecorder.Header().Get("Retry-After")).To(Equal(handlers.StagingQueueRetryAfter))
+					})
+
+					It("does not desire the task", func() {
+						Expect(fakeDiegoClient.DesireTaskCallCount()).To(Equal(0))
+					})
+
+					It("responds with a StagingQueueFull error and counts the failure", func() {
+						var response cc_messages.StagingResponseForCC
+						Expect(json.NewDecoder(responseRecorder.Body).Decode(&response)).To(Succeed())
+						Expect(response.Error.Id).To(Equal(diego_errors.STAGING_QUEUE_FULL_ID))
+						Expect(fakeMetricSender.GetCounter("StagingFailed" + diego_errors.STAGING_QUEUE_FULL_ID)).To(Equal(uint64(1)))
+					})
+				})
+			})
+
 			Context("when the recipe failed to be built", func() {
 				var buildRecipeError error
 
@@ -167,6 +725,24 @@ var _ = Describe("StagingHandler", func() {
 					Expect(logger).To(gbytes.Say("recipe-building-failed"))
 				})
 
+				Context("when the request carries an environment", func() {
+					BeforeEach(func() {
+						stagingRequest.Environment = []*models.EnvironmentVariable{{Name: "DATABASE_URL", Value: "postgres://user:secret@db"}}
+
+						var err error
+						stagingRequestJson, err = json.Marshal(stagingRequest)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("logs only the app id, staging guid and lifecycle of the request", func() {
+						logs := string(logger.(*lagertest.TestLogger).Buffer().Contents())
+						Expect(logs).To(ContainSubstring(`"app-id":"myapp"`))
+						Expect(logs).To(ContainSubstring(`"lifecycle":"fake-backend"`))
+						Expect(logs).To(ContainSubstring(`"staging-guid":"a-staging-guid"`))
+						Expect(logs).NotTo(ContainSubstring("secret@db"))
+					})
+				})
+
 				It("returns an internal service error status code", func() {
 					Expect(responseRecorder.Code).To(Equal(http.StatusInternalServerError))
 				})
@@ -189,6 +765,29 @@ var _ = Describe("StagingHandler", func() {
 						Expect(response).To(Equal(responseForCC))
 					})
 				})
+
+				Context("when the recipe is rejected with a catalogued error", func() {
+					BeforeEach(func() {
+						fakeBackend.BuildRecipeReturns(&models.TaskDefinition{}, "", "", backend.ErrMissingAppId)
+					})
+
+					It("responds with the error's status and a structured body", func() {
+						Expect(responseRecorder.Code).To(Equal(http.StatusUnprocessableEntity))
+						Expect(responseRecorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+						var response handlers.ErrorResponse
+						Expect(json.NewDecoder(responseRecorder.Body).Decode(&response)).To(Succeed())
+						Expect(response).To(Equal(handlers.ErrorResponse{
+							Code:    "missing_app_id",
+							Message: diego_errors.MISSING_APP_ID_MESSAGE,
+							Field:   "app_id",
+							Error: &cc_messages.StagingError{
+								Id:      cc_messages.STAGING_ERROR,
+								Message: diego_errors.MISSING_APP_ID_MESSAGE,
+							},
+						}))
+					})
+				})
 			})
 		})
 
@@ -201,6 +800,13 @@ var _ = Describe("StagingHandler", func() {
 				It("returns bad request", func() {
 					Expect(responseRecorder.Code).To(Equal(http.StatusBadRequest))
 				})
+
+				It("describes the error in the body", func() {
+					var response handlers.ErrorResponse
+					Expect(json.NewDecoder(responseRecorder.Body).Decode(&response)).To(Succeed())
+					Expect(response.Code).To(Equal("invalid_staging_request"))
+					Expect(response.Message).To(HavePrefix(diego_errors.INVALID_STAGING_REQUEST_MESSAGE))
+				})
 			})
 
 			Context("when a staging request is received for an unknown backend", func() {
@@ -218,6 +824,23 @@ var _ = Describe("StagingHandler", func() {
 				It("returns a Not Found response", func() {
 					Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
 				})
+
+				It("lists the supported lifecycles in the body", func() {
+					var response handlers.ErrorResponse
+					Expect(json.NewDecoder(responseRecorder.Body).Decode(&response)).To(Succeed())
+					Expect(response.Code).To(Equal("unknown_lifecycle"))
+					Expect(response.Message).To(Equal("unknown lifecycle: 'unknown-backend'"))
+					Expect(response.Field).To(Equal("lifecycle"))
+					Expect(response.SupportedLifecycles).To(Equal([]string{"fake-backend"}))
+				})
+
+				It("does not count a staging failure", func() {
+					Expect(fakeMetricSender.GetCounter("StagingFailed" + cc_messages.STAGING_ERROR)).To(BeZero())
+				})
+
+				It("ends the stage span with the error", func() {
+					Expect(spans).To(gbytes.Say(`"name":"stage".*"status":\{"code":2,"message":"unknown lifecycle: 'unknown-backend'"\}`))
+				})
 			})
 
 			Context("when a malformed staging request is received", func() {
@@ -266,6 +889,14 @@ var _ = Describe("StagingHandler", func() {
 				It("returns StatusNotFound", func() {
 					Expect(responseRecorder.Code).To(Equal(http.StatusNotFound))
 				})
+
+				It("records the failed request in the audit log", func() {
+					Expect(fakeAuditor.RecordCallCount()).To(Equal(1))
+					event := fakeAuditor.RecordArgsForCall(0)
+					Expect(event.Action).To(Equal(audit.ActionStopStaging))
+					Expect(event.StagingGuid).To(Equal("a-staging-guid"))
+					Expect(event.Outcome).To(Equal(audit.OutcomeFailure))
+				})
 			})
 
 			Context("when retrieving the current task fails", func() {
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/diego_errors"
+	"code.cloudfoundry.org/stager/stager_metrics"
+)
+
+const (
+	StagingRequestsThrottledCounter = stager_metrics.Counter("StagingRequestsThrottled")
+
+	DefaultStagingLimitsCacheTTL = 5 * time.Second
+)
+
+var ErrStagingLimitExceeded = diego_errors.StagingLimitExceeded
+
+// StagingLimits caps the number of staging tasks in flight. A zero limit is
+// unlimited.
+type StagingLimits struct {
+	MaxInFlight                    int
+	MaxInFlightPerApp              int
+	MaxInFlightPerIsolationSegment int
+	CacheTTL                       time.Duration
+}
+
+func (l StagingLimits) Enabled() bool {
+	return l.MaxInFlight > 0 || l.MaxInFlightPerApp > 0 || l.MaxInFlightPerIsolationSegment > 0
+}
+
+type inFlightTask struct {
+	appId            string
+	isolationSegment string
+	desiredAt        time.Time
+	annotation       backend.StagingTaskAnnotation
+}
+
+// StagingLimiter admits staging tasks while the configured limits allow it.
+// In-flight tasks are counted from the BBS task listing for the staging
+// domain, refreshed at most once per CacheTTL, plus the tasks this stager has
+// admitted that the listing does not reflect yet. The listing is requested
+// without holding the lock, by one request at a time, and a failed listing is
+// not retried until the CacheTTL has passed again.
+type StagingLimiter struct {
+	logger    lager.Logger
+	bbsClient bbs.Client
+	clock     clock.Clock
+	domain    string
+	limits    StagingLimits
+
+	lock       sync.Mutex
+	syncedAt   time.Time
+	refreshing chan struct{}
+	listed     map[string]inFlightTask
+	admitted   map[string]inFlightTask
+}
+
+func NewStagingLimiter(logger lager.Logger, bbsClient bbs.Client, clock clock.Clock, domain string, limits StagingLimits) *StagingLimiter {
+	if limits.CacheTTL <= 0 {
+		limits.CacheTTL = DefaultStagingLimitsCacheTTL
+	}
+
+	return &StagingLimiter{
+		logger:    logger.Session("staging-limiter"),
+		bbsClient: bbsClient,
+		clock:     clock,
+		domain:    domain,
+		limits:    limits,
+		listed:    map[string]inFlightTask{},
+		admitted:  map[string]inFlightTask{},
+	}
+}
+
+// Admit records the task as in flight if doing so would not exceed any of the
+// limits, and returns an error wrapping ErrStagingLimitExceeded otherwise.
+// Tasks that are already in flight are always admitted. The annotation is
+// kept so that the task is reported by InFlightTasks before it is listed.
+func (l *StagingLimiter) Admit(taskGuid string, annotation backend.StagingTaskAnnotation) error {
+	logger := l.logger.Session("admit", lager.Data{"task-guid": taskGuid})
+	appId, isolationSegment := annotation.AppId, annotation.IsolationSegment
+
+	l.refresh(logger)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.listed[taskGuid]; ok {
+		return nil
+	}
+	if _, ok := l.admitted[taskGuid]; ok {
+		return nil
+	}
+
+	total, perApp, perSegment := 0, 0, 0
+	count := func(task inFlightTask) {
+		total++
+		if task.appId == appId {
+			perApp++
+		}
+		if task.isolationSegment == isolationSegment {
+			perSegment++
+		}
+	}
+	for _, task := range l.listed {
+		count(task)
+	}
+	for _, task := range l.admitted {
+		count(task)
+	}
+
+	var err error
+	switch {
+	case l.limits.MaxInFlight > 0 && total >= l.limits.MaxInFlight:
+		err = ErrStagingLimitExceeded.WithDetail("%d staging tasks in flight", total)
+	case l.limits.MaxInFlightPerApp > 0 && perApp >= l.limits.MaxInFlightPerApp:
+		err = ErrStagingLimitExceeded.WithDetail("%d staging tasks in flight for app %s", perApp, appId)
+	case l.limits.MaxInFlightPerIsolationSegment > 0 && perSegment >= l.limits.MaxInFlightPerIsolationSegment:
+		err = ErrStagingLimitExceeded.WithDetail("%d staging tasks in flight for isolation segment '%s'", perSegment, isolationSegment)
+	}
+
+	if err != nil {
+		logger.Info("staging-limit-exceeded", lager.Data{
+			"app-id":            appId,
+			"isolation-segment": isolationSegment,
+			"reason":            err.Error(),
+		})
+		StagingRequestsThrottledCounter.Increment()
+		return err
+	}
+
+	l.admitted[taskGuid] = inFlightTask{
+		appId:            appId,
+		isolationSegment: isolationSegment,
+		annotation:       annotation,
+	}
+	return nil
+}
+
+// Desired marks an admitted task as desired on the BBS, after which the next
+// task listing is authoritative for it.
+func (l *StagingLimiter) Desired(taskGuid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if task, ok := l.admitted[taskGuid]; ok {
+		task.desiredAt = l.clock.Now()
+		l.admitted[taskGuid] = task
+	}
+}
+
+// Release forgets a task this stager admitted, e.g. because desiring it
+// failed.
+func (l *StagingLimiter) Release(taskGuid string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.admitted, taskGuid)
+	delete(l.listed, taskGuid)
+}
+
+// InFlightTasks returns the annotations of the staging tasks in flight
+// according to the cached BBS listing, and of the tasks this stager has
+// admitted since, keyed by task guid.
+func (l *StagingLimiter) InFlightTasks(logger lager.Logger) map[string]backend.StagingTaskAnnotation {
+	l.refresh(logger)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	inFlight := map[string]backend.StagingTaskAnnotation{}
+	for guid, task := range l.listed {
+		inFlight[guid] = task.annotation
+	}
+	for guid, task := range l.admitted {
+		inFlight[guid] = task.annotation
+	}
+	return inFlight
+}
+
+// refresh lists the in-flight tasks if the cached listing has expired. If
+// another request is already listing them it waits for that listing instead.
+func (l *StagingLimiter) refresh(logger lager.Logger) {
+	l.lock.Lock()
+	now := l.clock.Now()
+	if now.Sub(l.syncedAt) < l.limits.CacheTTL {
+		l.lock.Unlock()
+		return
+	}
+	if refreshing := l.refreshing; refreshing != nil {
+		l.lock.Unlock()
+		<-refreshing
+		return
+	}
+	refreshing := make(chan struct{})
+	l.refreshing = refreshing
+	l.lock.Unlock()
+
+	tasks, err := l.bbsClient.TasksByDomain(logger, l.domain)
+
+	l.lock.Lock()
+	defer func() {
+		l.refreshing = nil
+		close(refreshing)
+		l.lock.Unlock()
+	}()
+
+	// a failed listing is not retried until the TTL has passed again, so
+	// that a BBS outage is not made worse by every staging request; the last
+	// listing keeps counting in the meantime
+	l.syncedAt = now
+	if err != nil {
+		logger.Error("failed-to-list-staging-tasks", err)
+		return
+	}
+
+	listed := map[string]inFlightTask{}
+	for _, task := range tasks {
+		if task.State != models.Task_Pending && task.State != models.Task_Running {
+			continue
+		}
+		listed[task.TaskGuid] = inFlightTaskFromTask(task)
+	}
+
+	// tasks desired before the listing was requested are either in the
+	// listing or are no longer in flight; tasks still waiting to be desired
+	// are not visible to the BBS yet and keep counting locally
+	for guid, task := range l.admitted {
+		if _, ok := listed[guid]; ok || (!task.desiredAt.IsZero() && task.desiredAt.Before(now)) {
+			delete(l.admitted, guid)
+		}
+	}
+
+	l.listed = listed
+}
+
+func inFlightTaskFromTask(task *models.Task) inFlightTask {
+	if task.TaskDefinition == nil {
+		return inFlightTask{}
+	}
+
+	var annotation backend.StagingTaskAnnotation
+	json.Unmarshal([]byte(task.Annotation), &annotation)
+
+	return inFlightTask{
+		appId:            annotation.AppId,
+		isolationSegment: annotation.IsolationSegment,
+		annotation:       annotation,
+	}
+}
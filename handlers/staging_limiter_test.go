@@ -0,0 +1,243 @@
+package handlers_test
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/bbs/fake_bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/backend"
+	"code.cloudfoundry.org/stager/diego_errors"
+	"code.cloudfoundry.org/stager/handlers"
+	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StagingLimiter", func() {
+	var (
+		fakeMetricSender *fake_metric_sender.FakeMetricSender
+		fakeBBSClient    *fake_bbs.FakeClient
+		fakeClock        *fakeclock.FakeClock
+		limits           handlers.StagingLimits
+		limiter          *handlers.StagingLimiter
+	)
+
+	stagingTask := func(guid, appId, isolationSegment string, state models.Task_State) *models.Task {
+		return &models.Task{
+			TaskGuid: guid,
+			State:    state,
+			TaskDefinition: &models.TaskDefinition{
+				Annotation: `{"lifecycle":"buildpack","app_id":"` + appId + `","isolation_segment":"` + isolationSegment + `"}`,
+				// placement tags are not necessarily the isolation segment
+				PlacementTags: []string{"other-placement-tag"},
+			},
+		}
+	}
+
+	stagingAnnotation := func(appId, isolationSegment string) backend.StagingTaskAnnotation {
+		annotation := backend.StagingTaskAnnotation{AppId: appId, IsolationSegment: isolationSegment}
+		annotation.Lifecycle = "buildpack"
+		return annotation
+	}
+
+	BeforeEach(func() {
+		fakeMetricSender = fake_metric_sender.NewFakeMetricSender()
+		metrics.Initialize(fakeMetricSender, nil)
+
+		fakeBBSClient = &fake_bbs.FakeClient{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		limits = handlers.StagingLimits{CacheTTL: time.Second}
+	})
+
+	JustBeforeEach(func() {
+		limiter = handlers.NewStagingLimiter(lagertest.NewTestLogger("test"), fakeBBSClient, fakeClock, "staging-domain", limits)
+	})
+
+	It("lists the tasks in the staging domain", func() {
+		Expect(limiter.Admit("guid", stagingAnnotation("app", ""))).To(Succeed())
+
+		Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+		_, domain := fakeBBSClient.TasksByDomainArgsForCall(0)
+		Expect(domain).To(Equal("staging-domain"))
+	})
+
+	Context("with a global limit", func() {
+		BeforeEach(func() {
+			limits.MaxInFlight = 2
+			fakeBBSClient.TasksByDomainReturns([]*models.Task{
+				stagingTask("running-guid", "app-1", "", models.Task_Running),
+				stagingTask("completed-guid", "app-2", "", models.Task_Completed),
+			}, nil)
+		})
+
+		It("counts pending and running tasks and the tasks it admitted", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+
+			err := limiter.Admit("guid-2", stagingAnnotation("app-4", ""))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(diego_errors.STAGING_LIMIT_EXCEEDED_MESSAGE))
+			Expect(fakeMetricSender.GetCounter("StagingRequestsThrottled")).To(Equal(uint64(1)))
+		})
+
+		It("always admits tasks that are already in flight", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+			Expect(limiter.Admit("running-guid", stagingAnnotation("app-1", ""))).To(Succeed())
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+		})
+
+		It("stops counting released tasks", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+			limiter.Release("guid-1")
+			Expect(limiter.Admit("guid-2", stagingAnnotation("app-4", ""))).To(Succeed())
+		})
+
+		It("caches the task listing", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+			limiter.Release("guid-1")
+			Expect(limiter.Admit("guid-2", stagingAnnotation("app-4", ""))).To(Succeed())
+			Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+		})
+
+		Context("when the listing expires", func() {
+			It("relies on the listing for tasks that have been desired", func() {
+				Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+				limiter.Desired("guid-1")
+
+				fakeClock.Increment(2 * time.Second)
+				Expect(limiter.Admit("guid-2", stagingAnnotation("app-4", ""))).To(Succeed())
+				Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(2))
+			})
+
+			It("keeps counting tasks that have not been desired yet", func() {
+				Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+
+				fakeClock.Increment(2 * time.Second)
+				Expect(limiter.Admit("guid-2", stagingAnnotation("app-4", ""))).NotTo(Succeed())
+			})
+		})
+
+		Context("when listing the tasks fails", func() {
+			BeforeEach(func() {
+				fakeBBSClient.TasksByDomainReturns(nil, errors.New("boom"))
+			})
+
+			It("admits based on the tasks it admitted", func() {
+				Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+				Expect(limiter.Admit("guid-2", stagingAnnotation("app-4", ""))).To(Succeed())
+				Expect(limiter.Admit("guid-3", stagingAnnotation("app-5", ""))).NotTo(Succeed())
+			})
+
+			It("does not list the tasks again until the listing expires", func() {
+				Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+				limiter.Release("guid-1")
+				Expect(limiter.Admit("guid-2", stagingAnnotation("app-4", ""))).To(Succeed())
+				Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+
+				fakeClock.Increment(2 * time.Second)
+				limiter.Admit("guid-3", stagingAnnotation("app-5", ""))
+				Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(2))
+			})
+		})
+
+		Context("when tasks are admitted while the tasks are being listed", func() {
+			var release chan struct{}
+
+			BeforeEach(func() {
+				release = make(chan struct{})
+				fakeBBSClient.TasksByDomainStub = func(lager.Logger, string) ([]*models.Task, error) {
+					<-release
+					return nil, nil
+				}
+			})
+
+			It("lists the tasks once for all of them", func() {
+				admitted := make(chan error, 2)
+				for _, guid := range []string{"guid-1", "guid-2"} {
+					go func(guid string) {
+						defer GinkgoRecover()
+						admitted <- limiter.Admit(guid, stagingAnnotation("app-"+guid, ""))
+					}(guid)
+				}
+
+				Eventually(fakeBBSClient.TasksByDomainCallCount).Should(Equal(1))
+				Consistently(fakeBBSClient.TasksByDomainCallCount).Should(Equal(1))
+				Expect(admitted).To(BeEmpty())
+
+				close(release)
+				Eventually(admitted).Should(HaveLen(2))
+				Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Context("with a per app limit", func() {
+		BeforeEach(func() {
+			limits.MaxInFlightPerApp = 1
+			fakeBBSClient.TasksByDomainReturns([]*models.Task{
+				stagingTask("running-guid", "app-1", "", models.Task_Pending),
+			}, nil)
+		})
+
+		It("rejects tasks for apps at their limit", func() {
+			err := limiter.Admit("guid-1", stagingAnnotation("app-1", ""))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("app-1"))
+		})
+
+		It("admits tasks for other apps", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-2", ""))).To(Succeed())
+		})
+	})
+
+	Context("with a per isolation segment limit", func() {
+		BeforeEach(func() {
+			limits.MaxInFlightPerIsolationSegment = 1
+			fakeBBSClient.TasksByDomainReturns([]*models.Task{
+				stagingTask("running-guid", "app-1", "segment-1", models.Task_Running),
+			}, nil)
+		})
+
+		It("rejects tasks for isolation segments at their limit", func() {
+			err := limiter.Admit("guid-1", stagingAnnotation("app-2", "segment-1"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("segment-1"))
+		})
+
+		It("admits tasks for other isolation segments", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-2", "segment-2"))).To(Succeed())
+			Expect(limiter.Admit("guid-2", stagingAnnotation("app-3", ""))).To(Succeed())
+		})
+	})
+
+	Describe("InFlightTasks", func() {
+		BeforeEach(func() {
+			fakeBBSClient.TasksByDomainReturns([]*models.Task{
+				stagingTask("running-guid", "app-1", "", models.Task_Running),
+				stagingTask("completed-guid", "app-2", "", models.Task_Completed),
+			}, nil)
+		})
+
+		It("returns the listed tasks and the tasks admitted since", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", "segment-1"))).To(Succeed())
+
+			inFlight := limiter.InFlightTasks(lagertest.NewTestLogger("test"))
+			Expect(fakeBBSClient.TasksByDomainCallCount()).To(Equal(1))
+			Expect(inFlight).To(HaveLen(2))
+			Expect(inFlight["running-guid"].AppId).To(Equal("app-1"))
+			Expect(inFlight["guid-1"]).To(Equal(stagingAnnotation("app-3", "segment-1")))
+		})
+
+		It("no longer returns admitted tasks that are released", func() {
+			Expect(limiter.Admit("guid-1", stagingAnnotation("app-3", ""))).To(Succeed())
+			limiter.Release("guid-1")
+
+			Expect(limiter.InFlightTasks(lagertest.NewTestLogger("test"))).NotTo(HaveKey("guid-1"))
+		})
+	})
+})
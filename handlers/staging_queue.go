@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"container/heap"
+	"os"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/stager_metrics"
+)
+
+const (
+	StagingRequestsQueuedCounter   = stager_metrics.Counter("StagingRequestsQueued")
+	StagingRequestsRejectedCounter = stager_metrics.Counter("StagingRequestsRejected")
+
+	// StagingQueueRetryAfter is the Retry-After value, in seconds, returned to
+	// CC when the intake queue is full.
+	StagingQueueRetryAfter = "5"
+)
+
+// StagingQueue buffers accepted staging requests and processes them with a
+// fixed pool of workers, so that a burst of staging requests does not turn
+// into a burst of concurrent BBS requests. Jobs with a higher priority are
+// processed first; jobs of equal priority are processed in order. Jobs still
+// queued when the queue is flushed or stopped are abandoned instead, so that
+// accepted requests are never dropped silently.
+type StagingQueue struct {
+	logger  lager.Logger
+	size    int
+	workers int
+
+	lock     sync.Mutex
+	jobs     stagingJobHeap
+	sequence uint64
+	pending  chan struct{}
+}
+
+type stagingJob struct {
+	priority int
+	sequence uint64
+	run      func()
+	abandon  func()
+}
+
+type stagingJobHeap []stagingJob
+
+func (h stagingJobHeap) Len() int { return len(h) }
+
+func (h stagingJobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].sequence < h[j].sequence
+}
+
+func (h stagingJobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *stagingJobHeap) Push(x interface{}) { *h = append(*h, x.(stagingJob)) }
+
+func (h *stagingJobHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return job
+}
+
+func NewStagingQueue(logger lager.Logger, size, workers int) *StagingQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	return &StagingQueue{
+		logger:  logger.Session("staging-queue"),
+		size:    size,
+		workers: workers,
+		pending: make(chan struct{}, size),
+	}
+}
+
+// Enqueue adds the job to the queue, returning false if the queue is full.
+// abandon is called instead of run if the job is flushed from the queue.
+func (q *StagingQueue) Enqueue(priority int, run, abandon func()) bool {
+	q.lock.Lock()
+	if q.jobs.Len() >= q.size {
+		q.lock.Unlock()
+		StagingRequestsRejectedCounter.Increment()
+		return false
+	}
+
+	q.sequence++
+	heap.Push(&q.jobs, stagingJob{priority: priority, sequence: q.sequence, run: run, abandon: abandon})
+	q.lock.Unlock()
+
+	// Flushed jobs leave their tokens behind, so the buffer may already be
+	// full; there is then a token for every queued job, including this one.
+	select {
+	case q.pending <- struct{}{}:
+	default:
+	}
+	StagingRequestsQueuedCounter.Increment()
+	return true
+}
+
+// Len returns the number of jobs waiting to be processed.
+func (q *StagingQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.jobs.Len()
+}
+
+// next returns the next job to run, or nil if the job was flushed before a
+// worker picked it up.
+func (q *StagingQueue) next() func() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.jobs.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&q.jobs).(stagingJob).run
+}
+
+// Flush abandons every queued job, returning the number abandoned. Workers
+// that pick up the tokens of flushed jobs find nothing to run.
+func (q *StagingQueue) Flush() int {
+	q.lock.Lock()
+	jobs := q.jobs
+	q.jobs = nil
+	q.lock.Unlock()
+
+	for _, job := range jobs {
+		if job.abandon != nil {
+			job.abandon()
+		}
+	}
+	return len(jobs)
+}
+
+func (q *StagingQueue) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	logger := q.logger.Session("run", lager.Data{"workers": q.workers})
+	logger.Info("starting")
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-q.pending:
+					if run := q.next(); run != nil {
+						run()
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	close(ready)
+	logger.Info("started")
+
+	<-signals
+	abandoned := q.Flush()
+	logger.Info("stopping", lager.Data{"abandoned-requests": abandoned})
+
+	close(done)
+	wg.Wait()
+
+	logger.Info("stopped")
+	return nil
+}
@@ -0,0 +1,170 @@
+package handlers_test
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/handlers"
+	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StagingQueue", func() {
+	var (
+		fakeMetricSender *fake_metric_sender.FakeMetricSender
+		queue            *handlers.StagingQueue
+	)
+
+	BeforeEach(func() {
+		fakeMetricSender = fake_metric_sender.NewFakeMetricSender()
+		metrics.Initialize(fakeMetricSender, nil)
+
+		queue = handlers.NewStagingQueue(lagertest.NewTestLogger("test"), 2, 2)
+	})
+
+	Describe("Enqueue", func() {
+		It("accepts jobs until the queue is full", func() {
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeFalse())
+
+			Expect(fakeMetricSender.GetCounter("StagingRequestsQueued")).To(Equal(uint64(2)))
+			Expect(fakeMetricSender.GetCounter("StagingRequestsRejected")).To(Equal(uint64(1)))
+		})
+	})
+
+	Describe("ordering", func() {
+		It("processes higher priority jobs first and equal priorities in order", func() {
+			queue = handlers.NewStagingQueue(lagertest.NewTestLogger("test"), 4, 1)
+
+			processed := make(chan string, 4)
+			enqueue := func(priority int, name string) {
+				Expect(queue.Enqueue(priority, func() { processed <- name }, nil)).To(BeTrue())
+			}
+			enqueue(0, "low-1")
+			enqueue(10, "high-1")
+			enqueue(0, "low-2")
+			enqueue(10, "high-2")
+
+			process := ginkgomon.Invoke(queue)
+			defer ginkgomon.Interrupt(process)
+
+			Eventually(processed).Should(HaveLen(4))
+			Expect(<-processed).To(Equal("high-1"))
+			Expect(<-processed).To(Equal("high-2"))
+			Expect(<-processed).To(Equal("low-1"))
+			Expect(<-processed).To(Equal("low-2"))
+		})
+	})
+
+	Describe("Run", func() {
+		var process ifrit.Process
+
+		BeforeEach(func() {
+			process = ginkgomon.Invoke(queue)
+		})
+
+		AfterEach(func() {
+			ginkgomon.Interrupt(process)
+		})
+
+		It("processes queued jobs", func() {
+			processed := make(chan struct{}, 3)
+			for i := 0; i < 3; i++ {
+				Eventually(func() bool {
+					return queue.Enqueue(0, func() { processed <- struct{}{} }, nil)
+				}).Should(BeTrue())
+			}
+
+			Eventually(processed).Should(HaveLen(3))
+		})
+
+		It("processes jobs concurrently with the configured number of workers", func() {
+			release := make(chan struct{})
+			started := make(chan struct{}, 2)
+			for i := 0; i < 2; i++ {
+				Expect(queue.Enqueue(0, func() {
+					started <- struct{}{}
+					<-release
+				}, nil)).To(BeTrue())
+			}
+
+			Eventually(started).Should(HaveLen(2))
+			close(release)
+		})
+	})
+
+	Describe("stopping", func() {
+		It("abandons jobs that are still queued", func() {
+			queue = handlers.NewStagingQueue(lagertest.NewTestLogger("test"), 2, 1)
+			process := ginkgomon.Invoke(queue)
+
+			release := make(chan struct{})
+			started := make(chan struct{})
+			Expect(queue.Enqueue(0, func() {
+				close(started)
+				<-release
+			}, nil)).To(BeTrue())
+			Eventually(started).Should(BeClosed())
+
+			ran := make(chan struct{}, 1)
+			abandoned := make(chan struct{}, 1)
+			Expect(queue.Enqueue(0, func() { ran <- struct{}{} }, func() { abandoned <- struct{}{} })).To(BeTrue())
+
+			process.Signal(os.Interrupt)
+			Eventually(abandoned).Should(HaveLen(1))
+			close(release)
+			Eventually(process.Wait()).Should(Receive())
+
+			Expect(ran).To(BeEmpty())
+			Expect(queue.Len()).To(Equal(0))
+		})
+	})
+
+	Describe("Flush", func() {
+		It("abandons every queued job", func() {
+			abandoned := 0
+			Expect(queue.Enqueue(0, func() {}, func() { abandoned++ })).To(BeTrue())
+			Expect(queue.Enqueue(0, func() {}, func() { abandoned++ })).To(BeTrue())
+
+			Expect(queue.Flush()).To(Equal(2))
+			Expect(abandoned).To(Equal(2))
+			Expect(queue.Len()).To(Equal(0))
+		})
+
+		It("accepts jobs again once flushed, even with no workers running", func() {
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+			Expect(queue.Flush()).To(Equal(2))
+
+			enqueued := make(chan bool, 2)
+			go func() {
+				enqueued <- queue.Enqueue(0, func() {}, nil)
+				enqueued <- queue.Enqueue(0, func() {}, nil)
+			}()
+			Eventually(enqueued).Should(Receive(BeTrue()))
+			Eventually(enqueued).Should(Receive(BeTrue()))
+			Expect(queue.Len()).To(Equal(2))
+		})
+
+		It("runs the jobs queued after a flush", func() {
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+			Expect(queue.Enqueue(0, func() {}, nil)).To(BeTrue())
+			Expect(queue.Flush()).To(Equal(2))
+
+			ran := make(chan struct{}, 2)
+			Expect(queue.Enqueue(0, func() { ran <- struct{}{} }, nil)).To(BeTrue())
+			Expect(queue.Enqueue(0, func() { ran <- struct{}{} }, nil)).To(BeTrue())
+
+			process := ifrit.Invoke(queue)
+			defer ginkgomon.Interrupt(process)
+
+			Eventually(ran).Should(HaveLen(2))
+		})
+	})
+})
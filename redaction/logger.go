@@ -0,0 +1,70 @@
+package redaction
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type logger struct {
+	lager.Logger
+	redactor *Redactor
+}
+
+// NewLogger wraps the logger so that the data and errors of every log line,
+// including those of its sessions, are redacted before reaching its sinks.
+func NewLogger(l lager.Logger, redactor *Redactor) lager.Logger {
+	return &logger{Logger: l, redactor: redactor}
+}
+
+func (l *logger) Session(task string, data ...lager.Data) lager.Logger {
+	return &logger{Logger: l.Logger.Session(task, l.redactData(data)...), redactor: l.redactor}
+}
+
+func (l *logger) WithData(data lager.Data) lager.Logger {
+	return &logger{Logger: l.Logger.WithData(l.redactData([]lager.Data{data})[0]), redactor: l.redactor}
+}
+
+func (l *logger) Debug(action string, data ...lager.Data) {
+	l.Logger.Debug(action, l.redactData(data)...)
+}
+
+func (l *logger) Info(action string, data ...lager.Data) {
+	l.Logger.Info(action, l.redactData(data)...)
+}
+
+func (l *logger) Error(action string, err error, data ...lager.Data) {
+	l.Logger.Error(action, l.redactError(err), l.redactData(data)...)
+}
+
+func (l *logger) Fatal(action string, err error, data ...lager.Data) {
+	l.Logger.Fatal(action, l.redactError(err), l.redactData(data)...)
+}
+
+func (l *logger) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	message := l.redactor.RedactString(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return errors.New(message)
+}
+
+func (l *logger) redactData(data []lager.Data) []lager.Data {
+	redacted := make([]lager.Data, 0, len(data))
+	for _, d := range data {
+		r := lager.Data{}
+		for key, value := range d {
+			if secretKeyPattern.MatchString(key) {
+				r[key] = Redacted
+				continue
+			}
+			r[key] = l.redactor.RedactValue(value)
+		}
+		redacted = append(redacted, r)
+	}
+	return redacted
+}
@@ -0,0 +1,207 @@
+package redaction
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces every value removed from the logs. Secrets within URLs
+// are replaced by redactedURLValue, which needs no escaping.
+const (
+	Redacted         = "[REDACTED]"
+	redactedURLValue = "REDACTED"
+)
+
+// secretKeyPattern matches the names of fields whose values are always
+// secret, such as docker_password or cc_basic_auth_password.
+var secretKeyPattern = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|private_key|authorization)`)
+
+// signedQueryParameters are query parameters carrying signatures or
+// credentials in pre-signed blobstore and registry URLs.
+var signedQueryParameters = map[string]bool{
+	"signature":            true,
+	"sig":                  true,
+	"token":                true,
+	"access_token":         true,
+	"x-amz-signature":      true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+	"googleaccessid":       true,
+	"awsaccesskeyid":       true,
+}
+
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// Redactor masks secrets in log data: values of secret-looking fields,
+// environment variable values, URL userinfo, signed URL query parameters and
+// anything matching the configured extra patterns.
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+func NewRedactor(extraPatterns []string) (*Redactor, error) {
+	redactor := &Redactor{}
+	for _, pattern := range extraPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		redactor.patterns = append(redactor.patterns, compiled)
+	}
+	return redactor, nil
+}
+
+// RedactValue returns a copy of value, as generic JSON data, with secrets
+// masked. Values that cannot be represented as JSON are returned unchanged.
+func (r *Redactor) RedactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return r.RedactString(v)
+	case []byte:
+		return r.RedactString(string(v))
+	case error:
+		return r.RedactString(v.Error())
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var decoded interface{}
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		return value
+	}
+
+	return r.redactJSON(decoded)
+}
+
+// RedactString masks secrets in a log message. Strings holding a JSON
+// document, such as request payloads, are redacted field by field. A nil
+// Redactor returns the message unchanged.
+func (r *Redactor) RedactString(value string) string {
+	if r == nil {
+		return value
+	}
+
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var decoded interface{}
+		if json.Unmarshal([]byte(trimmed), &decoded) == nil {
+			encoded, err := json.Marshal(r.redactJSON(decoded))
+			if err == nil {
+				return string(encoded)
+			}
+		}
+	}
+
+	value = urlPattern.ReplaceAllStringFunc(value, redactURL)
+	for _, pattern := range r.patterns {
+		value = pattern.ReplaceAllString(value, Redacted)
+	}
+	return value
+}
+
+func (r *Redactor) redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if isEnvironmentVariable(v) {
+			v["value"] = Redacted
+			return v
+		}
+
+		for key, field := range v {
+			if secretKeyPattern.MatchString(key) {
+				if field != nil && field != "" {
+					v[key] = Redacted
+				}
+				continue
+			}
+			v[key] = r.redactJSON(field)
+		}
+		return v
+	case []interface{}:
+		for i, element := range v {
+			v[i] = r.redactJSON(element)
+		}
+		return v
+	case string:
+		return r.RedactString(v)
+	default:
+		return v
+	}
+}
+
+// isEnvironmentVariable recognises the {"name": ..., "value": ...} objects
+// used for environment variables in staging requests and task definitions.
+func isEnvironmentVariable(v map[string]interface{}) bool {
+	if len(v) != 2 {
+		return false
+	}
+	_, hasName := v["name"]
+	_, hasValue := v["value"]
+	return hasName && hasValue
+}
+
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	redacted := false
+	if parsed.User != nil {
+		parsed.User = url.User(redactedURLValue)
+		redacted = true
+	}
+
+	query := parsed.Query()
+	for key := range query {
+		if signedQueryParameters[strings.ToLower(key)] {
+			query.Set(key, redactedURLValue)
+			redacted = true
+		}
+	}
+
+	if !redacted {
+		return raw
+	}
+
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// StripURLSecrets returns rawURL without its userinfo and, if it is a signed
+// URL, without its query, which only holds signing material such as the
+// signature and its expiry. It is meant for URLs that are stored rather than
+// logged. rawURL is returned unchanged if it cannot be parsed.
+func StripURLSecrets(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	stripped := false
+	if parsed.User != nil {
+		parsed.User = nil
+		stripped = true
+	}
+
+	for key := range parsed.Query() {
+		if signedQueryParameters[strings.ToLower(key)] {
+			parsed.RawQuery = ""
+			stripped = true
+			break
+		}
+	}
+
+	if !stripped {
+		return rawURL
+	}
+	return parsed.String()
+}
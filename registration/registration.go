@@ -0,0 +1,102 @@
+package registration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Service registration backends selectable in the stager configuration.
+const (
+	Consul = "consul"
+	File   = "file"
+	None   = "none"
+)
+
+// Validate returns an error if mode is not a known registration backend. An
+// empty mode selects Consul.
+func Validate(mode string) error {
+	switch mode {
+	case "", Consul, File, None:
+		return nil
+	default:
+		return fmt.Errorf("unknown service registration '%s'", mode)
+	}
+}
+
+// Service describes the stager to a service registry.
+type Service struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	Port    int    `json:"port"`
+}
+
+// FileRunner registers the service by writing it as JSON to a file, for use
+// with file or DNS-SRV based discovery, and deregisters it by removing the
+// file when signalled.
+type FileRunner struct {
+	logger  lager.Logger
+	path    string
+	service Service
+}
+
+func NewFileRunner(logger lager.Logger, path string, service Service) *FileRunner {
+	return &FileRunner{
+		logger:  logger.Session("file-registration", lager.Data{"path": path}),
+		path:    path,
+		service: service,
+	}
+}
+
+func (r *FileRunner) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	err := r.register()
+	if err != nil {
+		r.logger.Error("failed-to-register", err)
+		return err
+	}
+	r.logger.Info("registered", lager.Data{"service": r.service})
+
+	close(ready)
+	<-signals
+
+	err = os.Remove(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		r.logger.Error("failed-to-deregister", err)
+		return err
+	}
+	r.logger.Info("deregistered")
+
+	return nil
+}
+
+func (r *FileRunner) register() error {
+	payload, err := json.Marshal(r.service)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	// temp files are only readable by their owner; the registration is read
+	// by other processes, such as the service discovery agent
+	err = tmpFile.Chmod(0644)
+	if err == nil {
+		_, err = tmpFile.Write(payload)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), r.path)
+}
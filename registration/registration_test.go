@@ -0,0 +1,73 @@
+package registration_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/stager/registration"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registration", func() {
+	Describe("Validate", func() {
+		It("accepts the known registration backends", func() {
+			for _, mode := range []string{"", registration.Consul, registration.File, registration.None} {
+				Expect(registration.Validate(mode)).To(Succeed())
+			}
+		})
+
+		It("rejects unknown registration backends", func() {
+			Expect(registration.Validate("zookeeper")).To(HaveOccurred())
+		})
+	})
+
+	Describe("FileRunner", func() {
+		var (
+			dir     string
+			path    string
+			process ifrit.Process
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "registration")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "stager.json")
+
+			runner := registration.NewFileRunner(lagertest.NewTestLogger("test"), path, registration.Service{
+				Name:    "stager",
+				Address: "10.0.0.1",
+				Port:    8888,
+			})
+			process = ginkgomon.Invoke(runner)
+		})
+
+		AfterEach(func() {
+			ginkgomon.Interrupt(process)
+			os.RemoveAll(dir)
+		})
+
+		It("writes the service to the file", func() {
+			contents, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{"name":"stager","address":"10.0.0.1","port":8888}`))
+		})
+
+		It("makes the file readable by other processes", func() {
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+		})
+
+		It("removes the file when stopped", func() {
+			ginkgomon.Interrupt(process)
+			Expect(path).NotTo(BeAnExistingFile())
+		})
+	})
+})
@@ -6,10 +6,20 @@ const (
 	StageRoute            = "Stage"
 	StopStagingRoute      = "StopStaging"
 	StagingCompletedRoute = "StagingCompleted"
+	HealthzRoute          = "Healthz"
+	ReadyzRoute           = "Readyz"
+	ReloadConfigRoute     = "ReloadConfig"
+	StagingFailuresRoute  = "StagingFailures"
+	StagingFailureRoute   = "StagingFailure"
 )
 
 var Routes = rata.Routes{
 	{Path: "/v1/staging/:staging_guid", Method: "PUT", Name: StageRoute},
 	{Path: "/v1/staging/:staging_guid", Method: "DELETE", Name: StopStagingRoute},
 	{Path: "/v1/staging/:staging_guid/completed", Method: "POST", Name: StagingCompletedRoute},
+	{Path: "/healthz", Method: "GET", Name: HealthzRoute},
+	{Path: "/readyz", Method: "GET", Name: ReadyzRoute},
+	{Path: "/v1/admin/reload", Method: "POST", Name: ReloadConfigRoute},
+	{Path: "/v1/admin/staging_failures", Method: "GET", Name: StagingFailuresRoute},
+	{Path: "/v1/admin/staging_failures/:staging_guid", Method: "GET", Name: StagingFailureRoute},
 }
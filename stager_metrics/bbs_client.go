@@ -0,0 +1,47 @@
+package stager_metrics
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/bbs"
+	"code.cloudfoundry.org/bbs/models"
+	"code.cloudfoundry.org/lager"
+)
+
+type bbsClient struct {
+	bbs.Client
+}
+
+// NewBBSClient wraps the BBS client to record the latency of the requests the
+// stager makes.
+func NewBBSClient(client bbs.Client) bbs.Client {
+	return &bbsClient{Client: client}
+}
+
+func (c *bbsClient) DesireTask(logger lager.Logger, taskGuid, domain string, taskDef *models.TaskDefinition) error {
+	start := time.Now()
+	err := c.Client.DesireTask(logger, taskGuid, domain, taskDef)
+	ObserveBBSRequest("desire_task", err, time.Since(start))
+	return err
+}
+
+func (c *bbsClient) TaskByGuid(logger lager.Logger, taskGuid string) (*models.Task, error) {
+	start := time.Now()
+	task, err := c.Client.TaskByGuid(logger, taskGuid)
+	ObserveBBSRequest("task_by_guid", err, time.Since(start))
+	return task, err
+}
+
+func (c *bbsClient) TasksByDomain(logger lager.Logger, domain string) ([]*models.Task, error) {
+	start := time.Now()
+	tasks, err := c.Client.TasksByDomain(logger, domain)
+	ObserveBBSRequest("tasks_by_domain", err, time.Since(start))
+	return tasks, err
+}
+
+func (c *bbsClient) CancelTask(logger lager.Logger, taskGuid string) error {
+	start := time.Now()
+	err := c.Client.CancelTask(logger, taskGuid)
+	ObserveBBSRequest("cancel_task", err, time.Since(start))
+	return err
+}
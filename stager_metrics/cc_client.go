@@ -0,0 +1,26 @@
+package stager_metrics
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/cc_client"
+	"code.cloudfoundry.org/stager/tracing"
+)
+
+type ccClient struct {
+	cc_client.CcClient
+}
+
+// NewCcClient wraps the CC client to record the latency of staging completion
+// requests.
+func NewCcClient(client cc_client.CcClient) cc_client.CcClient {
+	return &ccClient{CcClient: client}
+}
+
+func (c *ccClient) StagingComplete(stagingGuid string, completionCallback string, payload []byte, trace tracing.SpanContext, logger lager.Logger) error {
+	start := time.Now()
+	err := c.CcClient.StagingComplete(stagingGuid, completionCallback, payload, trace, logger)
+	ObserveCCRequest("staging_complete", err, time.Since(start))
+	return err
+}
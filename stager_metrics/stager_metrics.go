@@ -0,0 +1,237 @@
+package stager_metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/runtimeschema/cc_messages"
+	"code.cloudfoundry.org/runtimeschema/metric"
+	"code.cloudfoundry.org/stager/diego_errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "stager"
+
+// Sources of staging failures: a staging task that failed, or a staging
+// request that failed before its task could be desired.
+const (
+	StagingFailureSourceTask    = "task"
+	StagingFailureSourceRequest = "request"
+)
+
+// Registry holds every metric the stager exposes to Prometheus.
+var Registry = prometheus.NewRegistry()
+
+var stagingDurationBuckets = []float64{5, 10, 30, 60, 120, 300, 600, 900, 1800}
+
+var (
+	stagingDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "staging_duration_seconds",
+			Help:      "Time from desiring a staging task to its completion callback.",
+			Buckets:   stagingDurationBuckets,
+		},
+		[]string{"lifecycle", "stack", "isolation_segment", "error_id"},
+	)
+
+	stagingQueueDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "staging_queue_duration_seconds",
+			Help:      "Time staging tasks that were never placed on a cell spent waiting for one.",
+			Buckets:   stagingDurationBuckets,
+		},
+		[]string{"lifecycle", "stack"},
+	)
+
+	stagingFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "staging_failures_total",
+			Help:      "Failed staging requests by the error id reported to the Cloud Controller.",
+		},
+		[]string{"lifecycle", "error_id", "source"},
+	)
+
+	bbsRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "bbs_request_duration_seconds",
+			Help:      "Latency of requests to the BBS.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"operation", "outcome"},
+	)
+
+	ccRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cc_request_duration_seconds",
+			Help:      "Latency of requests to the Cloud Controller.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"operation", "outcome"},
+	)
+
+	lock       sync.Mutex
+	counters   = map[string]prometheus.Counter{}
+	histograms = map[string]prometheus.Histogram{}
+)
+
+func init() {
+	Registry.MustRegister(stagingDuration, stagingQueueDuration, stagingFailures, bbsRequestDuration, ccRequestDuration)
+}
+
+// Handler serves the Prometheus /metrics endpoint.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// Counter is a metric.Counter that is also exposed to Prometheus as
+// stager_<snake_case_name>_total. Counters should be registered with
+// RegisterCounters at startup so that they are exported before their first
+// increment.
+type Counter string
+
+// RegisterCounters registers the Prometheus counters for names.
+func RegisterCounters(names ...Counter) {
+	for _, name := range names {
+		prometheusCounter(string(name))
+	}
+}
+
+func (name Counter) Increment() {
+	metric.Counter(name).Increment()
+	prometheusCounter(string(name)).Inc()
+}
+
+// Duration is a metric.Duration that is also exposed to Prometheus as the
+// histogram stager_<snake_case_name>_seconds. Durations should be registered
+// with RegisterDurations at startup.
+type Duration string
+
+// RegisterDurations registers the Prometheus histograms for names.
+func RegisterDurations(names ...Duration) {
+	for _, name := range names {
+		prometheusHistogram(string(name))
+	}
+}
+
+func (name Duration) Send(duration time.Duration) error {
+	prometheusHistogram(string(name)).Observe(duration.Seconds())
+	return metric.Duration(name).Send(duration)
+}
+
+// ObserveStagingDuration records the duration of a completed staging task.
+// errorId is empty for successful staging.
+func ObserveStagingDuration(lifecycle, stack, isolationSegment, errorId string, duration time.Duration) {
+	stagingDuration.WithLabelValues(lifecycle, stack, isolationSegment, errorId).Observe(duration.Seconds())
+}
+
+// ObserveStagingQueueDuration records the time a staging task spent waiting
+// to be placed on a cell. It is also sent to dropsonde as
+// StagingQueueDuration.
+func ObserveStagingQueueDuration(lifecycle, stack string, duration time.Duration) error {
+	stagingQueueDuration.WithLabelValues(lifecycle, stack).Observe(duration.Seconds())
+	return metric.Duration("StagingQueueDuration").Send(duration)
+}
+
+// stagingFailureIds are the error ids that are counted in dropsonde under
+// their own name. Error ids from operator-configured failure rules are counted
+// as StagingFailedOther, so that the set of dropsonde metric names is fixed.
+var stagingFailureIds = map[string]bool{
+	cc_messages.STAGING_ERROR:                   true,
+	cc_messages.INSUFFICIENT_RESOURCES:          true,
+	cc_messages.NO_COMPATIBLE_CELL:              true,
+	cc_messages.CELL_COMMUNICATION_ERROR:        true,
+	cc_messages.BUILDPACK_DETECT_FAILED:         true,
+	cc_messages.BUILDPACK_COMPILE_FAILED:        true,
+	cc_messages.BUILDPACK_RELEASE_FAILED:        true,
+	diego_errors.STAGING_LIMIT_EXCEEDED_ID:      true,
+	diego_errors.STAGING_IN_PROGRESS_ID:         true,
+	diego_errors.STAGING_SUPERSEDED_ID:          true,
+	diego_errors.INVALID_STAGING_RESULT_ID:      true,
+	diego_errors.STAGING_OUT_OF_MEMORY_ID:       true,
+	diego_errors.STAGING_DISK_QUOTA_EXCEEDED_ID: true,
+	diego_errors.STAGING_TIMED_OUT_ID:           true,
+	diego_errors.STAGING_INTERRUPTED_ID:         true,
+	diego_errors.STAGING_QUEUE_FULL_ID:          true,
+}
+
+// IncrementStagingFailure counts a failed staging request by its lifecycle and
+// the error id reported to CC. It is also counted in dropsonde as
+// StagingFailed<ErrorId>, or StagingFailedOther for error ids that are not
+// built in.
+func IncrementStagingFailure(lifecycle, errorId, source string) {
+	stagingFailures.WithLabelValues(lifecycle, errorId, source).Inc()
+
+	if !stagingFailureIds[errorId] {
+		errorId = "Other"
+	}
+	metric.Counter("StagingFailed" + errorId).Increment()
+}
+
+func ObserveBBSRequest(operation string, err error, duration time.Duration) {
+	bbsRequestDuration.WithLabelValues(operation, outcome(err)).Observe(duration.Seconds())
+}
+
+func ObserveCCRequest(operation string, err error, duration time.Duration) {
+	ccRequestDuration.WithLabelValues(operation, outcome(err)).Observe(duration.Seconds())
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func prometheusCounter(name string) prometheus.Counter {
+	lock.Lock()
+	defer lock.Unlock()
+
+	counter, ok := counters[name]
+	if !ok {
+		counter = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      snakeCase(name) + "_total",
+			Help:      "Mirrors the " + name + " counter.",
+		})
+		Registry.MustRegister(counter)
+		counters[name] = counter
+	}
+
+	return counter
+}
+
+func prometheusHistogram(name string) prometheus.Histogram {
+	lock.Lock()
+	defer lock.Unlock()
+
+	histogram, ok := histograms[name]
+	if !ok {
+		histogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      snakeCase(strings.TrimSuffix(name, "Duration")) + "_duration_seconds",
+			Help:      "Mirrors the " + name + " duration.",
+			Buckets:   stagingDurationBuckets,
+		})
+		Registry.MustRegister(histogram)
+		histograms[name] = histogram
+	}
+
+	return histogram
+}
+
+var camelCaseBoundary = regexp.MustCompile("([a-z0-9])([A-Z])")
+
+func snakeCase(name string) string {
+	return strings.ToLower(camelCaseBoundary.ReplaceAllString(name, "${1}_${2}"))
+}
@@ -0,0 +1,13 @@
+package stager_metrics_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestStagerMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "StagerMetrics Suite")
+}
@@ -0,0 +1,185 @@
+package stager_metrics_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/stager/stager_metrics"
+	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StagerMetrics", func() {
+	var fakeMetricSender *fake_metric_sender.FakeMetricSender
+
+	findMetricFamily := func(name string) *dto.MetricFamily {
+		families, err := stager_metrics.Registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, family := range families {
+			if family.GetName() == name {
+				return family
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		fakeMetricSender = fake_metric_sender.NewFakeMetricSender()
+		metrics.Initialize(fakeMetricSender, nil)
+	})
+
+	Describe("Counter", func() {
+		It("increments both the dropsonde and the Prometheus counter", func() {
+			counter := stager_metrics.Counter("SomeTestEvents")
+			counter.Increment()
+			counter.Increment()
+
+			Expect(fakeMetricSender.GetCounter("SomeTestEvents")).To(Equal(uint64(2)))
+
+			family := findMetricFamily("stager_some_test_events_total")
+			Expect(family).NotTo(BeNil())
+			Expect(family.GetMetric()[0].GetCounter().GetValue()).To(Equal(float64(2)))
+		})
+	})
+
+	Describe("RegisterCounters", func() {
+		It("exports the counters before they are incremented", func() {
+			stager_metrics.RegisterCounters(stager_metrics.Counter("RegisteredTestEvents"))
+
+			family := findMetricFamily("stager_registered_test_events_total")
+			Expect(family).NotTo(BeNil())
+			Expect(family.GetMetric()[0].GetCounter().GetValue()).To(Equal(float64(0)))
+		})
+	})
+
+	Describe("RegisterDurations", func() {
+		It("exports the histograms before they are observed", func() {
+			stager_metrics.RegisterDurations(stager_metrics.Duration("RegisteredTestDuration"))
+
+			family := findMetricFamily("stager_registered_test_duration_seconds")
+			Expect(family).NotTo(BeNil())
+			Expect(family.GetMetric()[0].GetHistogram().GetSampleCount()).To(Equal(uint64(0)))
+		})
+	})
+
+	Describe("Duration", func() {
+		It("sends the dropsonde value and observes the Prometheus histogram", func() {
+			err := stager_metrics.Duration("SomeTestDuration").Send(2 * time.Second)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeMetricSender.GetValue("SomeTestDuration").Value).To(Equal(float64(2 * time.Second)))
+
+			family := findMetricFamily("stager_some_test_duration_seconds")
+			Expect(family).NotTo(BeNil())
+			Expect(family.GetMetric()[0].GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+			Expect(family.GetMetric()[0].GetHistogram().GetSampleSum()).To(Equal(float64(2)))
+		})
+	})
+
+	Describe("ObserveStagingQueueDuration", func() {
+		It("labels the queue duration and sends it to dropsonde", func() {
+			err := stager_metrics.ObserveStagingQueueDuration("buildpack", "cflinuxfs2", 40*time.Second)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeMetricSender.GetValue("StagingQueueDuration").Value).To(Equal(float64(40 * time.Second)))
+
+			family := findMetricFamily("stager_staging_queue_duration_seconds")
+			Expect(family).NotTo(BeNil())
+
+			labels := map[string]string{}
+			for _, label := range family.GetMetric()[0].GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			Expect(labels).To(Equal(map[string]string{
+				"lifecycle": "buildpack",
+				"stack":     "cflinuxfs2",
+			}))
+		})
+	})
+
+	Describe("IncrementStagingFailure", func() {
+		It("counts failures by lifecycle, error id and source", func() {
+			stager_metrics.IncrementStagingFailure("docker", "NoCompatibleCell", stager_metrics.StagingFailureSourceTask)
+			stager_metrics.IncrementStagingFailure("docker", "NoCompatibleCell", stager_metrics.StagingFailureSourceTask)
+			stager_metrics.IncrementStagingFailure("docker", "StagingError", stager_metrics.StagingFailureSourceRequest)
+
+			Expect(fakeMetricSender.GetCounter("StagingFailedNoCompatibleCell")).To(Equal(uint64(2)))
+			Expect(fakeMetricSender.GetCounter("StagingFailedStagingError")).To(Equal(uint64(1)))
+
+			family := findMetricFamily("stager_staging_failures_total")
+			Expect(family).NotTo(BeNil())
+
+			dockerSeries := 0
+			for _, series := range family.GetMetric() {
+				for _, label := range series.GetLabel() {
+					if label.GetName() == "lifecycle" && label.GetValue() == "docker" {
+						dockerSeries++
+					}
+				}
+			}
+			Expect(dockerSeries).To(Equal(2))
+		})
+
+		It("counts error ids that are not built in as other failures in dropsonde", func() {
+			stager_metrics.IncrementStagingFailure("buildpack", "OperatorDefinedFailure", stager_metrics.StagingFailureSourceTask)
+
+			Expect(fakeMetricSender.GetCounter("StagingFailedOperatorDefinedFailure")).To(BeZero())
+			Expect(fakeMetricSender.GetCounter("StagingFailedOther")).To(Equal(uint64(1)))
+		})
+	})
+
+	Describe("ObserveStagingDuration", func() {
+		It("labels the staging duration", func() {
+			stager_metrics.ObserveStagingDuration("buildpack", "cflinuxfs2", "segment", "InsufficientResources", time.Minute)
+
+			family := findMetricFamily("stager_staging_duration_seconds")
+			Expect(family).NotTo(BeNil())
+
+			labels := map[string]string{}
+			for _, label := range family.GetMetric()[0].GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			Expect(labels).To(Equal(map[string]string{
+				"lifecycle":         "buildpack",
+				"stack":             "cflinuxfs2",
+				"isolation_segment": "segment",
+				"error_id":          "InsufficientResources",
+			}))
+		})
+	})
+
+	Describe("ObserveBBSRequest", func() {
+		It("labels the request by operation and outcome", func() {
+			stager_metrics.ObserveBBSRequest("desire_task", errors.New("boom"), time.Millisecond)
+
+			family := findMetricFamily("stager_bbs_request_duration_seconds")
+			Expect(family).NotTo(BeNil())
+			Expect(family.GetMetric()[0].GetLabel()).To(HaveLen(2))
+		})
+	})
+
+	Describe("Handler", func() {
+		It("serves the registry on /metrics", func() {
+			stager_metrics.Counter("ServedEvents").Increment()
+
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest("GET", "/metrics", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			stager_metrics.Handler().ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			body, err := ioutil.ReadAll(recorder.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring("stager_served_events_total 1"))
+		})
+	})
+})
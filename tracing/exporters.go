@@ -0,0 +1,233 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/stager/redaction"
+)
+
+const (
+	otlpBatchSize     = 100
+	otlpQueueSize     = 1000
+	otlpExportTimeout = 5 * time.Second
+
+	otlpSpanKindServer    = 2
+	otlpStatusCodeOk      = 1
+	otlpStatusCodeError   = 2
+	otlpTracesPath        = "/v1/traces"
+	otlpServiceNameKey    = "service.name"
+	otlpInstrumentationID = "code.cloudfoundry.org/stager"
+)
+
+// WriterExporter writes each finished span to a writer as a line of OTLP
+// JSON. It is intended for tests and local debugging.
+type WriterExporter struct {
+	serviceName string
+	redactor    *redaction.Redactor
+
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterExporter(serviceName string, writer io.Writer, redactor *redaction.Redactor) *WriterExporter {
+	return &WriterExporter{
+		serviceName: serviceName,
+		redactor:    redactor,
+		writer:      writer,
+	}
+}
+
+func (e *WriterExporter) Export(span *Span) {
+	payload, err := json.Marshal(newOTLPRequest(e.serviceName, e.redactor, []*Span{span}))
+	if err != nil {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.writer.Write(append(payload, '\n'))
+}
+
+// OTLPExporter posts finished spans in batches to an OTLP/HTTP collector
+// using the JSON encoding. Spans are dropped if the collector falls behind.
+// The exporter only sends spans while it is running. Span errors are
+// redacted, as they may quote the URLs and payloads of failed requests.
+type OTLPExporter struct {
+	logger      lager.Logger
+	url         string
+	serviceName string
+	redactor    *redaction.Redactor
+	httpClient  *http.Client
+	spans       chan *Span
+}
+
+func NewOTLPExporter(logger lager.Logger, endpoint, serviceName string, redactor *redaction.Redactor) *OTLPExporter {
+	return &OTLPExporter{
+		logger:      logger.Session("otlp-exporter"),
+		url:         strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		serviceName: serviceName,
+		redactor:    redactor,
+		httpClient:  &http.Client{Timeout: otlpExportTimeout},
+		spans:       make(chan *Span, otlpQueueSize),
+	}
+}
+
+func (e *OTLPExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		e.logger.Debug("dropped-span", lager.Data{"name": span.Name})
+	}
+}
+
+func (e *OTLPExporter) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	for {
+		select {
+		case span := <-e.spans:
+			e.send(e.batch(span))
+		case <-signals:
+			for len(e.spans) > 0 {
+				e.send(e.batch(<-e.spans))
+			}
+			return nil
+		}
+	}
+}
+
+func (e *OTLPExporter) batch(first *Span) []*Span {
+	batch := []*Span{first}
+	for len(batch) < otlpBatchSize {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (e *OTLPExporter) send(spans []*Span) {
+	payload, err := json.Marshal(newOTLPRequest(e.serviceName, e.redactor, spans))
+	if err != nil {
+		e.logger.Error("marshal-spans-failed", err)
+		return
+	}
+
+	response, err := e.httpClient.Post(e.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		e.logger.Error("export-spans-failed", err, lager.Data{"spans": len(spans)})
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		e.logger.Error("export-spans-failed", fmt.Errorf("collector responded with %d", response.StatusCode), lager.Data{"spans": len(spans)})
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPRequest(serviceName string, redactor *redaction.Redactor, spans []*Span) otlpRequest {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, newOTLPSpan(span, redactor))
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: otlpServiceNameKey, Value: otlpAttributeValue{StringValue: serviceName}}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: otlpInstrumentationID},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func newOTLPSpan(span *Span, redactor *redaction.Redactor) otlpSpan {
+	otlp := otlpSpan{
+		TraceId:           hex.EncodeToString(span.Context.TraceID[:]),
+		SpanId:            hex.EncodeToString(span.Context.SpanID[:]),
+		Name:              span.Name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusCodeOk},
+	}
+
+	if span.ParentSpanID != [8]byte{} {
+		otlp.ParentSpanId = hex.EncodeToString(span.ParentSpanID[:])
+	}
+
+	for key, value := range span.Attributes() {
+		otlp.Attributes = append(otlp.Attributes, otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: value}})
+	}
+
+	if span.Err != nil {
+		otlp.Status = otlpStatus{Code: otlpStatusCodeError, Message: redactor.RedactString(span.Err.Error())}
+	}
+
+	return otlp
+}
@@ -0,0 +1,209 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header used to propagate traces
+// between the stager, its callers and CC.
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent encodes the span context as a W3C traceparent header value. It
+// returns an empty string for an invalid span context.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent decodes a W3C traceparent header value, returning an
+// invalid span context if the value is malformed.
+func ParseTraceparent(value string) SpanContext {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	if !sc.IsValid() {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// Inject sets the traceparent header if the span context is valid.
+func Inject(header http.Header, sc SpanContext) {
+	if traceparent := sc.Traceparent(); traceparent != "" {
+		header.Set(TraceparentHeader, traceparent)
+	}
+}
+
+// Extract reads the span context from the traceparent header.
+func Extract(header http.Header) SpanContext {
+	return ParseTraceparent(header.Get(TraceparentHeader))
+}
+
+// Span is a timed operation within a trace. Spans must be finished with End.
+type Span struct {
+	tracer *Tracer
+
+	Name         string
+	Context      SpanContext
+	ParentSpanID [8]byte
+	StartTime    time.Time
+	EndTime      time.Time
+	Err          error
+
+	lock       sync.Mutex
+	attributes map[string]string
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *Span) Attributes() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	attributes := make(map[string]string, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
+
+// End finishes the span, recording err as its status, and exports it.
+func (s *Span) End(err error) {
+	s.EndAt(time.Now(), err)
+}
+
+func (s *Span) EndAt(end time.Time, err error) {
+	if s == nil {
+		return
+	}
+
+	s.EndTime = end
+	s.Err = err
+
+	if s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Exporter receives finished spans. Implementations must not block.
+type Exporter interface {
+	Export(span *Span)
+}
+
+type noopExporter struct{}
+
+func (noopExporter) Export(*Span) {}
+
+// Tracer starts spans and hands them to its exporter once finished.
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+}
+
+// NewTracer returns a tracer exporting to exporter, or a tracer that records
+// nothing if exporter is nil. Spans with a parent follow its sampling
+// decision; new traces are sampled with probability sampleRatio, so that a
+// ratio of 0 only records the traces sampled by the stager's callers.
+func NewTracer(exporter Exporter, sampleRatio float64) *Tracer {
+	if exporter == nil {
+		exporter = noopExporter{}
+	}
+	return &Tracer{exporter: exporter, sampleRatio: sampleRatio}
+}
+
+// StartSpan starts a span as a child of parent, or as the root of a new trace
+// if parent is invalid.
+func (t *Tracer) StartSpan(name string, parent SpanContext) *Span {
+	return t.StartSpanAt(name, parent, time.Now())
+}
+
+func (t *Tracer) StartSpanAt(name string, parent SpanContext, start time.Time) *Span {
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		StartTime:  start,
+		attributes: map[string]string{},
+	}
+
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = t.sampleRoot(span.Context.TraceID)
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return span
+}
+
+// sampleRoot decides from the random part of the trace id whether to sample
+// a new trace, so that the decision is consistent for the whole trace.
+func (t *Tracer) sampleRoot(traceID [16]byte) bool {
+	switch {
+	case t.sampleRatio >= 1:
+		return true
+	case t.sampleRatio <= 0:
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])) < t.sampleRatio*math.MaxUint64
+}
+
+// StartSpanFromRequest starts a span continuing the trace propagated in the
+// request headers, if any.
+func (t *Tracer) StartSpanFromRequest(name string, req *http.Request) *Span {
+	return t.StartSpan(name, Extract(req.Header))
+}
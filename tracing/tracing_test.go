@@ -0,0 +1,137 @@
+package tracing_test
+
+import (
+	"errors"
+	"net/http"
+
+	"code.cloudfoundry.org/stager/tracing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Tracing", func() {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	Describe("ParseTraceparent", func() {
+		It("round-trips a valid traceparent", func() {
+			sc := tracing.ParseTraceparent(traceparent)
+			Expect(sc.IsValid()).To(BeTrue())
+			Expect(sc.Sampled).To(BeTrue())
+			Expect(sc.Traceparent()).To(Equal(traceparent))
+		})
+
+		It("rejects malformed values", func() {
+			for _, value := range []string{
+				"",
+				"garbage",
+				"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+			} {
+				Expect(tracing.ParseTraceparent(value).IsValid()).To(BeFalse(), value)
+			}
+		})
+	})
+
+	Describe("Inject and Extract", func() {
+		It("propagates the span context through headers", func() {
+			header := http.Header{}
+			tracing.Inject(header, tracing.ParseTraceparent(traceparent))
+			Expect(header.Get("traceparent")).To(Equal(traceparent))
+			Expect(tracing.Extract(header).Traceparent()).To(Equal(traceparent))
+		})
+
+		It("does not set the header for an invalid span context", func() {
+			header := http.Header{}
+			tracing.Inject(header, tracing.SpanContext{})
+			Expect(header).To(BeEmpty())
+		})
+	})
+
+	Describe("Tracer", func() {
+		var (
+			output *gbytes.Buffer
+			tracer *tracing.Tracer
+		)
+
+		BeforeEach(func() {
+			output = gbytes.NewBuffer()
+			tracer = tracing.NewTracer(tracing.NewWriterExporter("stager", output, nil), 1)
+		})
+
+		It("starts a child span of the parent", func() {
+			parent := tracing.ParseTraceparent(traceparent)
+			span := tracer.StartSpan("child", parent)
+
+			Expect(span.Context.TraceID).To(Equal(parent.TraceID))
+			Expect(span.Context.SpanID).NotTo(Equal(parent.SpanID))
+			Expect(span.ParentSpanID).To(Equal(parent.SpanID))
+		})
+
+		It("starts a new sampled trace without a parent", func() {
+			span := tracer.StartSpan("root", tracing.SpanContext{})
+			Expect(span.Context.IsValid()).To(BeTrue())
+			Expect(span.Context.Sampled).To(BeTrue())
+			Expect(span.ParentSpanID).To(BeZero())
+		})
+
+		Context("with a sample ratio of 0", func() {
+			BeforeEach(func() {
+				tracer = tracing.NewTracer(tracing.NewWriterExporter("stager", output, nil), 0)
+			})
+
+			It("does not sample new traces", func() {
+				span := tracer.StartSpan("root", tracing.SpanContext{})
+				Expect(span.Context.IsValid()).To(BeTrue())
+				Expect(span.Context.Sampled).To(BeFalse())
+
+				span.End(nil)
+				Consistently(output.Contents).Should(BeEmpty())
+			})
+
+			It("follows the sampling decision of the parent", func() {
+				span := tracer.StartSpan("child", tracing.ParseTraceparent(traceparent))
+				Expect(span.Context.Sampled).To(BeTrue())
+			})
+		})
+
+		It("samples a share of new traces with a fractional sample ratio", func() {
+			tracer = tracing.NewTracer(nil, 0.5)
+
+			sampled := 0
+			for i := 0; i < 1000; i++ {
+				if tracer.StartSpan("root", tracing.SpanContext{}).Context.Sampled {
+					sampled++
+				}
+			}
+			Expect(sampled).To(BeNumerically("~", 500, 100))
+		})
+
+		It("exports finished spans", func() {
+			span := tracer.StartSpan("stage", tracing.ParseTraceparent(traceparent))
+			span.SetAttribute("staging_guid", "some-guid")
+			span.End(errors.New("boom"))
+
+			Eventually(output).Should(gbytes.Say(`"service.name","value":{"stringValue":"stager"}`))
+			Eventually(output).Should(gbytes.Say(`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`))
+			Eventually(output).Should(gbytes.Say(`"parentSpanId":"00f067aa0ba902b7","name":"stage"`))
+			Eventually(output).Should(gbytes.Say(`"key":"staging_guid","value":{"stringValue":"some-guid"}`))
+			Eventually(output).Should(gbytes.Say(`"status":{"code":2,"message":"boom"}`))
+		})
+
+		It("does not export spans of unsampled traces", func() {
+			span := tracer.StartSpan("stage", tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+			span.End(nil)
+
+			Consistently(output.Contents).Should(BeEmpty())
+		})
+
+		It("records nothing without an exporter", func() {
+			span := tracing.NewTracer(nil, 1).StartSpan("stage", tracing.SpanContext{})
+			Expect(func() { span.End(nil) }).NotTo(Panic())
+		})
+	})
+})